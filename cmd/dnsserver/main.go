@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/api"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/dnsresolver"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+)
+
+var (
+	configPath = flag.String("config", "/app/config.yaml", "Path to configuration file")
+	apiListen  = flag.String("api-listen", "", "Overrides dns.api_listen, e.g. \":8053\" inside a container whose port is published on the host loopback")
+)
+
+// dnsserver runs inside the DNS container: the resolver and, when
+// dns.api_listen is set, the API with the resolver endpoints.
+func main() {
+	flag.Parse()
+
+	cfg, err := config.LoadFromFile(*configPath)
+	if err != nil {
+		logger.Errorf("Failed to load configuration: %v", err)
+		os.Exit(1)
+	}
+	logger.SetLevel(cfg.Logging.Level)
+	if *apiListen != "" {
+		cfg.DNS.APIListen = *apiListen
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	resolver := dnsresolver.NewResolver(cfg.DNS)
+
+	if cfg.DNS.APIListen != "" {
+		apiCfg := cfg.API
+		apiCfg.Listen = cfg.DNS.APIListen
+		go func() {
+			if err := api.Start(ctx, apiCfg, resolver); err != nil {
+				logger.Errorf("API server error: %v", err)
+				stop()
+			}
+		}()
+	}
+
+	if err := dnsresolver.Serve(ctx, cfg.DNS, resolver); err != nil {
+		logger.Errorf("DNS server error: %v", err)
+		os.Exit(1)
+	}
+	logger.Infof("DNS server stopped")
+}
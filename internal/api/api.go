@@ -2,36 +2,57 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/dnsresolver"
 	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/metrics"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
-func CreateRouter() http.Handler {
+// CreateRouter builds the API routes. Resolver endpoints are mounted only
+// when the resolver runs in the same process.
+func CreateRouter(cfg config.APIConfig, resolver *dnsresolver.Resolver) http.Handler {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
 	r.Use(loggingMiddleware)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 
-	r.Get("/health", healthHandler)
-	r.Get("/config", configHandler)
-	r.Post("/restart", restartHandler)
+	// DoH picks profiles and limits by client address, so it must see the
+	// socket address and not headers rewritten by RealIP
+	if resolver != nil {
+		mountDoH(r, resolver)
+	}
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RealIP)
+
+		r.Get("/health", healthHandler)
+		r.Get("/config", configHandler)
+		r.Post("/restart", restartHandler)
+		r.Method(http.MethodGet, "/metrics", metrics.Handler())
+
+		if resolver != nil {
+			mountResolver(r, resolver, requireAPIKey(cfg.APIKey))
+		}
+	})
 
 	return r
 }
 
-func Start(ctx context.Context, cfg config.APIConfig) error {
+func Start(ctx context.Context, cfg config.APIConfig, resolver *dnsresolver.Resolver) error {
 	server := &http.Server{
 		Addr:         cfg.Listen,
-		Handler:      CreateRouter(),
+		Handler:      CreateRouter(cfg, resolver),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -57,6 +78,26 @@ func Start(ctx context.Context, cfg config.APIConfig) error {
 	}
 }
 
+// requireAPIKey guards routes that change the resolver or expose what
+// clients browse. They stay closed while no key is configured.
+func requireAPIKey(key string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key == "" {
+				writeError(w, http.StatusForbidden, fmt.Errorf("api.api_key is not set"))
+				return
+			}
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing API key"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -86,3 +127,15 @@ func restartHandler(w http.ResponseWriter, r *http.Request) {
 		"message": "Restart initiated",
 	})
 }
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/dnsresolver"
+	"github.com/miekg/dns"
+)
+
+func TestDoHIgnoresForwardingHeaders(t *testing.T) {
+	resolver := dnsresolver.NewResolver(config.DNSConfig{
+		CacheSize:      100,
+		AllowedClients: []string{"192.168.1.0/24"},
+		RefuseAny:      true,
+	})
+	router := CreateRouter(config.APIConfig{}, resolver)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeANY)
+	wire, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := dnsresolver.DoHPath + "?dns=" + base64.RawURLEncoding.EncodeToString(wire)
+
+	tests := []struct {
+		name  string
+		peer  string
+		rcode int
+	}{
+		{name: "LAN client", peer: "192.168.1.10:40000", rcode: dns.RcodeSuccess},
+		{name: "outside client claiming a LAN address", peer: "203.0.113.9:40000", rcode: dns.RcodeRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.RemoteAddr = tt.peer
+			req.Header.Set("X-Forwarded-For", "192.168.1.10")
+			req.Header.Set("X-Real-IP", "192.168.1.10")
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("HTTP %d: %s", rec.Code, rec.Body)
+			}
+
+			resp := new(dns.Msg)
+			if err := resp.Unpack(rec.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Rcode != tt.rcode {
+				t.Fatalf("rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+		})
+	}
+}
+
+func TestResolverRoutes(t *testing.T) {
+	get := func(router http.Handler, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	// Without a resolver the routes are not mounted
+	if rec := get(CreateRouter(config.APIConfig{}, nil), "/profiles/"+dnsresolver.DefaultProfile); rec.Code != http.StatusNotFound {
+		t.Fatalf("HTTP %d without a resolver", rec.Code)
+	}
+
+	router := CreateRouter(config.APIConfig{}, dnsresolver.NewResolver(config.DNSConfig{CacheSize: 100}))
+	rec := get(router, "/profiles/"+dnsresolver.DefaultProfile)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("HTTP %d: %s", rec.Code, rec.Body)
+	}
+	var profile config.ProfileConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name != dnsresolver.DefaultProfile {
+		t.Fatalf("profile %q, want %q", profile.Name, dnsresolver.DefaultProfile)
+	}
+
+	if rec := get(router, "/profiles/missing"); rec.Code != http.StatusNotFound {
+		t.Fatalf("HTTP %d for a missing profile", rec.Code)
+	}
+}
+
+func TestResolverAuth(t *testing.T) {
+	const key = "secret"
+
+	tests := []struct {
+		name   string
+		key    string // configured api_key
+		method string
+		target string
+		token  string
+		status int
+	}{
+		{name: "read without token", key: key, method: http.MethodGet, target: "/profiles/", status: http.StatusOK},
+		{name: "change without token", key: key, method: http.MethodPut, target: "/profiles/kids", status: http.StatusUnauthorized},
+		{name: "change with wrong token", key: key, method: http.MethodPut, target: "/profiles/kids", token: "guess", status: http.StatusUnauthorized},
+		{name: "change with token", key: key, method: http.MethodPut, target: "/profiles/kids", token: key, status: http.StatusOK},
+		{name: "delete client without token", key: key, method: http.MethodDelete, target: "/clients/tablet", status: http.StatusUnauthorized},
+		{name: "query log without token", key: key, method: http.MethodGet, target: "/querylog", status: http.StatusUnauthorized},
+		{name: "query log with token", key: key, method: http.MethodGet, target: "/querylog", token: key, status: http.StatusOK},
+		{name: "no key configured", method: http.MethodPut, target: "/profiles/kids", status: http.StatusForbidden},
+		{name: "no key configured, token sent", method: http.MethodGet, target: "/querylog", token: "anything", status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := CreateRouter(config.APIConfig{APIKey: tt.key}, dnsresolver.NewResolver(config.DNSConfig{CacheSize: 100}))
+
+			var body io.Reader
+			if tt.method == http.MethodPut {
+				body = strings.NewReader(`{"blocklist": ["tiktok.com"]}`)
+			}
+			req := httptest.NewRequest(tt.method, tt.target, body)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("HTTP %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
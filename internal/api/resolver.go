@@ -0,0 +1,213 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/dnsresolver"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/querylog"
+	"github.com/go-chi/chi/v5"
+)
+
+type resolverHandlers struct {
+	resolver *dnsresolver.Resolver
+}
+
+// mountResolver adds the resolver endpoints. Changes and the query log go
+// through auth.
+func mountResolver(r chi.Router, resolver *dnsresolver.Resolver, auth func(http.Handler) http.Handler) {
+	h := &resolverHandlers{resolver: resolver}
+
+	r.Route("/profiles", func(r chi.Router) {
+		r.Get("/", h.listProfiles)
+		r.Get("/{name}", h.getProfile)
+		r.With(auth).Put("/{name}", h.putProfile)
+		r.With(auth).Delete("/{name}", h.deleteProfile)
+	})
+
+	r.Route("/clients", func(r chi.Router) {
+		r.Get("/", h.listClients)
+		r.With(auth).Put("/{name}", h.putClient)
+		r.With(auth).Delete("/{name}", h.deleteClient)
+	})
+	r.Get("/identities", h.listIdentities)
+	r.Get("/dhcp/leases", h.listDHCPLeases)
+
+	r.Get("/schedules", h.listSchedules)
+	r.Get("/filter/check", h.checkFilter)
+	r.With(auth).Get("/querylog", h.searchQueryLog)
+	r.Get("/stats", h.getStats)
+	r.Get("/ratelimit", h.getRateLimit)
+}
+
+// mountDoH serves DNS-over-HTTPS for clients that reach the API.
+func mountDoH(r chi.Router, resolver *dnsresolver.Resolver) {
+	doh := dnsresolver.NewDoHHandler(resolver)
+	r.Handle(dnsresolver.DoHPath, doh)
+	r.Handle(dnsresolver.JSONPath, doh)
+}
+
+func (h *resolverHandlers) listProfiles(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.resolver.Profiles())
+}
+
+func (h *resolverHandlers) getProfile(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	profile, ok := h.resolver.Profile(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("profile %q not found", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+func (h *resolverHandlers) putProfile(w http.ResponseWriter, r *http.Request) {
+	var profile config.ProfileConfig
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	profile.Name = chi.URLParam(r, "name")
+
+	if err := h.resolver.SetProfile(profile); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+func (h *resolverHandlers) deleteProfile(w http.ResponseWriter, r *http.Request) {
+	if err := h.resolver.DeleteProfile(chi.URLParam(r, "name")); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *resolverHandlers) listClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.resolver.Clients())
+}
+
+// listIdentities shows the names and MACs known for client addresses.
+func (h *resolverHandlers) listIdentities(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.resolver.Identities())
+}
+
+func (h *resolverHandlers) listDHCPLeases(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.resolver.DHCPLeases())
+}
+
+func (h *resolverHandlers) putClient(w http.ResponseWriter, r *http.Request) {
+	var client config.ClientConfig
+	if err := json.NewDecoder(r.Body).Decode(&client); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	client.Name = chi.URLParam(r, "name")
+
+	if err := h.resolver.SetClient(client); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, client)
+}
+
+func (h *resolverHandlers) deleteClient(w http.ResponseWriter, r *http.Request) {
+	if err := h.resolver.DeleteClient(chi.URLParam(r, "name")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *resolverHandlers) listSchedules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.resolver.Schedules())
+}
+
+// checkFilter explains why a domain is blocked or allowed for a client.
+func (h *resolverHandlers) checkFilter(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("domain is required"))
+		return
+	}
+	client := r.URL.Query().Get("client")
+
+	profile, decision := h.resolver.Check(client, domain)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"domain":   domain,
+		"client":   client,
+		"profile":  profile,
+		"decision": decision,
+	})
+}
+
+// searchQueryLog serves paginated query log records, newest first.
+func (h *resolverHandlers) searchQueryLog(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := querylog.Query{
+		Client:   params.Get("client"),
+		Domain:   params.Get("domain"),
+		Decision: params.Get("decision"),
+		Limit:    100,
+	}
+
+	var err error
+	for name, dst := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		if v := params.Get(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil || *dst < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s %q", name, v))
+				return
+			}
+		}
+	}
+	for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := params.Get(name); v != "" {
+			if *dst, err = time.Parse(time.RFC3339, v); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s %q, expected RFC 3339", name, v))
+				return
+			}
+		}
+	}
+
+	records, total := h.resolver.QueryLog().Search(q)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total":   total,
+		"offset":  q.Offset,
+		"limit":   q.Limit,
+		"records": records,
+	})
+}
+
+// getStats serves aggregated counters for a window: 1h, 24h (default) or 7d.
+func (h *resolverHandlers) getStats(w http.ResponseWriter, r *http.Request) {
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "24h"
+	}
+
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		limit = n
+	}
+
+	snapshot, err := h.resolver.Stats().Snapshot(window, limit, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func (h *resolverHandlers) getRateLimit(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.resolver.RateLimits())
+}
@@ -2,23 +2,260 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"gopkg.in/yaml.v3"
 )
 
+var Weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
 type DNSConfig struct {
-	Listen          string        `yaml:"listen"`
-	Upstreams       []string      `yaml:"upstreams"`
-	DoHUpstreams    []string      `yaml:"doh_upstreams"`
-	Timeout         time.Duration `yaml:"timeout"`
-	CacheSize       int           `yaml:"cache_size"`
-	CacheTTL        int           `yaml:"cache_ttl"`
-	EnableFiltering bool          `yaml:"enable_filtering"`
-	Blocklist       []string      `yaml:"blocklist"`
-	Allowlist       []string      `yaml:"allowlist"`
+	Listen            string        `yaml:"listen"`             // UDP and TCP, unless listen_udp/listen_tcp are set
+	Upstreams         []string      `yaml:"upstreams"`          // DoT host:port or sdns:// stamps
+	DoHUpstreams      []string      `yaml:"doh_upstreams"`      // DoH URLs or sdns:// stamps
+	DNSCryptUpstreams []string      `yaml:"dnscrypt_upstreams"` // sdns:// stamps
+	ODoHUpstreams     []ODoHConfig  `yaml:"odoh_upstreams"`
+	Timeout           time.Duration `yaml:"timeout"`
+	CacheSize         int           `yaml:"cache_size"`
+	CacheTTL          int           `yaml:"cache_ttl"`
+	EnableFiltering   bool          `yaml:"enable_filtering"`
+	Blocklist         []string      `yaml:"blocklist"`
+	Allowlist         []string      `yaml:"allowlist"`
+
+	// Plain DNS listeners, host:port with IPv6 hosts in brackets
+	ListenUDP        []string `yaml:"listen_udp"`
+	ListenTCP        []string `yaml:"listen_tcp"`
+	SocketActivation bool     `yaml:"socket_activation"` // use sockets passed by systemd
+
+	// Response filtering by resolved addresses
+	IPBlocklist         []string `yaml:"ip_blocklist"`
+	IPBlockMode         string   `yaml:"ip_block_mode"` // strip, block
+	RebindingProtection bool     `yaml:"rebinding_protection"`
+	RebindingAllowlist  []string `yaml:"rebinding_allowlist"`
+
+	// HTTPS/SVCB answers: keep, strip_ech or drop
+	SVCBPolicy string `yaml:"svcb_policy"`
+
+	// Per-client policies
+	BlockMode      string               `yaml:"block_mode"` // nxdomain, null_ip, refused
+	Profiles       []ProfileConfig      `yaml:"profiles"`
+	Clients        []ClientConfig       `yaml:"clients"`
+	ClientIdentity ClientIdentityConfig `yaml:"client_identity"`
+
+	// Local answers
+	SafeSearch bool            `yaml:"safe_search"`
+	Rewrites   []RewriteConfig `yaml:"rewrites"`
+	HostsFiles []string        `yaml:"hosts_files"`
+	ZoneFiles  []string        `yaml:"zone_files"`
+
+	// Reverse lookups of private ranges go here instead of the upstreams,
+	// e.g. the router at "192.168.1.1:53"; empty answers NXDOMAIN
+	LANResolver string `yaml:"lan_resolver"`
+
+	// Time based rules
+	Timezone  string           `yaml:"timezone"`
+	Schedules []ScheduleConfig `yaml:"schedules"`
+
+	QueryLog QueryLogConfig `yaml:"query_log"`
+
+	// Abuse protection
+	AllowedClients []string        `yaml:"allowed_clients"` // CIDRs or addresses, empty allows everyone
+	RateLimit      RateLimitConfig `yaml:"rate_limit"`
+	RefuseAny      bool            `yaml:"refuse_any"` // answer ANY with HINFO as in RFC 8482
+	Chaos          ChaosConfig     `yaml:"chaos"`
+
+	// 0x20 case randomisation of upstream queries, verified in replies.
+	// Some upstreams do not preserve case and will fail with this on.
+	RandomizeCase bool `yaml:"randomize_case"`
+
+	// Checks and cleanup of upstream answers before they are cached
+	Sanitize SanitizeConfig `yaml:"sanitize"`
+
+	// EDNS Client Subnet sent upstream
+	ECS ECSConfig `yaml:"ecs"`
+
+	// AAAA synthesis for IPv6-only clients behind NAT64
+	DNS64 DNS64Config `yaml:"dns64"`
+
+	// Built-in DHCPv4 server for networks where the router's DHCP can not
+	// point clients at the hub
+	DHCP DHCPConfig `yaml:"dhcp"`
+
+	// Encrypted listeners for LAN clients, empty addresses disable them
+	ListenDoT string `yaml:"listen_dot"`
+	ListenDoH string `yaml:"listen_doh"`
+	TLSCert   string `yaml:"tls_cert"`
+	TLSKey    string `yaml:"tls_key"`
+
+	// Reverse proxies in front of DoH; X-Forwarded-For and X-Real-IP are
+	// ignored from everyone else
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// API of the DNS server with the resolver endpoints: profiles, clients,
+	// query log, stats and DoH. Empty disables it.
+	APIListen string `yaml:"api_listen"`
+}
+
+// ClientIdentityConfig names clients by address for logs, stats and
+// profiles.
+type ClientIdentityConfig struct {
+	LeaseFiles []string             `yaml:"lease_files"` // dnsmasq or ISC dhcpd, detected by content
+	ARP        bool                 `yaml:"arp"`         // MACs from /proc/net/arp
+	Static     []StaticClientConfig `yaml:"static"`
+	Refresh    time.Duration        `yaml:"refresh"` // rereading lease files and ARP, default 1m
+}
+
+// StaticClientConfig names a host by IP, by MAC or both.
+type StaticClientConfig struct {
+	Name string `yaml:"name"`
+	IP   string `yaml:"ip"`
+	MAC  string `yaml:"mac"`
+}
+
+// SanitizeConfig limits what upstream answers may contain. Records outside
+// the bailiwick of the question are always dropped; private addresses for
+// public names are handled by RebindingProtection. MinTTL leaves the SOA of
+// negative answers alone, it sets how long they are cached.
+type SanitizeConfig struct {
+	MaxRecords int           `yaml:"max_records"` // larger answers fail the upstream, default 200
+	MinTTL     time.Duration `yaml:"min_ttl"`
+	MaxTTL     time.Duration `yaml:"max_ttl"` // 0 keeps upstream TTLs
+}
+
+// DNS64Config synthesizes AAAA records from A records as in RFC 6147.
+type DNS64Config struct {
+	Enabled bool     `yaml:"enabled"`
+	Prefix  string   `yaml:"prefix"`  // NAT64 prefix, default 64:ff9b::/96
+	Exclude []string `yaml:"exclude"` // AAAA answers in these IPv6 ranges are ignored, A records in these IPv4 ranges are not synthesized; default ::ffff:0:0/96
+}
+
+// DHCPConfig is the built-in DHCPv4 server. It advertises the hub as DNS
+// server and registers client host names in the local zone.
+type DHCPConfig struct {
+	Enabled      bool                `yaml:"enabled"`
+	Interface    string              `yaml:"interface"` // e.g. eth0, empty listens on all
+	ServerIP     string              `yaml:"server_ip"` // our address on that network
+	RangeStart   string              `yaml:"range_start"`
+	RangeEnd     string              `yaml:"range_end"`
+	SubnetMask   string              `yaml:"subnet_mask"` // default 255.255.255.0
+	Router       string              `yaml:"router"`
+	DNS          []string            `yaml:"dns"`    // default server_ip
+	Domain       string              `yaml:"domain"` // host names are also registered under it
+	LeaseTime    time.Duration       `yaml:"lease_time"`
+	LeaseFile    string              `yaml:"lease_file"` // dnsmasq format, empty keeps leases in memory
+	StaticLeases []StaticLeaseConfig `yaml:"static_leases"`
+}
+
+type StaticLeaseConfig struct {
+	MAC      string `yaml:"mac"`
+	IP       string `yaml:"ip"`
+	Hostname string `yaml:"hostname"`
+}
+
+// ODoHConfig is an Oblivious DoH target reached through a relay.
+type ODoHConfig struct {
+	Target string `yaml:"target"` // e.g. https://odoh.cloudflare-dns.com/dns-query, or a stamp
+	Relay  string `yaml:"relay"`  // relay endpoint, receives targethost and targetpath
+}
+
+// ChaosConfig controls answers to CHAOS class queries such as version.bind.
+type ChaosConfig struct {
+	Policy  string `yaml:"policy"`  // refuse, answer
+	Version string `yaml:"version"` // version.bind and version.server
+	ID      string `yaml:"id"`      // id.server and hostname.bind, the host name when empty
+}
+
+// RateLimitConfig limits queries per client and, for UDP, identical
+// responses per client network (RRL). Zero rates disable a limit.
+type RateLimitConfig struct {
+	QPS        float64 `yaml:"qps"`
+	Burst      int     `yaml:"burst"`
+	RRLRate    float64 `yaml:"rrl_responses_per_second"`
+	RRLSlip    int     `yaml:"rrl_slip"`    // every Nth limited response is sent truncated, 0 drops all
+	IPv4Prefix int     `yaml:"ipv4_prefix"` // client network size for RRL, default /24
+	IPv6Prefix int     `yaml:"ipv6_prefix"` // default /56
+}
+
+type ECSConfig struct {
+	ECSPolicyConfig `yaml:",inline"`
+	Upstreams       map[string]ECSPolicyConfig `yaml:"upstreams"` // keyed by upstream as configured
+}
+
+type ECSPolicyConfig struct {
+	Mode   string `yaml:"mode"`   // strip, forward, replace
+	Subnet string `yaml:"subnet"` // sent instead of the client subnet by replace
+}
+
+type QueryLogConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	File            string        `yaml:"file"`        // JSON lines, empty keeps records in memory only
+	MaxSizeMB       int           `yaml:"max_size_mb"` // rotate the file after this size
+	MaxBackups      int           `yaml:"max_backups"`
+	MaxRecords      int           `yaml:"max_records"` // in-memory ring buffer used for search
+	HashKeyRotation time.Duration `yaml:"hash_key_rotation"`
+
+	// Default policy, profiles may override it
+	QueryLogPolicyConfig `yaml:",inline"`
+}
+
+// QueryLogPolicyConfig controls what is recorded about a query and for how long.
+type QueryLogPolicyConfig struct {
+	AnonymizeClientIP bool          `yaml:"anonymize_client_ip" json:"anonymize_client_ip"` // truncate to /24 and /48
+	HashNames         bool          `yaml:"hash_names" json:"hash_names"`                   // HMAC with a rotating key
+	SkipAllowlisted   bool          `yaml:"skip_allowlisted" json:"skip_allowlisted"`
+	IgnoreDomains     []string      `yaml:"ignore_domains" json:"ignore_domains,omitempty"`
+	Retention         time.Duration `yaml:"retention" json:"retention"` // memory and file, checked every minute
+}
+
+type ProfileConfig struct {
+	Name              string   `yaml:"name" json:"name"`
+	EnableFiltering   *bool    `yaml:"enable_filtering" json:"enable_filtering,omitempty"`
+	Blocklist         []string `yaml:"blocklist" json:"blocklist,omitempty"`
+	Allowlist         []string `yaml:"allowlist" json:"allowlist,omitempty"`
+	BlockMode         string   `yaml:"block_mode" json:"block_mode,omitempty"`
+	SafeSearch        *bool    `yaml:"safe_search" json:"safe_search,omitempty"`
+	SVCBPolicy        string   `yaml:"svcb_policy" json:"svcb_policy,omitempty"`
+	Upstreams         []string `yaml:"upstreams" json:"upstreams,omitempty"`
+	DoHUpstreams      []string `yaml:"doh_upstreams" json:"doh_upstreams,omitempty"`
+	DNSCryptUpstreams []string `yaml:"dnscrypt_upstreams" json:"dnscrypt_upstreams,omitempty"`
+
+	QueryLog *QueryLogPolicyConfig `yaml:"query_log" json:"query_log,omitempty"`
+}
+
+// RewriteConfig answers for Domain (exact or "*.suffix") with Answer, which is
+// either an IP address or a host name served as CNAME.
+type RewriteConfig struct {
+	Domain string `yaml:"domain" json:"domain"`
+	Answer string `yaml:"answer" json:"answer"`
+}
+
+// ScheduleConfig blocks extra domains during a daily time window. An empty
+// Days list means every day, an empty Profiles list means every profile.
+// Start equal to End is a 24 hour window, "00:00" to "00:00" the whole day.
+type ScheduleConfig struct {
+	Name      string   `yaml:"name" json:"name"`
+	Days      []string `yaml:"days" json:"days,omitempty"`
+	Start     string   `yaml:"start" json:"start"`
+	End       string   `yaml:"end" json:"end"`
+	Blocklist []string `yaml:"blocklist" json:"blocklist"`
+	Profiles  []string `yaml:"profiles" json:"profiles,omitempty"`
+}
+
+// ClientConfig maps client identifiers (IP, CIDR or EDNS client-id) to a profile.
+type ClientConfig struct {
+	Name    string   `yaml:"name" json:"name"`
+	IDs     []string `yaml:"ids" json:"ids"` // IP, CIDR, MAC, host name or EDNS client-id
+	Profile string   `yaml:"profile" json:"profile"`
 }
 
 type ProxyConfig struct {
@@ -38,9 +275,10 @@ type APIConfig struct {
 	APIKey      string `yaml:"api_key"`
 }
 
+// DockerContainerConfig describes the resolver container, its ports are
+// taken from DNSConfig.
 type DockerContainerConfig struct {
 	Name          string                      `yaml:"name"`
-	Listen        int                         `yaml:"listen"`
 	Image         string                      `yaml:"image"`
 	Network       string                      `yaml:"network"`
 	RestartPolicy container.RestartPolicyMode `yaml:"restart_policy"`
@@ -79,12 +317,87 @@ func LoadFromFile(path string) (*Config, error) {
 }
 
 func (c *Config) validate() error {
-	if c.DNS.Listen == "" {
-		return fmt.Errorf("dns.listen is required")
+	if err := c.DNS.validateListen(); err != nil {
+		return err
 	}
-	if len(c.DNS.Upstreams) == 0 && len(c.DNS.DoHUpstreams) == 0 {
+	if len(c.DNS.Upstreams) == 0 && len(c.DNS.DoHUpstreams) == 0 && len(c.DNS.DNSCryptUpstreams) == 0 && len(c.DNS.ODoHUpstreams) == 0 {
 		return fmt.Errorf("at least one upstream is required")
 	}
+	if err := c.DNS.validateProfiles(); err != nil {
+		return err
+	}
+	if err := c.DNS.validateSchedules(); err != nil {
+		return err
+	}
+	if err := c.DNS.validateECS(); err != nil {
+		return err
+	}
+	for _, o := range c.DNS.ODoHUpstreams {
+		for _, u := range []string{o.Target, o.Relay} {
+			if strings.HasPrefix(u, "sdns://") {
+				continue
+			}
+			if parsed, err := url.Parse(u); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+				return fmt.Errorf("dns.odoh_upstreams: %q must be an https URL or sdns:// stamp", u)
+			}
+		}
+	}
+	for _, s := range c.DNS.ClientIdentity.Static {
+		if s.Name == "" || (s.IP == "" && s.MAC == "") {
+			return fmt.Errorf("dns.client_identity.static: entries need a name and an ip or mac")
+		}
+		if _, err := netip.ParseAddr(s.IP); s.IP != "" && err != nil {
+			return fmt.Errorf("dns.client_identity.static: invalid ip %q", s.IP)
+		}
+		if _, err := net.ParseMAC(s.MAC); s.MAC != "" && err != nil {
+			return fmt.Errorf("dns.client_identity.static: invalid mac %q", s.MAC)
+		}
+	}
+	if s := c.DNS.Sanitize; s.MaxRecords < 0 || s.MinTTL < 0 || s.MaxTTL < 0 || (s.MaxTTL > 0 && s.MinTTL > s.MaxTTL) {
+		return fmt.Errorf("dns.sanitize: limits must be positive and min_ttl not above max_ttl")
+	}
+	if c.DNS.DNS64.Enabled {
+		if err := c.DNS.DNS64.validate(); err != nil {
+			return err
+		}
+	}
+	if c.DNS.DHCP.Enabled {
+		if err := c.DNS.DHCP.validate(); err != nil {
+			return err
+		}
+	}
+	for _, stamp := range c.DNS.DNSCryptUpstreams {
+		if !strings.HasPrefix(stamp, "sdns://") {
+			return fmt.Errorf("dns.dnscrypt_upstreams: %q must be an sdns:// stamp", stamp)
+		}
+	}
+	switch c.DNS.Chaos.Policy {
+	case "", "refuse", "answer":
+	default:
+		return fmt.Errorf("dns.chaos.policy must be refuse or answer")
+	}
+	for _, client := range c.DNS.AllowedClients {
+		if _, err := netip.ParsePrefix(client); err != nil {
+			if _, err := netip.ParseAddr(client); err != nil {
+				return fmt.Errorf("dns.allowed_clients: invalid entry %q", client)
+			}
+		}
+	}
+	for _, proxy := range c.DNS.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			if _, err := netip.ParseAddr(proxy); err != nil {
+				return fmt.Errorf("dns.trusted_proxies: invalid entry %q", proxy)
+			}
+		}
+	}
+	if (c.DNS.ListenDoT != "" || c.DNS.ListenDoH != "") && (c.DNS.TLSCert == "" || c.DNS.TLSKey == "") {
+		return fmt.Errorf("dns.tls_cert and dns.tls_key are required for DoT and DoH listeners")
+	}
+	switch c.DNS.IPBlockMode {
+	case "", "strip", "block":
+	default:
+		return fmt.Errorf("dns.ip_block_mode must be strip or block")
+	}
 	if c.Proxy.Listen == "" {
 		return fmt.Errorf("proxy.listen is required")
 	}
@@ -96,3 +409,246 @@ func (c *Config) validate() error {
 	}
 	return nil
 }
+
+func (c *DNSConfig) validateProfiles() error {
+	if err := ValidateBlockMode(c.BlockMode); err != nil {
+		return fmt.Errorf("dns.block_mode: %v", err)
+	}
+	if err := ValidateSVCBPolicy(c.SVCBPolicy); err != nil {
+		return fmt.Errorf("dns.svcb_policy: %v", err)
+	}
+
+	profiles := make(map[string]bool)
+	for _, p := range c.Profiles {
+		if p.Name == "" {
+			return fmt.Errorf("dns.profiles: name is required")
+		}
+		if profiles[p.Name] {
+			return fmt.Errorf("dns.profiles: duplicate profile %q", p.Name)
+		}
+		if err := ValidateBlockMode(p.BlockMode); err != nil {
+			return fmt.Errorf("dns.profiles[%s].block_mode: %v", p.Name, err)
+		}
+		if err := ValidateSVCBPolicy(p.SVCBPolicy); err != nil {
+			return fmt.Errorf("dns.profiles[%s].svcb_policy: %v", p.Name, err)
+		}
+		profiles[p.Name] = true
+	}
+
+	for _, cl := range c.Clients {
+		if len(cl.IDs) == 0 {
+			return fmt.Errorf("dns.clients[%s]: at least one id is required", cl.Name)
+		}
+		if !profiles[cl.Profile] {
+			return fmt.Errorf("dns.clients[%s]: unknown profile %q", cl.Name, cl.Profile)
+		}
+	}
+	return nil
+}
+
+func ValidateBlockMode(mode string) error {
+	switch mode {
+	case "", "nxdomain", "null_ip", "refused":
+		return nil
+	default:
+		return fmt.Errorf("unknown block mode %q", mode)
+	}
+}
+
+func ValidateSVCBPolicy(policy string) error {
+	switch policy {
+	case "", "keep", "strip_ech", "drop":
+		return nil
+	default:
+		return fmt.Errorf("unknown HTTPS/SVCB policy %q", policy)
+	}
+}
+
+// UDPAddrs returns the UDP listen addresses, falling back to Listen.
+func (c DNSConfig) UDPAddrs() []string {
+	if len(c.ListenUDP) > 0 {
+		return c.ListenUDP
+	}
+	if c.Listen != "" {
+		return []string{c.Listen}
+	}
+	return nil
+}
+
+// TCPAddrs returns the TCP listen addresses, falling back to Listen.
+func (c DNSConfig) TCPAddrs() []string {
+	if len(c.ListenTCP) > 0 {
+		return c.ListenTCP
+	}
+	if c.Listen != "" {
+		return []string{c.Listen}
+	}
+	return nil
+}
+
+// UDPPorts and TCPPorts return the distinct listen ports in configuration
+// order, for components that forward or publish them.
+func (c DNSConfig) UDPPorts() []int { return listenPorts(c.UDPAddrs()) }
+func (c DNSConfig) TCPPorts() []int { return listenPorts(c.TCPAddrs()) }
+
+// APIPorts returns the port of APIListen, none when it is disabled.
+func (c DNSConfig) APIPorts() []int { return listenPorts([]string{c.APIListen}) }
+
+// TLSPorts returns the DoT and DoH listen ports, both TCP.
+func (c DNSConfig) TLSPorts() []int {
+	var addrs []string
+	for _, addr := range []string{c.ListenDoT, c.ListenDoH} {
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return listenPorts(addrs)
+}
+
+func listenPorts(addrs []string) []int {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, addr := range addrs {
+		port, err := listenPort(addr)
+		if err != nil || seen[port] {
+			continue
+		}
+		seen[port] = true
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+func listenPort(addr string) (int, error) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return port, nil
+}
+
+func (c *DNSConfig) validateListen() error {
+	udp, tcp := c.UDPAddrs(), c.TCPAddrs()
+	if len(udp) == 0 || len(tcp) == 0 {
+		return fmt.Errorf("dns.listen or dns.listen_udp and dns.listen_tcp are required")
+	}
+	for _, addr := range append(append([]string{}, udp...), tcp...) {
+		if _, err := listenPort(addr); err != nil {
+			return fmt.Errorf("dns listen address %q: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+func (c *DNSConfig) validateECS() error {
+	if err := c.ECS.validate(); err != nil {
+		return fmt.Errorf("dns.ecs: %v", err)
+	}
+	for upstream, p := range c.ECS.Upstreams {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("dns.ecs.upstreams[%s]: %v", upstream, err)
+		}
+	}
+	return nil
+}
+
+func (p ECSPolicyConfig) validate() error {
+	switch p.Mode {
+	case "", "strip", "forward":
+		return nil
+	case "replace":
+		if _, err := netip.ParsePrefix(p.Subnet); err != nil {
+			return fmt.Errorf("replace needs a subnet: %v", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q", p.Mode)
+	}
+}
+
+func (c *DNSConfig) validateSchedules() error {
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("dns.timezone: %v", err)
+	}
+
+	for _, sc := range c.Schedules {
+		if sc.Name == "" {
+			return fmt.Errorf("dns.schedules: name is required")
+		}
+		for _, day := range sc.Days {
+			if _, ok := Weekdays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("dns.schedules[%s]: unknown day %q", sc.Name, day)
+			}
+		}
+		for _, t := range []string{sc.Start, sc.End} {
+			if _, err := time.Parse("15:04", t); err != nil {
+				return fmt.Errorf("dns.schedules[%s]: invalid time %q, expected HH:MM", sc.Name, t)
+			}
+		}
+	}
+	return nil
+}
+
+func (d DNS64Config) validate() error {
+	if d.Prefix != "" {
+		prefix, err := netip.ParsePrefix(d.Prefix)
+		if err != nil || !prefix.Addr().Is6() {
+			return fmt.Errorf("dns.dns64.prefix must be an IPv6 prefix")
+		}
+		switch prefix.Bits() {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return fmt.Errorf("dns.dns64.prefix length must be 32, 40, 48, 56, 64 or 96")
+		}
+	}
+	for _, entry := range d.Exclude {
+		if _, err := netip.ParsePrefix(entry); err != nil {
+			return fmt.Errorf("dns.dns64.exclude: invalid range %q", entry)
+		}
+	}
+	return nil
+}
+
+func (d DHCPConfig) validate() error {
+	var start, end netip.Addr
+	for _, f := range []struct {
+		name  string
+		value string
+		addr  *netip.Addr
+	}{
+		{"server_ip", d.ServerIP, nil},
+		{"range_start", d.RangeStart, &start},
+		{"range_end", d.RangeEnd, &end},
+	} {
+		addr, err := netip.ParseAddr(f.value)
+		if err != nil || !addr.Is4() {
+			return fmt.Errorf("dns.dhcp.%s must be an IPv4 address", f.name)
+		}
+		if f.addr != nil {
+			*f.addr = addr
+		}
+	}
+	if end.Less(start) {
+		return fmt.Errorf("dns.dhcp.range_end is before range_start")
+	}
+
+	for _, ip := range append([]string{d.SubnetMask, d.Router}, d.DNS...) {
+		if addr, err := netip.ParseAddr(ip); ip != "" && (err != nil || !addr.Is4()) {
+			return fmt.Errorf("dns.dhcp: invalid IPv4 address %q", ip)
+		}
+	}
+
+	for _, l := range d.StaticLeases {
+		if _, err := net.ParseMAC(l.MAC); err != nil {
+			return fmt.Errorf("dns.dhcp.static_leases: invalid mac %q", l.MAC)
+		}
+		if addr, err := netip.ParseAddr(l.IP); err != nil || !addr.Is4() {
+			return fmt.Errorf("dns.dhcp.static_leases: invalid ip %q", l.IP)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package dhcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lease is a bound or static lease as shown by the API.
+type Lease struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expiry   time.Time `json:"expiry,omitempty"`
+	Static   bool      `json:"static,omitempty"`
+}
+
+type lease struct {
+	mac      string
+	ip       netip.Addr
+	hostname string
+	expiry   time.Time // zero for static leases
+	static   bool
+	offered  bool     // held for a client that has not requested it yet
+	names    []string // registered in the local zone
+}
+
+func (l *lease) active(now time.Time) bool {
+	return now.Before(l.expiry)
+}
+
+func (l *lease) public() Lease {
+	return Lease{MAC: l.mac, IP: l.ip.String(), Hostname: l.hostname, Expiry: l.expiry, Static: l.static}
+}
+
+// leaseTable indexes leases by MAC and address and persists them in the
+// dnsmasq lease file format, so the client identity registry can read it.
+type leaseTable struct {
+	path     string
+	byMAC    map[string]*lease
+	byIP     map[netip.Addr]*lease
+	declined map[netip.Addr]time.Time
+}
+
+func newLeaseTable(path string) *leaseTable {
+	return &leaseTable{
+		path:     path,
+		byMAC:    make(map[string]*lease),
+		byIP:     make(map[netip.Addr]*lease),
+		declined: make(map[netip.Addr]time.Time),
+	}
+}
+
+func (t *leaseTable) put(l *lease) {
+	t.byMAC[l.mac] = l
+	t.byIP[l.ip] = l
+}
+
+func (t *leaseTable) remove(l *lease) {
+	if t.byMAC[l.mac] == l {
+		delete(t.byMAC, l.mac)
+	}
+	if t.byIP[l.ip] == l {
+		delete(t.byIP, l.ip)
+	}
+}
+
+// all returns the leases ordered by address.
+func (t *leaseTable) all() []*lease {
+	leases := make([]*lease, 0, len(t.byMAC))
+	for _, l := range t.byMAC {
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].ip.Less(leases[j].ip) })
+	return leases
+}
+
+// load restores the dynamic leases that are still valid. Static leases come
+// from the configuration and win over the file.
+func (t *leaseTable) load(now time.Time) error {
+	data, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read lease file: %v", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || expiry == 0 || !time.Unix(expiry, 0).After(now) {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		if l := t.byMAC[mac.String()]; l != nil && l.static {
+			continue
+		}
+		if l := t.byIP[addr]; l != nil && l.static {
+			continue
+		}
+
+		hostname := fields[3]
+		if hostname == "*" {
+			hostname = ""
+		}
+		t.put(&lease{mac: mac.String(), ip: addr, hostname: hostname, expiry: time.Unix(expiry, 0)})
+	}
+
+	return scanner.Err()
+}
+
+// save writes "<expiry> <mac> <ip> <hostname> <client-id>" lines, expiry 0
+// for static leases. The file is replaced atomically.
+func (t *leaseTable) save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	var b strings.Builder
+	for _, l := range t.all() {
+		if l.offered {
+			continue
+		}
+		expiry := int64(0)
+		if !l.static {
+			expiry = l.expiry.Unix()
+		}
+		hostname := l.hostname
+		if hostname == "" {
+			hostname = "*"
+		}
+		fmt.Fprintf(&b, "%d %s %s %s *\n", expiry, l.mac, l.ip, hostname)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save leases: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save leases: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save leases: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), t.path); err != nil {
+		return fmt.Errorf("failed to save leases: %v", err)
+	}
+	return nil
+}
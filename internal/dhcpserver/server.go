@@ -0,0 +1,500 @@
+package dhcpserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+)
+
+const (
+	defaultLeaseTime = 24 * time.Hour
+	defaultNetmask   = "255.255.255.0"
+
+	// An offered address is held this long for the client's request
+	offerTimeout = 1 * time.Minute
+	// Addresses a client declined as already in use are skipped this long
+	declineHold    = 1 * time.Hour
+	expireInterval = 1 * time.Minute
+)
+
+// Hosts publishes client host names, the resolver's local zone.
+type Hosts interface {
+	AddHost(ip net.IP, names ...string)
+	RemoveHost(ip net.IP, names ...string)
+}
+
+// Server is a DHCPv4 server for a single subnet. It hands out addresses
+// from a range, advertises the hub as DNS server and registers the host
+// names clients send.
+type Server struct {
+	cfg       config.DHCPConfig
+	serverIP  net.IP
+	netmask   net.IPMask
+	router    net.IP
+	dns       []net.IP
+	start     netip.Addr
+	end       netip.Addr
+	leaseTime time.Duration
+	hosts     Hosts
+	leases    *leaseTable
+	now       func() time.Time
+	mu        sync.Mutex
+}
+
+func New(cfg config.DHCPConfig, hosts Hosts) (*Server, error) {
+	s := &Server{
+		cfg:       cfg,
+		serverIP:  net.ParseIP(cfg.ServerIP).To4(),
+		router:    net.ParseIP(cfg.Router).To4(),
+		leaseTime: cfg.LeaseTime,
+		hosts:     hosts,
+		now:       time.Now,
+	}
+	if s.serverIP == nil {
+		return nil, fmt.Errorf("invalid server ip %q", cfg.ServerIP)
+	}
+	if s.leaseTime <= 0 {
+		s.leaseTime = defaultLeaseTime
+	}
+
+	mask := cfg.SubnetMask
+	if mask == "" {
+		mask = defaultNetmask
+	}
+	maskIP := net.ParseIP(mask).To4()
+	if maskIP == nil {
+		return nil, fmt.Errorf("invalid subnet mask %q", mask)
+	}
+	s.netmask = net.IPMask(maskIP)
+
+	var err error
+	if s.start, err = netip.ParseAddr(cfg.RangeStart); err != nil {
+		return nil, fmt.Errorf("invalid range start: %v", err)
+	}
+	if s.end, err = netip.ParseAddr(cfg.RangeEnd); err != nil {
+		return nil, fmt.Errorf("invalid range end: %v", err)
+	}
+
+	s.dns = []net.IP{s.serverIP}
+	if len(cfg.DNS) > 0 {
+		s.dns = nil
+		for _, addr := range cfg.DNS {
+			if ip := net.ParseIP(addr).To4(); ip != nil {
+				s.dns = append(s.dns, ip)
+			}
+		}
+	}
+
+	s.leases = newLeaseTable(cfg.LeaseFile)
+	for _, l := range cfg.StaticLeases {
+		mac, err := net.ParseMAC(l.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static lease mac %q", l.MAC)
+		}
+		addr, err := netip.ParseAddr(l.IP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static lease ip %q", l.IP)
+		}
+		s.leases.put(&lease{mac: mac.String(), ip: addr, hostname: sanitizeHostname(l.Hostname), static: true})
+	}
+
+	if cfg.LeaseFile != "" {
+		if err := s.leases.load(s.now()); err != nil {
+			logger.Warnf("DHCP: %v", err)
+		}
+	}
+	for _, l := range s.leases.all() {
+		s.register(l)
+	}
+
+	return s, nil
+}
+
+// ListenAndServe answers on the DHCP server port of the configured
+// interface until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	conn, err := server4.NewIPv4UDPConn(s.cfg.Interface, &net.UDPAddr{Port: dhcpv4.ServerPort})
+	if err != nil {
+		return fmt.Errorf("failed to listen for DHCP: %v", err)
+	}
+
+	logger.Infof("DHCP server listening on %s, range %s-%s", conn.LocalAddr(), s.start, s.end)
+	return s.Serve(ctx, conn)
+}
+
+// Serve answers requests read from conn until ctx is done.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	srv, err := server4.NewServer("", nil, s.handle, server4.WithConn(conn))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(expireInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				srv.Close()
+				return
+			case <-ticker.C:
+				s.expire()
+			}
+		}
+	}()
+
+	err = srv.Serve()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Leases returns the bound and static leases.
+func (s *Server) Leases() []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var leases []Lease
+	for _, l := range s.leases.all() {
+		if !l.offered {
+			leases = append(leases, l.public())
+		}
+	}
+	return leases
+}
+
+func (s *Server) handle(conn net.PacketConn, _ net.Addr, req *dhcpv4.DHCPv4) {
+	if req.OpCode != dhcpv4.OpcodeBootRequest {
+		return
+	}
+
+	resp, err := s.reply(req)
+	if err != nil {
+		logger.Warnf("DHCP %s from %s: %v", req.MessageType(), req.ClientHWAddr, err)
+		return
+	}
+	if resp == nil {
+		return
+	}
+
+	dst := destination(req, resp)
+	logger.Debugf("DHCP %s to %s via %s: %s", resp.MessageType(), req.ClientHWAddr, dst, resp.YourIPAddr)
+	if _, err := conn.WriteTo(resp.ToBytes(), dst); err != nil {
+		logger.Errorf("DHCP: failed to send %s: %v", resp.MessageType(), err)
+	}
+}
+
+// destination picks where resp goes as RFC 2131 section 4.1 says. Clients
+// without an address send from 0.0.0.0, so the peer address is no use.
+func destination(req, resp *dhcpv4.DHCPv4) net.Addr {
+	switch {
+	case req.GatewayIPAddr != nil && !req.GatewayIPAddr.IsUnspecified():
+		return &net.UDPAddr{IP: req.GatewayIPAddr, Port: dhcpv4.ServerPort}
+	case resp.MessageType() == dhcpv4.MessageTypeNak,
+		req.IsBroadcast(),
+		req.ClientIPAddr == nil || req.ClientIPAddr.IsUnspecified():
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	}
+	return &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort}
+}
+
+// reply returns the answer to req, nil when none is due.
+func (s *Server) reply(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+	mac := req.ClientHWAddr.String()
+	hostname := sanitizeHostname(req.HostName())
+
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		addr, err := s.offer(mac, req.RequestedIPAddress(), hostname)
+		if err != nil {
+			return nil, err
+		}
+		return s.response(req, dhcpv4.MessageTypeOffer, addr)
+
+	case dhcpv4.MessageTypeRequest:
+		// The client picked another server's offer
+		if sid := req.ServerIdentifier(); sid != nil && !sid.Equal(s.serverIP) {
+			s.forget(mac)
+			return nil, nil
+		}
+
+		// Renewing clients send their address in ciaddr
+		requested := req.RequestedIPAddress()
+		if requested == nil || requested.IsUnspecified() {
+			requested = req.ClientIPAddr
+		}
+		addr, ok := s.bind(mac, requested, hostname)
+		if !ok {
+			return dhcpv4.NewReplyFromRequest(req,
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.serverIP)),
+			)
+		}
+		return s.response(req, dhcpv4.MessageTypeAck, addr)
+
+	case dhcpv4.MessageTypeRelease:
+		s.release(mac, req.ClientIPAddr)
+		return nil, nil
+
+	case dhcpv4.MessageTypeDecline:
+		s.decline(mac, req.RequestedIPAddress())
+		return nil, nil
+
+	case dhcpv4.MessageTypeInform:
+		// Configuration only, the client has its address already
+		return s.response(req, dhcpv4.MessageTypeAck, netip.Addr{})
+	}
+
+	return nil, nil
+}
+
+func (s *Server) response(req *dhcpv4.DHCPv4, mt dhcpv4.MessageType, addr netip.Addr) (*dhcpv4.DHCPv4, error) {
+	modifiers := []dhcpv4.Modifier{
+		dhcpv4.WithMessageType(mt),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.serverIP)),
+		dhcpv4.WithOption(dhcpv4.OptSubnetMask(s.netmask)),
+		dhcpv4.WithOption(dhcpv4.OptDNS(s.dns...)),
+	}
+	if addr.IsValid() {
+		modifiers = append(modifiers,
+			dhcpv4.WithYourIP(net.IP(addr.AsSlice())),
+			dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(s.leaseTime)),
+		)
+	}
+	if s.router != nil {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptRouter(s.router)))
+	}
+	if s.cfg.Domain != "" {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptDomainName(s.cfg.Domain)))
+	}
+
+	return dhcpv4.NewReplyFromRequest(req, modifiers...)
+}
+
+// offer holds an address for mac until it is requested.
+func (s *Server) offer(mac string, requested net.IP, hostname string) (netip.Addr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	addr, ok := s.pick(mac, requested, now)
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("no free address in %s-%s", s.start, s.end)
+	}
+
+	if l := s.leases.byMAC[mac]; l != nil && l.ip == addr && (l.static || l.active(now)) {
+		return addr, nil
+	}
+	s.replace(&lease{mac: mac, ip: addr, hostname: hostname, expiry: now.Add(offerTimeout), offered: true})
+	return addr, nil
+}
+
+// bind turns a request for addr into a lease, false means NAK.
+func (s *Server) bind(mac string, requested net.IP, hostname string) (netip.Addr, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	addr, ok := netip.AddrFromSlice(requested.To4())
+	if !ok || !s.available(addr, mac, now) {
+		return netip.Addr{}, false
+	}
+
+	l := &lease{mac: mac, ip: addr, hostname: hostname, expiry: now.Add(s.leaseTime)}
+	if existing := s.leases.byMAC[mac]; existing != nil && existing.static {
+		if existing.ip != addr {
+			return netip.Addr{}, false
+		}
+		l.static, l.expiry = true, time.Time{}
+		if existing.hostname != "" {
+			l.hostname = existing.hostname
+		}
+	} else if !s.inRange(addr) {
+		return netip.Addr{}, false
+	}
+
+	s.replace(l)
+	s.save()
+	return addr, true
+}
+
+// forget drops the offer made to mac.
+func (s *Server) forget(mac string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l := s.leases.byMAC[mac]; l != nil && l.offered {
+		s.leases.remove(l)
+	}
+}
+
+func (s *Server) release(mac string, ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.leases.byMAC[mac]
+	if l == nil || l.static || !net.IP(l.ip.AsSlice()).Equal(ip) {
+		return
+	}
+	s.unregister(l)
+	s.leases.remove(l)
+	s.save()
+}
+
+func (s *Server) decline(mac string, ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addr, ok := netip.AddrFromSlice(ip.To4())
+	if !ok {
+		return
+	}
+	logger.Warnf("DHCP: %s declined %s, the address is in use", mac, addr)
+	s.leases.declined[addr] = s.now().Add(declineHold)
+
+	if l := s.leases.byMAC[mac]; l != nil && !l.static && l.ip == addr {
+		s.unregister(l)
+		s.leases.remove(l)
+		s.save()
+	}
+}
+
+// expire drops leases that were not renewed.
+func (s *Server) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	changed := false
+	for _, l := range s.leases.all() {
+		if l.static || l.active(now) {
+			continue
+		}
+		if !l.offered {
+			logger.Debugf("DHCP lease of %s for %s expired", l.ip, l.mac)
+			changed = true
+		}
+		s.unregister(l)
+		s.leases.remove(l)
+	}
+	for addr, until := range s.leases.declined {
+		if now.After(until) {
+			delete(s.leases.declined, addr)
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// pick chooses the address for mac: its static or previous one, the one it
+// asked for, or the first free one in the range.
+func (s *Server) pick(mac string, requested net.IP, now time.Time) (netip.Addr, bool) {
+	if l := s.leases.byMAC[mac]; l != nil && (l.static || s.available(l.ip, mac, now)) {
+		return l.ip, true
+	}
+	if addr, ok := netip.AddrFromSlice(requested.To4()); ok && s.inRange(addr) && s.available(addr, mac, now) {
+		return addr, true
+	}
+	for addr := s.start; s.inRange(addr); addr = addr.Next() {
+		if s.available(addr, mac, now) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// available reports whether addr may be given to mac.
+func (s *Server) available(addr netip.Addr, mac string, now time.Time) bool {
+	if net.IP(addr.AsSlice()).Equal(s.serverIP) {
+		return false
+	}
+	if until, ok := s.leases.declined[addr]; ok && now.Before(until) {
+		return false
+	}
+	l := s.leases.byIP[addr]
+	return l == nil || l.mac == mac || (!l.static && !l.active(now))
+}
+
+func (s *Server) inRange(addr netip.Addr) bool {
+	return addr.IsValid() && !addr.Less(s.start) && !s.end.Less(addr)
+}
+
+// replace stores l as the lease of its MAC, dropping whatever held the MAC
+// or the address before.
+func (s *Server) replace(l *lease) {
+	if old := s.leases.byIP[l.ip]; old != nil && old.mac != l.mac {
+		s.unregister(old)
+		s.leases.remove(old)
+	}
+	if old := s.leases.byMAC[l.mac]; old != nil {
+		s.unregister(old)
+		s.leases.remove(old)
+	}
+	s.leases.put(l)
+	s.register(l)
+}
+
+// register publishes the host name of a bound lease, unless another client
+// holds it already.
+func (s *Server) register(l *lease) {
+	if l.offered || l.hostname == "" {
+		return
+	}
+	for _, other := range s.leases.all() {
+		if other != l && other.mac != l.mac && len(other.names) > 0 && other.hostname == l.hostname {
+			logger.Warnf("DHCP: host name %s of %s is taken by %s", l.hostname, l.mac, other.mac)
+			return
+		}
+	}
+
+	l.names = []string{l.hostname}
+	if s.cfg.Domain != "" {
+		l.names = []string{l.hostname + "." + strings.Trim(s.cfg.Domain, "."), l.hostname}
+	}
+	s.hosts.AddHost(net.IP(l.ip.AsSlice()), l.names...)
+}
+
+func (s *Server) unregister(l *lease) {
+	if len(l.names) == 0 {
+		return
+	}
+	s.hosts.RemoveHost(net.IP(l.ip.AsSlice()), l.names...)
+	l.names = nil
+}
+
+func (s *Server) save() {
+	if err := s.leases.save(); err != nil {
+		logger.Errorf("DHCP: %v", err)
+	}
+}
+
+// sanitizeHostname keeps a valid DNS label of what clients send.
+func sanitizeHostname(name string) string {
+	name, _, _ = strings.Cut(strings.ToLower(name), ".")
+
+	b := make([]byte, 0, len(name))
+	for _, c := range []byte(name) {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-':
+			b = append(b, c)
+		case c == ' ' || c == '_':
+			b = append(b, '-')
+		}
+	}
+	if len(b) > 63 {
+		b = b[:63]
+	}
+	return strings.Trim(string(b), "-")
+}
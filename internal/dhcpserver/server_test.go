@@ -0,0 +1,381 @@
+package dhcpserver
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// fakeConn feeds packets to the server and collects its replies.
+type fakeConn struct {
+	in     chan []byte
+	out    chan packet
+	closed chan struct{}
+	once   sync.Once
+}
+
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{in: make(chan []byte), out: make(chan packet, 16), closed: make(chan struct{})}
+}
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p), &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.out <- packet{data: append([]byte(nil), b...), addr: addr}
+	return len(b), nil
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) LocalAddr() net.Addr              { return &net.UDPAddr{Port: dhcpv4.ServerPort} }
+func (c *fakeConn) SetDeadline(time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+// exchange sends req and returns the reply, nil when none came.
+func (c *fakeConn) exchange(t *testing.T, req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	t.Helper()
+	resp, _ := c.exchangeTo(t, req)
+	return resp
+}
+
+// exchangeTo is exchange that also returns the address the reply went to.
+func (c *fakeConn) exchangeTo(t *testing.T, req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, string) {
+	t.Helper()
+	c.in <- req.ToBytes()
+
+	select {
+	case p := <-c.out:
+		resp, err := dhcpv4.FromBytes(p.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, p.addr.String()
+	case <-time.After(200 * time.Millisecond):
+		return nil, ""
+	}
+}
+
+type fakeHosts struct {
+	names map[string]string
+	mu    sync.Mutex
+}
+
+func (h *fakeHosts) AddHost(ip net.IP, names ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, name := range names {
+		h.names[name] = ip.String()
+	}
+}
+
+func (h *fakeHosts) RemoveHost(ip net.IP, names ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, name := range names {
+		if h.names[name] == ip.String() {
+			delete(h.names, name)
+		}
+	}
+}
+
+func (h *fakeHosts) lookup(name string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.names[name]
+}
+
+func testConfig(t *testing.T) config.DHCPConfig {
+	return config.DHCPConfig{
+		Enabled:    true,
+		ServerIP:   "192.168.50.1",
+		RangeStart: "192.168.50.100",
+		RangeEnd:   "192.168.50.110",
+		Router:     "192.168.50.254",
+		Domain:     "lan",
+		LeaseTime:  time.Hour,
+		LeaseFile:  filepath.Join(t.TempDir(), "dhcp.leases"),
+	}
+}
+
+func startServer(t *testing.T, cfg config.DHCPConfig, hosts Hosts) (*Server, *fakeConn) {
+	t.Helper()
+	s, err := New(cfg, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := newFakeConn()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s.Serve(ctx, conn); err != nil {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s, conn
+}
+
+const broadcast = "255.255.255.255:68"
+
+// dora runs DISCOVER, OFFER, REQUEST, ACK for hw and returns the ACK.
+func dora(t *testing.T, conn *fakeConn, hw net.HardwareAddr, hostname string) *dhcpv4.DHCPv4 {
+	t.Helper()
+	discover, err := dhcpv4.NewDiscovery(hw, dhcpv4.WithOption(dhcpv4.OptHostName(hostname)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, dst := conn.exchangeTo(t, discover)
+	if offer == nil || offer.MessageType() != dhcpv4.MessageTypeOffer {
+		t.Fatalf("expected OFFER, got %v", offer)
+	}
+	// The client has no address yet
+	if dst != broadcast {
+		t.Fatalf("OFFER sent to %s, want %s", dst, broadcast)
+	}
+
+	request, err := dhcpv4.NewRequestFromOffer(offer, dhcpv4.WithOption(dhcpv4.OptHostName(hostname)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, dst := conn.exchangeTo(t, request)
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("expected ACK, got %v", ack)
+	}
+	if dst != broadcast {
+		t.Fatalf("ACK sent to %s, want %s", dst, broadcast)
+	}
+	if !ack.YourIPAddr.Equal(offer.YourIPAddr) {
+		t.Fatalf("ACK for %s, offered %s", ack.YourIPAddr, offer.YourIPAddr)
+	}
+	return ack
+}
+
+func TestServerLeasesAndRegistersNames(t *testing.T) {
+	hosts := &fakeHosts{names: make(map[string]string)}
+	cfg := testConfig(t)
+	s, conn := startServer(t, cfg, hosts)
+
+	hw, _ := net.ParseMAC("02:00:00:00:00:01")
+	ack := dora(t, conn, hw, "Laptop")
+
+	if got := ack.YourIPAddr.String(); got != "192.168.50.100" {
+		t.Fatalf("leased %s, want first address of the range", got)
+	}
+	if dns := ack.DNS(); len(dns) != 1 || !dns[0].Equal(net.ParseIP("192.168.50.1")) {
+		t.Fatalf("advertised DNS %v, want the hub", dns)
+	}
+	if router := ack.Router(); len(router) != 1 || !router[0].Equal(net.ParseIP("192.168.50.254")) {
+		t.Fatalf("advertised router %v", router)
+	}
+	if got := ack.IPAddressLeaseTime(0); got != time.Hour {
+		t.Fatalf("lease time %s", got)
+	}
+	if got := hosts.lookup("laptop.lan"); got != "192.168.50.100" {
+		t.Fatalf("laptop.lan registered as %q", got)
+	}
+
+	// A second client gets the next address
+	other, _ := net.ParseMAC("02:00:00:00:00:02")
+	if got := dora(t, conn, other, "phone").YourIPAddr.String(); got != "192.168.50.101" {
+		t.Fatalf("second client leased %s", got)
+	}
+
+	data, err := os.ReadFile(cfg.LeaseFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "02:00:00:00:00:01 192.168.50.100 laptop *") {
+		t.Fatalf("lease file:\n%s", data)
+	}
+	if leases := s.Leases(); len(leases) != 2 {
+		t.Fatalf("got %d leases, want 2", len(leases))
+	}
+
+	// Releasing frees the address and the name
+	release, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(hw),
+		dhcpv4.WithClientIP(ack.YourIPAddr),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := conn.exchange(t, release); resp != nil {
+		t.Fatalf("unexpected reply to RELEASE: %v", resp)
+	}
+	if got := hosts.lookup("laptop.lan"); got != "" {
+		t.Fatalf("laptop.lan still registered as %q", got)
+	}
+	if leases := s.Leases(); len(leases) != 1 {
+		t.Fatalf("got %d leases after release, want 1", len(leases))
+	}
+}
+
+func TestServerStaticLease(t *testing.T) {
+	hosts := &fakeHosts{names: make(map[string]string)}
+	cfg := testConfig(t)
+	cfg.StaticLeases = []config.StaticLeaseConfig{{MAC: "02:00:00:00:00:aa", IP: "192.168.50.20", Hostname: "nas"}}
+	_, conn := startServer(t, cfg, hosts)
+
+	// Static names are known before the host shows up
+	if got := hosts.lookup("nas.lan"); got != "192.168.50.20" {
+		t.Fatalf("nas.lan registered as %q", got)
+	}
+
+	hw, _ := net.ParseMAC("02:00:00:00:00:aa")
+	if got := dora(t, conn, hw, "whatever").YourIPAddr.String(); got != "192.168.50.20" {
+		t.Fatalf("static client leased %s", got)
+	}
+	if got := hosts.lookup("nas.lan"); got != "192.168.50.20" {
+		t.Fatalf("nas.lan registered as %q", got)
+	}
+
+	// Nobody else may request the reserved address
+	other, _ := net.ParseMAC("02:00:00:00:00:bb")
+	request, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(other),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.ParseIP("192.168.50.20"))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, dst := conn.exchangeTo(t, request)
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+		t.Fatalf("expected NAK, got %v", resp)
+	}
+	if dst != broadcast {
+		t.Fatalf("NAK sent to %s, want %s", dst, broadcast)
+	}
+}
+
+func TestServerRestoresLeases(t *testing.T) {
+	cfg := testConfig(t)
+	hw, _ := net.ParseMAC("02:00:00:00:00:01")
+
+	_, conn := startServer(t, cfg, &fakeHosts{names: make(map[string]string)})
+	dora(t, conn, hw, "laptop")
+	other, _ := net.ParseMAC("02:00:00:00:00:02")
+	dora(t, conn, other, "phone")
+
+	// A restarted server keeps the address and name of known clients
+	hosts := &fakeHosts{names: make(map[string]string)}
+	s, conn := startServer(t, cfg, hosts)
+	if got := hosts.lookup("phone.lan"); got != "192.168.50.101" {
+		t.Fatalf("phone.lan restored as %q", got)
+	}
+	if leases := s.Leases(); len(leases) != 2 {
+		t.Fatalf("restored %d leases, want 2", len(leases))
+	}
+	if got := dora(t, conn, other, "phone").YourIPAddr.String(); got != "192.168.50.101" {
+		t.Fatalf("known client leased %s after restart", got)
+	}
+}
+
+func TestServerReplyDestination(t *testing.T) {
+	_, conn := startServer(t, testConfig(t), &fakeHosts{names: make(map[string]string)})
+
+	hw, _ := net.ParseMAC("02:00:00:00:00:01")
+	leased := dora(t, conn, hw, "laptop").YourIPAddr
+
+	renew := func(modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+		req, err := dhcpv4.New(append([]dhcpv4.Modifier{
+			dhcpv4.WithHwAddr(hw),
+			dhcpv4.WithClientIP(leased),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		}, modifiers...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	relayed, err := dhcpv4.NewDiscovery(hw, dhcpv4.WithGatewayIP(net.ParseIP("192.168.60.1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  *dhcpv4.DHCPv4
+		want string
+	}{
+		{name: "renewing client gets unicast", req: renew(), want: "192.168.50.100:68"},
+		{name: "broadcast flag", req: renew(dhcpv4.WithBroadcast(true)), want: broadcast},
+		{name: "relay agent", req: relayed, want: "192.168.60.1:67"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, dst := conn.exchangeTo(t, tt.req)
+			if resp == nil {
+				t.Fatal("no reply")
+			}
+			if dst != tt.want {
+				t.Fatalf("%s sent to %s, want %s", resp.MessageType(), dst, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerIgnoresOtherServersOffer(t *testing.T) {
+	_, conn := startServer(t, testConfig(t), &fakeHosts{names: make(map[string]string)})
+
+	hw, _ := net.ParseMAC("02:00:00:00:00:01")
+	request, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(hw),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.ParseIP("10.0.0.5"))),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.ParseIP("10.0.0.1"))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := conn.exchange(t, request); resp != nil {
+		t.Fatalf("answered a request for another server: %v", resp)
+	}
+}
+
+func TestSanitizeHostname(t *testing.T) {
+	tests := map[string]string{
+		"Laptop":                "laptop",
+		"my_phone":              "my-phone",
+		"host.example":          "host",
+		"-weird name!-":         "weird-name",
+		"":                      "",
+		strings.Repeat("a", 80): strings.Repeat("a", 63),
+	}
+	for in, want := range tests {
+		if got := sanitizeHostname(in); got != want {
+			t.Errorf("sanitizeHostname(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Roman-Samoilenko/privacy-hub/internal/metrics"
 	"github.com/miekg/dns"
 )
 
@@ -101,6 +102,7 @@ func (c *Cache) evictOldest() {
 
 	if oldestKey != "" {
 		delete(c.entries, oldestKey)
+		metrics.DNSCacheEvictions.Inc()
 	}
 }
 
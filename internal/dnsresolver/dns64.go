@@ -0,0 +1,197 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultDNS64Prefix = "64:ff9b::/96"
+
+	// TTL of synthesized records when the AAAA answer carries no SOA
+	dns64MaxTTL = 600
+)
+
+// DNS64 synthesizes AAAA records from A records for IPv6-only clients
+// behind NAT64 (RFC 6147, addresses embedded as in RFC 6052).
+type DNS64 struct {
+	prefix  netip.Prefix
+	exclude []netip.Prefix
+}
+
+func NewDNS64(cfg config.DNS64Config) (*DNS64, error) {
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = DefaultDNS64Prefix
+	}
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil || !p.Addr().Is6() {
+		return nil, fmt.Errorf("invalid prefix %q", prefix)
+	}
+
+	d := &DNS64{prefix: p.Masked()}
+
+	// IPv4-mapped addresses are never usable by IPv6-only hosts
+	exclude := cfg.Exclude
+	if len(exclude) == 0 {
+		exclude = []string{"::ffff:0:0/96"}
+	}
+	for _, entry := range exclude {
+		e, err := parsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude range %q: %v", entry, err)
+		}
+		d.exclude = append(d.exclude, e)
+	}
+
+	return d, nil
+}
+
+// applies reports whether the AAAA answer resp to req leaves the client
+// without usable addresses, after dropping the excluded ones.
+func (d *DNS64) applies(req, resp *dns.Msg) bool {
+	if d == nil {
+		return false
+	}
+	question := req.Question[0]
+	if question.Qtype != dns.TypeAAAA || question.Qclass != dns.ClassINET {
+		return false
+	}
+	// Validating clients would reject the synthesized records
+	if opt := req.IsEdns0(); opt != nil && opt.Do() && req.CheckingDisabled {
+		return false
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return false
+	}
+
+	usable := false
+	kept := resp.Answer[:0]
+	for _, rr := range resp.Answer {
+		// Not unmapped, so ::ffff:0:0/96 can be excluded
+		if v, ok := rr.(*dns.AAAA); ok {
+			if addr, ok := netip.AddrFromSlice(v.AAAA); ok && d.excluded(addr) {
+				continue
+			}
+			usable = true
+		}
+		kept = append(kept, rr)
+	}
+	resp.Answer = kept
+
+	return !usable
+}
+
+// synthesize answers resp's question from the A answer a. It returns nil
+// when a has no usable address, so the AAAA answer stands.
+func (d *DNS64) synthesize(resp, a *dns.Msg) *dns.Msg {
+	if a.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	// Synthesized records live no longer than the negative AAAA answer
+	ttl := uint32(dns64MaxTTL)
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	var answer []dns.RR
+	found := false
+	for _, rr := range a.Answer {
+		v, ok := rr.(*dns.A)
+		if !ok {
+			// CNAME chain of the A answer
+			if rr.Header().Rrtype != dns.TypeAAAA {
+				answer = append(answer, dns.Copy(rr))
+			}
+			continue
+		}
+		addr, ok := rrAddr(v)
+		if !ok || d.excluded(addr) {
+			continue
+		}
+		answer = append(answer, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   v.Hdr.Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    min(v.Hdr.Ttl, ttl),
+			},
+			AAAA: net.IP(d.embed(addr).AsSlice()),
+		})
+		found = true
+	}
+	if !found {
+		return nil
+	}
+
+	out := resp.Copy()
+	out.Rcode = dns.RcodeSuccess
+	out.Answer = answer
+	out.Ns = nil
+	out.AuthenticatedData = false
+	return out
+}
+
+// embed places v4 into the prefix, skipping bits 64 to 71 (RFC 6052 2.2).
+func (d *DNS64) embed(v4 netip.Addr) netip.Addr {
+	addr := d.prefix.Addr().As16()
+	pos := d.prefix.Bits() / 8
+	for _, b := range v4.As4() {
+		if pos == 8 {
+			pos++
+		}
+		addr[pos] = b
+		pos++
+	}
+	return netip.AddrFrom16(addr)
+}
+
+func (d *DNS64) excluded(addr netip.Addr) bool {
+	for _, prefix := range d.exclude {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// synthesizeAAAA looks up the A records behind an AAAA answer without
+// usable addresses and returns the synthesized answer, or resp when there
+// is nothing to synthesize. The A answer passes the IP filter first; true
+// means it is blocked.
+func (r *Resolver) synthesizeAAAA(q *query, resp *dns.Msg, cacheName string) (*dns.Msg, bool) {
+	name := q.req.Question[0].Name
+
+	a := r.cache.Get(cacheName, dns.TypeA)
+	if a == nil {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		var err error
+		if a, _, err = r.forward(req, q.profile.upstreams); err != nil {
+			logger.Debugf("DNS64: A lookup failed for %s: %v", name, err)
+			return resp, false
+		}
+		if a.Rcode == dns.RcodeSuccess {
+			r.cache.Set(cacheName, dns.TypeA, a)
+		}
+	}
+
+	if r.ipFilter.Apply(name, a) {
+		return nil, true
+	}
+
+	synthesized := r.dns64.synthesize(resp, a)
+	if synthesized == nil {
+		return resp, false
+	}
+	logger.Debugf("DNS64: synthesized %d AAAA records for %s", len(synthesized.Answer), name)
+	return synthesized, false
+}
@@ -0,0 +1,240 @@
+package dnsresolver
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream answers from canned records per query type and counts the
+// queries it gets.
+type fakeUpstream struct {
+	rcode   map[uint16]int
+	answer  map[uint16][]dns.RR
+	ns      map[uint16][]dns.RR
+	queries map[uint16]int
+	mu      sync.Mutex
+}
+
+func newFakeUpstream() *fakeUpstream {
+	return &fakeUpstream{
+		rcode:   make(map[uint16]int),
+		answer:  make(map[uint16][]dns.RR),
+		ns:      make(map[uint16][]dns.RR),
+		queries: make(map[uint16]int),
+	}
+}
+
+func (u *fakeUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	qtype := req.Question[0].Qtype
+	u.queries[qtype]++
+
+	resp := new(dns.Msg)
+	resp.SetRcode(req, u.rcode[qtype])
+	for _, rr := range u.answer[qtype] {
+		resp.Answer = append(resp.Answer, dns.Copy(rr))
+	}
+	for _, rr := range u.ns[qtype] {
+		resp.Ns = append(resp.Ns, dns.Copy(rr))
+	}
+	return resp, nil
+}
+
+func (u *fakeUpstream) Address() string { return "fake" }
+
+func (u *fakeUpstream) count(qtype uint16) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.queries[qtype]
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func newDNS64Resolver(t *testing.T, cfg config.DNS64Config, upstream Upstream) *Resolver {
+	t.Helper()
+	cfg.Enabled = true
+	r := NewResolver(config.DNSConfig{CacheSize: 100, CacheTTL: 300, DNS64: cfg})
+	if r.dns64 == nil {
+		t.Fatal("DNS64 not enabled")
+	}
+	r.profiles[DefaultProfile].upstreams = []Upstream{upstream}
+	return r
+}
+
+func queryAAAA(r *Resolver, name string) *dns.Msg {
+	w := newRecorder()
+	r.ServeDNS(w, question(name, dns.TypeAAAA, dns.ClassINET))
+	return w.msg
+}
+
+func aaaaAnswers(resp *dns.Msg) []string {
+	var addrs []string
+	for _, rr := range resp.Answer {
+		if v, ok := rr.(*dns.AAAA); ok {
+			addrs = append(addrs, v.AAAA.String())
+		}
+	}
+	return addrs
+}
+
+func TestDNS64Embed(t *testing.T) {
+	// RFC 6052 section 2.4 examples for 192.0.2.33
+	tests := map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+	}
+	for prefix, want := range tests {
+		d, err := NewDNS64(config.DNS64Config{Prefix: prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.embed(netip.MustParseAddr("192.0.2.33")); got != netip.MustParseAddr(want) {
+			t.Errorf("%s: embedded as %s, want %s", prefix, got, want)
+		}
+	}
+}
+
+func TestDNS64SynthesizesFromA(t *testing.T) {
+	upstream := newFakeUpstream()
+	upstream.ns[dns.TypeAAAA] = []dns.RR{mustRR(t, "example.com. 3600 IN SOA ns.example.com. host.example.com. 1 7200 3600 1209600 60")}
+	upstream.answer[dns.TypeA] = []dns.RR{
+		mustRR(t, "v4only.example.com. 300 IN CNAME host.example.com."),
+		mustRR(t, "host.example.com. 300 IN A 192.0.2.1"),
+	}
+	r := newDNS64Resolver(t, config.DNS64Config{}, upstream)
+
+	resp := queryAAAA(r, "v4only.example.com.")
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+	if got := aaaaAnswers(resp); len(got) != 1 || got[0] != "64:ff9b::c000:201" {
+		t.Fatalf("synthesized %v", got)
+	}
+	if len(resp.Answer) != 2 || resp.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatalf("CNAME chain lost: %v", resp.Answer)
+	}
+	if ttl := resp.Answer[1].Header().Ttl; ttl != 60 {
+		t.Fatalf("TTL %d, want the SOA minimum", ttl)
+	}
+	if len(resp.Ns) != 0 {
+		t.Fatalf("negative SOA kept: %v", resp.Ns)
+	}
+
+	// The synthesized answer is cached
+	queryAAAA(r, "v4only.example.com.")
+	if n := upstream.count(dns.TypeAAAA); n != 1 {
+		t.Fatalf("%d AAAA queries upstream, want 1", n)
+	}
+	if n := upstream.count(dns.TypeA); n != 1 {
+		t.Fatalf("%d A queries upstream, want 1", n)
+	}
+}
+
+func TestDNS64KeepsNativeAAAA(t *testing.T) {
+	upstream := newFakeUpstream()
+	upstream.answer[dns.TypeAAAA] = []dns.RR{mustRR(t, "dual.example.com. 300 IN AAAA 2001:db8::1")}
+	upstream.answer[dns.TypeA] = []dns.RR{mustRR(t, "dual.example.com. 300 IN A 192.0.2.1")}
+	r := newDNS64Resolver(t, config.DNS64Config{}, upstream)
+
+	resp := queryAAAA(r, "dual.example.com.")
+	if got := aaaaAnswers(resp); len(got) != 1 || got[0] != "2001:db8::1" {
+		t.Fatalf("answer %v, want the native address", got)
+	}
+	if n := upstream.count(dns.TypeA); n != 0 {
+		t.Fatalf("%d A queries for a name with AAAA records", n)
+	}
+}
+
+func TestDNS64Exclusions(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude []string
+		aaaa    string
+		a       string
+		want    []string
+	}{
+		{
+			name: "mapped AAAA is ignored by default",
+			aaaa: "host.example.com. 300 IN AAAA ::ffff:192.0.2.1",
+			a:    "host.example.com. 300 IN A 192.0.2.1",
+			want: []string{"64:ff9b::c000:201"},
+		},
+		{
+			name:    "excluded AAAA range",
+			exclude: []string{"2001:db8:dead::/48"},
+			aaaa:    "host.example.com. 300 IN AAAA 2001:db8:dead::1",
+			a:       "host.example.com. 300 IN A 198.51.100.7",
+			want:    []string{"64:ff9b::c633:6407"},
+		},
+		{
+			name:    "excluded IPv4 range is not synthesized",
+			exclude: []string{"10.0.0.0/8"},
+			a:       "host.example.com. 300 IN A 10.1.2.3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newFakeUpstream()
+			if tt.aaaa != "" {
+				upstream.answer[dns.TypeAAAA] = []dns.RR{mustRR(t, tt.aaaa)}
+			}
+			upstream.answer[dns.TypeA] = []dns.RR{mustRR(t, tt.a)}
+			r := newDNS64Resolver(t, config.DNS64Config{Exclude: tt.exclude}, upstream)
+
+			resp := queryAAAA(r, "host.example.com.")
+			got := aaaaAnswers(resp)
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Fatalf("answer %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNS64SkipsNXDomain(t *testing.T) {
+	upstream := newFakeUpstream()
+	upstream.rcode[dns.TypeAAAA] = dns.RcodeNameError
+	upstream.answer[dns.TypeA] = []dns.RR{mustRR(t, "gone.example.com. 300 IN A 192.0.2.1")}
+	r := newDNS64Resolver(t, config.DNS64Config{}, upstream)
+
+	resp := queryAAAA(r, "gone.example.com.")
+	if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Fatalf("got %s with %d answers, want NXDOMAIN", dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	}
+	if n := upstream.count(dns.TypeA); n != 0 {
+		t.Fatalf("%d A queries for a missing name", n)
+	}
+}
+
+func TestDNS64RespectsIPFilter(t *testing.T) {
+	upstream := newFakeUpstream()
+	upstream.answer[dns.TypeA] = []dns.RR{mustRR(t, "ads.example.com. 300 IN A 203.0.113.5")}
+	r := newDNS64Resolver(t, config.DNS64Config{}, upstream)
+	r.ipFilter = NewIPFilter([]string{"203.0.113.0/24"}, IPBlockModeBlock, false, nil)
+
+	resp := queryAAAA(r, "ads.example.com.")
+	for _, rr := range resp.Answer {
+		if v, ok := rr.(*dns.AAAA); ok && !v.AAAA.Equal(net.IPv6zero) {
+			t.Fatalf("blocked address synthesized: %v", v)
+		}
+	}
+}
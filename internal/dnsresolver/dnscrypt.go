@@ -0,0 +1,379 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// DNSCrypt v2, see https://dnscrypt.info/protocol
+const (
+	dnscryptCertMagic     = "DNSC"
+	dnscryptResolverMagic = "r6fnvWj8"
+	dnscryptCertSize      = 124
+
+	// X25519-XSalsa20Poly1305, the only construction we speak
+	dnscryptXSalsa20 = 0x0001
+
+	dnscryptHalfNonce    = 12
+	dnscryptMinQuerySize = 256
+	dnscryptPadBlock     = 64
+
+	// Resolvers publish the next certificate before the current one
+	// expires, so we look for it regularly
+	dnscryptCertRefresh = time.Hour
+)
+
+// dnscryptCert is a verified resolver certificate together with the client
+// key pair used while it is current.
+type dnscryptCert struct {
+	serial      uint32
+	resolverKey [32]byte
+	clientMagic [8]byte
+	notBefore   time.Time
+	notAfter    time.Time
+
+	publicKey [32]byte
+	sharedKey [32]byte
+}
+
+// parseDNSCryptCert checks the signature of a certificate against the
+// provider key from the stamp.
+func parseDNSCryptCert(data []byte, providerKey ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(data) < dnscryptCertSize || string(data[:4]) != dnscryptCertMagic {
+		return nil, fmt.Errorf("malformed dnscrypt certificate")
+	}
+	if v := binary.BigEndian.Uint16(data[4:6]); v != dnscryptXSalsa20 {
+		return nil, fmt.Errorf("unsupported dnscrypt construction %d", v)
+	}
+	if !ed25519.Verify(providerKey, data[72:], data[8:72]) {
+		return nil, fmt.Errorf("invalid dnscrypt certificate signature")
+	}
+
+	cert := &dnscryptCert{
+		serial:    binary.BigEndian.Uint32(data[112:116]),
+		notBefore: time.Unix(int64(binary.BigEndian.Uint32(data[116:120])), 0),
+		notAfter:  time.Unix(int64(binary.BigEndian.Uint32(data[120:124])), 0),
+	}
+	copy(cert.resolverKey[:], data[72:104])
+	copy(cert.clientMagic[:], data[104:112])
+	return cert, nil
+}
+
+func (c *dnscryptCert) valid(now time.Time) bool {
+	return !now.Before(c.notBefore) && now.Before(c.notAfter)
+}
+
+// dnscryptUpstream is a DNSCrypt v2 resolver described by a stamp.
+type dnscryptUpstream struct {
+	addr         string
+	providerName string
+	providerKey  ed25519.PublicKey
+	timeout      time.Duration
+
+	// certificates are fetched as plain TXT records
+	certResolver *plainUpstream
+
+	cert      *dnscryptCert
+	fetchedAt time.Time
+	fetch     *certFetch // running fetch, nil when none
+	mu        sync.Mutex
+}
+
+func newDNSCryptUpstream(stamp *serverStamp, timeout time.Duration) *dnscryptUpstream {
+	return &dnscryptUpstream{
+		addr:         stamp.addr,
+		providerName: dns.Fqdn(stamp.providerName),
+		providerKey:  ed25519.PublicKey(stamp.providerKey),
+		timeout:      timeout,
+		certResolver: newPlainUpstream(stamp.addr, timeout),
+	}
+}
+
+func (u *dnscryptUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	cert, err := u.certificate(false)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.exchange(cert, req)
+	if err != nil {
+		// The resolver may have rotated its certificate early
+		fresh, certErr := u.certificate(true)
+		if certErr != nil || fresh.serial == cert.serial {
+			return nil, err
+		}
+		resp, err = u.exchange(fresh, req)
+	}
+	return resp, err
+}
+
+func (u *dnscryptUpstream) Address() string {
+	return "dnscrypt://" + u.addr
+}
+
+// certificate returns the current certificate, fetching the published ones
+// when missing, expired, due for a refresh or refresh is set. Fetches run
+// without holding u.mu and concurrent callers share them. A due refresh
+// runs in the background while the current certificate stays in use.
+func (u *dnscryptUpstream) certificate(refresh bool) (*dnscryptCert, error) {
+	u.mu.Lock()
+	now := time.Now()
+	cert := u.cert
+	if cert != nil && !cert.valid(now) {
+		cert = nil
+	}
+	if !refresh && cert != nil && now.Sub(u.fetchedAt) < dnscryptCertRefresh {
+		u.mu.Unlock()
+		return cert, nil
+	}
+
+	fetch := u.fetch
+	if fetch == nil {
+		fetch = &certFetch{done: make(chan struct{})}
+		u.fetch = fetch
+		go u.runFetch(fetch)
+	}
+	u.mu.Unlock()
+
+	if !refresh && cert != nil {
+		return cert, nil
+	}
+	<-fetch.done
+	return fetch.cert, fetch.err
+}
+
+// runFetch fetches the certificates and swaps the current one under u.mu.
+func (u *dnscryptUpstream) runFetch(fetch *certFetch) {
+	now := time.Now()
+	cert, err := u.fetchCertificate(now)
+
+	u.mu.Lock()
+	if err == nil {
+		cert, err = u.useCertificate(cert, now)
+	}
+	fetch.cert, fetch.err = cert, err
+	u.fetch = nil
+	u.mu.Unlock()
+	close(fetch.done)
+
+	if err != nil {
+		logger.Debugf("Failed to refresh dnscrypt certificate of %s: %v", u.providerName, err)
+	}
+}
+
+// certFetch is a certificate fetch in progress, done is closed once cert
+// and err are set.
+type certFetch struct {
+	done chan struct{}
+	cert *dnscryptCert
+	err  error
+}
+
+// fetchCertificate queries the published certificates and returns the
+// newest one valid at now.
+func (u *dnscryptUpstream) fetchCertificate(now time.Time) (*dnscryptCert, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(u.providerName, dns.TypeTXT)
+	resp, err := u.certResolver.Exchange(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch dnscrypt certificate: %v", err)
+	}
+
+	var best *dnscryptCert
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := parseDNSCryptCert(unescapeTXT(strings.Join(txt.Txt, "")), u.providerKey)
+		if err != nil {
+			logger.Debugf("Ignoring dnscrypt certificate of %s: %v", u.providerName, err)
+			continue
+		}
+		if cert.valid(now) && (best == nil || cert.serial > best.serial) {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no valid dnscrypt certificate for %s", u.providerName)
+	}
+	return best, nil
+}
+
+// useCertificate makes cert current, keeping the client key pair when the
+// resolver still publishes the same certificate. Called with u.mu held.
+func (u *dnscryptUpstream) useCertificate(cert *dnscryptCert, now time.Time) (*dnscryptCert, error) {
+	if u.cert != nil && u.cert.serial == cert.serial {
+		cert = u.cert
+	} else {
+		publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		cert.publicKey = *publicKey
+		box.Precompute(&cert.sharedKey, &cert.resolverKey, privateKey)
+		logger.Debugf("Using dnscrypt certificate %d of %s", cert.serial, u.providerName)
+	}
+
+	u.cert = cert
+	u.fetchedAt = now
+	return cert, nil
+}
+
+// exchange sends the query over UDP and repeats it over TCP when the
+// answer is truncated.
+func (u *dnscryptUpstream) exchange(cert *dnscryptCert, req *dns.Msg) (*dns.Msg, error) {
+	wire, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.roundTrip("udp", cert, wire)
+	if err == nil && resp.Truncated {
+		resp, err = u.roundTrip("tcp", cert, wire)
+	}
+	return resp, err
+}
+
+func (u *dnscryptUpstream) roundTrip(network string, cert *dnscryptCert, wire []byte) (*dns.Msg, error) {
+	minSize := 0
+	if network == "udp" {
+		minSize = dnscryptMinQuerySize
+	}
+	packet, clientNonce, err := dnscryptEncrypt(cert, wire, minSize)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout(network, u.addr, u.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(u.timeout))
+
+	var data []byte
+	if network == "udp" {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		data = buf[:n]
+	} else {
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packet)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		data = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil, err
+		}
+	}
+
+	plain, err := dnscryptDecrypt(cert, clientNonce, data)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(plain); err != nil {
+		return nil, fmt.Errorf("invalid dnscrypt response: %v", err)
+	}
+	return resp, nil
+}
+
+// dnscryptEncrypt builds client-magic || client-pk || client-nonce ||
+// box(padded query). The query is padded ISO/IEC 7816-4 style to a
+// multiple of 64 bytes and at least minSize.
+func dnscryptEncrypt(cert *dnscryptCert, wire []byte, minSize int) ([]byte, []byte, error) {
+	padded := max(minSize, (len(wire)+1+dnscryptPadBlock-1)/dnscryptPadBlock*dnscryptPadBlock)
+	if padded > dns.MaxMsgSize-box.Overhead-8-32-dnscryptHalfNonce {
+		return nil, nil, fmt.Errorf("query too large for dnscrypt")
+	}
+	plain := make([]byte, padded)
+	copy(plain, wire)
+	plain[len(wire)] = 0x80
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:dnscryptHalfNonce]); err != nil {
+		return nil, nil, err
+	}
+
+	packet := make([]byte, 0, 8+32+dnscryptHalfNonce+padded+box.Overhead)
+	packet = append(packet, cert.clientMagic[:]...)
+	packet = append(packet, cert.publicKey[:]...)
+	packet = append(packet, nonce[:dnscryptHalfNonce]...)
+	packet = box.SealAfterPrecomputation(packet, plain, &nonce, &cert.sharedKey)
+	return packet, nonce[:dnscryptHalfNonce], nil
+}
+
+// dnscryptDecrypt opens resolver-magic || nonce || box(padded response)
+// and checks that the nonce continues ours.
+func dnscryptDecrypt(cert *dnscryptCert, clientNonce, data []byte) ([]byte, error) {
+	header := len(dnscryptResolverMagic) + 24
+	if len(data) < header+box.Overhead || string(data[:len(dnscryptResolverMagic)]) != dnscryptResolverMagic {
+		return nil, fmt.Errorf("malformed dnscrypt response")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], data[len(dnscryptResolverMagic):header])
+	if !bytes.Equal(nonce[:dnscryptHalfNonce], clientNonce) {
+		return nil, fmt.Errorf("dnscrypt response nonce does not match query")
+	}
+
+	plain, ok := box.OpenAfterPrecomputation(nil, data[header:], &nonce, &cert.sharedKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to decrypt dnscrypt response")
+	}
+
+	plain = bytes.TrimRight(plain, "\x00")
+	if len(plain) == 0 || plain[len(plain)-1] != 0x80 {
+		return nil, fmt.Errorf("invalid dnscrypt response padding")
+	}
+	return plain[:len(plain)-1], nil
+}
+
+// unescapeTXT turns the presentation form miekg/dns uses for TXT strings
+// back into bytes: \DDD is a decimal byte, \X the character X.
+func unescapeTXT(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			b = append(b, (s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		b = append(b, s[i+1])
+		i++
+	}
+	return b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,286 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const dnscryptTestProvider = "2.dnscrypt-cert.test."
+
+// dnscryptServer is a stand-in DNSCrypt resolver on UDP. It publishes its
+// certificates as TXT records of the provider name and answers every
+// encrypted A query with 192.0.2.1.
+type dnscryptServer struct {
+	t           *testing.T
+	conn        net.PacketConn
+	providerKey ed25519.PrivateKey
+
+	publicKey   *[32]byte
+	secretKey   *[32]byte
+	magic       [8]byte
+	txt         []string // published certificates, escaped for dns.TXT
+	certQueries int
+	gate        chan struct{} // certificate answers wait until it is closed
+	mu          sync.Mutex
+}
+
+func newDNSCryptServer(t *testing.T) *dnscryptServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	_, providerKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dnscryptServer{t: t, conn: conn, providerKey: providerKey}
+	srv.rotate(1)
+	go srv.serve()
+	return srv
+}
+
+// stamp is the sdns:// stamp clients use to reach the server.
+func (srv *dnscryptServer) stamp() string {
+	key := srv.providerKey.Public().(ed25519.PublicKey)
+	return rawStamp(dnscryptStampData(srv.conn.LocalAddr().String(), key, dnscryptTestProvider))
+}
+
+// rotate switches to a new key pair and publishes only its certificate.
+func (srv *dnscryptServer) rotate(serial uint32) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		srv.t.Fatal(err)
+	}
+	srv.publicKey, srv.secretKey = publicKey, secretKey
+	rand.Read(srv.magic[:])
+	srv.txt = []string{srv.certTXT(srv.providerKey, serial, time.Now().Add(time.Hour))}
+}
+
+// hold makes certificate answers wait until the returned channel is closed.
+func (srv *dnscryptServer) hold() chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.gate = make(chan struct{})
+	return srv.gate
+}
+
+// publish adds a certificate for the current key pair.
+func (srv *dnscryptServer) publish(signer ed25519.PrivateKey, serial uint32, notAfter time.Time) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.txt = append(srv.txt, srv.certTXT(signer, serial, notAfter))
+}
+
+func (srv *dnscryptServer) certTXT(signer ed25519.PrivateKey, serial uint32, notAfter time.Time) string {
+	data := make([]byte, dnscryptCertSize)
+	copy(data, dnscryptCertMagic)
+	binary.BigEndian.PutUint16(data[4:], dnscryptXSalsa20)
+	copy(data[72:], srv.publicKey[:])
+	copy(data[104:], srv.magic[:])
+	binary.BigEndian.PutUint32(data[112:], serial)
+	binary.BigEndian.PutUint32(data[116:], uint32(time.Now().Add(-time.Hour).Unix()))
+	binary.BigEndian.PutUint32(data[120:], uint32(notAfter.Unix()))
+	copy(data[8:72], ed25519.Sign(signer, data[72:]))
+
+	var txt strings.Builder
+	for _, b := range data {
+		fmt.Fprintf(&txt, "\\%03d", b)
+	}
+	return txt.String()
+}
+
+func (srv *dnscryptServer) serve() {
+	for {
+		buf := make([]byte, dns.MaxMsgSize)
+		n, addr, err := srv.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		go func() {
+			if reply := srv.handle(buf[:n]); reply != nil {
+				srv.conn.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+func (srv *dnscryptServer) handle(packet []byte) []byte {
+	srv.mu.Lock()
+	magic, publicKey, secretKey := srv.magic, srv.publicKey, srv.secretKey
+	srv.mu.Unlock()
+
+	if bytes.HasPrefix(packet, magic[:]) {
+		return srv.answer(packet, publicKey, secretKey)
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packet); err != nil {
+		// Queries for a certificate we no longer have
+		return []byte("unknown client magic")
+	}
+	srv.mu.Lock()
+	srv.certQueries++
+	gate, txt := srv.gate, srv.txt
+	srv.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for _, s := range txt {
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: dnscryptTestProvider, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{s},
+		})
+	}
+	wire, _ := resp.Pack()
+	return wire
+}
+
+func (srv *dnscryptServer) answer(packet []byte, publicKey, secretKey *[32]byte) []byte {
+	var clientKey [32]byte
+	var nonce [24]byte
+	copy(clientKey[:], packet[8:40])
+	copy(nonce[:], packet[40:40+dnscryptHalfNonce])
+
+	plain, ok := box.Open(nil, packet[40+dnscryptHalfNonce:], &nonce, &clientKey, secretKey)
+	if !ok {
+		srv.t.Error("failed to open dnscrypt query")
+		return nil
+	}
+	if len(plain) < dnscryptMinQuerySize || len(plain)%dnscryptPadBlock != 0 {
+		srv.t.Errorf("query padded to %d bytes", len(plain))
+	}
+	plain = bytes.TrimRight(plain, "\x00")
+	req := new(dns.Msg)
+	if err := req.Unpack(plain[:len(plain)-1]); err != nil {
+		srv.t.Errorf("bad padded query: %v", err)
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	}}
+	wire, _ := resp.Pack()
+	wire = append(wire, 0x80, 0, 0)
+
+	rand.Read(nonce[dnscryptHalfNonce:])
+	reply := append([]byte(dnscryptResolverMagic), nonce[:]...)
+	return box.Seal(reply, wire, &nonce, &clientKey, secretKey)
+}
+
+func newDNSCryptTestUpstream(t *testing.T, srv *dnscryptServer) *dnscryptUpstream {
+	t.Helper()
+	u, err := stampUpstream(srv.stamp(), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.(*dnscryptUpstream)
+}
+
+func TestDNSCryptExchange(t *testing.T) {
+	srv := newDNSCryptServer(t)
+	// Neither a forged nor an expired certificate may win by serial
+	_, forger, _ := ed25519.GenerateKey(rand.Reader)
+	srv.publish(forger, 5, time.Now().Add(time.Hour))
+	srv.publish(srv.providerKey, 6, time.Now().Add(-time.Minute))
+
+	u := newDNSCryptTestUpstream(t, srv)
+	exchange := func() {
+		t.Helper()
+		resp, err := u.Exchange(question("example.com.", dns.TypeA, dns.ClassINET))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Fatalf("answer %v", resp.Answer)
+		}
+	}
+
+	exchange()
+	if u.cert.serial != 1 {
+		t.Fatalf("using certificate %d, want 1", u.cert.serial)
+	}
+
+	// A resolver rotating early is picked up on the first failure
+	srv.rotate(2)
+	exchange()
+	if u.cert.serial != 2 {
+		t.Fatalf("using certificate %d after rotation, want 2", u.cert.serial)
+	}
+}
+
+func TestDNSCryptCertificateFetch(t *testing.T) {
+	srv := newDNSCryptServer(t)
+	u := newDNSCryptTestUpstream(t, srv)
+
+	// Concurrent callers without a certificate share one fetch
+	gate := srv.hold()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := u.certificate(false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+	srv.mu.Lock()
+	queries := srv.certQueries
+	srv.mu.Unlock()
+	if queries != 1 {
+		t.Fatalf("%d certificate queries, want 1", queries)
+	}
+
+	// A due refresh does not hold up queries while the provider is slow
+	gate = srv.hold()
+	u.mu.Lock()
+	u.fetchedAt = time.Now().Add(-2 * dnscryptCertRefresh)
+	u.mu.Unlock()
+
+	got := make(chan *dnscryptCert, 1)
+	go func() {
+		cert, _ := u.certificate(false)
+		got <- cert
+	}()
+	select {
+	case cert := <-got:
+		if cert == nil || cert.serial != 1 {
+			t.Fatalf("certificate %v during refresh", cert)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("query waited for the certificate refresh")
+	}
+
+	u.mu.Lock()
+	fetch := u.fetch
+	u.mu.Unlock()
+	close(gate)
+	if fetch != nil {
+		<-fetch.done
+	}
+}
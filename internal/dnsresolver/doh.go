@@ -0,0 +1,276 @@
+package dnsresolver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DoHPath  = "/dns-query"
+	JSONPath = "/resolve"
+
+	dohContentType  = "application/dns-message"
+	jsonContentType = "application/dns-json"
+)
+
+// NewDoHHandler serves RFC 8484 DNS-over-HTTPS on DoHPath and the JSON API
+// known from public resolvers on JSONPath.
+func NewDoHHandler(resolver *Resolver) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(DoHPath, func(w http.ResponseWriter, r *http.Request) {
+		serveDoH(resolver, w, r)
+	})
+	mux.HandleFunc(JSONPath, func(w http.ResponseWriter, r *http.Request) {
+		serveJSON(resolver, w, r)
+	})
+	return mux
+}
+
+func serveDoH(resolver *Resolver, w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(wire); err != nil {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+
+	resp := exchangeHTTP(resolver, r, req)
+	if resp == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := resp.Pack()
+	if err != nil {
+		http.Error(w, "failed to pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(resp)))
+	w.Write(out)
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type jsonResponse struct {
+	Status    int            `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []jsonQuestion `json:"Question"`
+	Answer    []jsonRR       `json:"Answer,omitempty"`
+	Authority []jsonRR       `json:"Authority,omitempty"`
+}
+
+func serveJSON(resolver *Resolver, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	name := params.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+
+	qtype := dns.TypeA
+	if t := params.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			http.Error(w, "invalid type", http.StatusBadRequest)
+			return
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.CheckingDisabled = isTrue(params.Get("cd"))
+	if isTrue(params.Get("do")) {
+		req.SetEdns0(ednsBufferSize, true)
+	}
+
+	resp := exchangeHTTP(resolver, r, req)
+	if resp == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	out := jsonResponse{
+		Status: resp.Rcode,
+		TC:     resp.Truncated,
+		RD:     resp.RecursionDesired,
+		RA:     resp.RecursionAvailable,
+		AD:     resp.AuthenticatedData,
+		CD:     resp.CheckingDisabled,
+		Answer: jsonRRs(resp.Answer),
+		// Authority carries the SOA of negative answers
+		Authority: jsonRRs(resp.Ns),
+	}
+	for _, q := range resp.Question {
+		out.Question = append(out.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(resp)))
+	json.NewEncoder(w).Encode(out)
+}
+
+func jsonRRs(rrs []dns.RR) []jsonRR {
+	var out []jsonRR
+	for _, rr := range rrs {
+		h := rr.Header()
+		out = append(out, jsonRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return out
+}
+
+func isTrue(v string) bool {
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+// minTTL is the lifetime of a response for HTTP caches.
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// exchangeHTTP runs req through the resolver as if it arrived over TCP
+// from the HTTP client.
+func exchangeHTTP(resolver *Resolver, r *http.Request, req *dns.Msg) *dns.Msg {
+	w := &httpResponseWriter{remote: httpRemoteAddr(resolver, r)}
+	resolver.ServeDNS(w, req)
+	return w.msg
+}
+
+// httpRemoteAddr returns the HTTP client. The address comes from the
+// socket, forwarding headers count only when a trusted proxy sent them.
+func httpRemoteAddr(resolver *Resolver, r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	p, _ := strconv.Atoi(port)
+	addr := &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+	if !resolver.trustedProxy(addr.IP) {
+		return addr
+	}
+
+	// Proxies append to X-Forwarded-For, the client is the rightmost hop
+	// that is not one of ours
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		hops := strings.Split(strings.Join(values, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			addr = &net.TCPAddr{IP: ip}
+			if !resolver.trustedProxy(ip) {
+				break
+			}
+		}
+		return addr
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	return addr
+}
+
+func (r *Resolver) trustedProxy(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range r.proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpResponseWriter captures the answer of ServeDNS for HTTP transports.
+type httpResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *httpResponseWriter) LocalAddr() net.Addr       { return &net.TCPAddr{} }
+func (w *httpResponseWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *httpResponseWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *httpResponseWriter) Close() error              { return nil }
+func (w *httpResponseWriter) TsigStatus() error         { return nil }
+func (w *httpResponseWriter) TsigTimersOnly(bool)       {}
+func (w *httpResponseWriter) Hijack()                   {}
+
+func (w *httpResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
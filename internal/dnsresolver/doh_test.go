@@ -0,0 +1,70 @@
+package dnsresolver
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+)
+
+func TestHTTPRemoteAddr(t *testing.T) {
+	r := NewResolver(config.DNSConfig{CacheSize: 100, TrustedProxies: []string{"10.0.0.1", "10.0.1.0/24"}})
+
+	tests := []struct {
+		name    string
+		peer    string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name:    "untrusted peer sets X-Forwarded-For",
+			peer:    "192.168.1.50:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"192.168.1.10"}},
+			want:    "192.168.1.50",
+		},
+		{
+			name:    "untrusted peer sets X-Real-IP",
+			peer:    "192.168.1.50:40000",
+			headers: map[string][]string{"X-Real-Ip": {"192.168.1.10"}},
+			want:    "192.168.1.50",
+		},
+		{
+			name:    "trusted proxy",
+			peer:    "10.0.0.1:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"192.168.1.10"}},
+			want:    "192.168.1.10",
+		},
+		{
+			name:    "spoofed hops before the trusted ones",
+			peer:    "10.0.0.1:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"192.168.1.99, 192.168.1.10", "10.0.1.7"}},
+			want:    "192.168.1.10",
+		},
+		{
+			name:    "trusted proxy with X-Real-IP",
+			peer:    "10.0.1.7:40000",
+			headers: map[string][]string{"X-Real-Ip": {"192.168.1.10"}},
+			want:    "192.168.1.10",
+		},
+		{
+			name: "trusted proxy without headers",
+			peer: "10.0.0.1:40000",
+			want: "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", DoHPath, nil)
+			req.RemoteAddr = tt.peer
+			for k, v := range tt.headers {
+				req.Header[k] = v
+			}
+			addr := httpRemoteAddr(r, req).(*net.TCPAddr)
+			if got := addr.IP.String(); got != tt.want {
+				t.Fatalf("client %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
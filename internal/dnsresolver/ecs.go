@@ -0,0 +1,182 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/miekg/dns"
+)
+
+const (
+	ECSStrip   = "strip"
+	ECSForward = "forward"
+	ECSReplace = "replace"
+)
+
+// ECSPolicy decides which EDNS Client Subnet, if any, an upstream sees.
+type ECSPolicy struct {
+	mode   string
+	subnet *dns.EDNS0_SUBNET
+}
+
+func NewECSPolicy(cfg config.ECSPolicyConfig) (*ECSPolicy, error) {
+	p := &ECSPolicy{mode: cfg.Mode}
+
+	switch cfg.Mode {
+	case "", ECSStrip:
+		p.mode = ECSStrip
+	case ECSForward:
+	case ECSReplace:
+		prefix, err := netip.ParsePrefix(cfg.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %v", cfg.Subnet, err)
+		}
+		p.subnet = subnetOption(prefix)
+	default:
+		return nil, fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+
+	return p, nil
+}
+
+// policyFor returns the policy of one upstream, falling back to strip when
+// the configuration is invalid.
+func policyFor(cfg config.ECSConfig, upstream string) *ECSPolicy {
+	policyCfg := cfg.ECSPolicyConfig
+	if override, ok := cfg.Upstreams[upstream]; ok {
+		policyCfg = override
+	}
+
+	p, err := NewECSPolicy(policyCfg)
+	if err != nil {
+		logger.Errorf("ECS policy for %s: %v, stripping", upstream, err)
+		p, _ = NewECSPolicy(config.ECSPolicyConfig{})
+	}
+	return p
+}
+
+// option returns the subnet to send for a client subnet, nil sends none.
+func (p *ECSPolicy) option(client *dns.EDNS0_SUBNET) *dns.EDNS0_SUBNET {
+	switch p.mode {
+	case ECSForward:
+		if client == nil {
+			return nil
+		}
+		o := *client
+		o.SourceScope = 0
+		return &o
+	case ECSReplace:
+		o := *p.subnet
+		return &o
+	default:
+		return nil
+	}
+}
+
+// apply replaces the client subnet of req according to the policy.
+func (p *ECSPolicy) apply(req *dns.Msg) *dns.Msg {
+	m := req.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(ednsBufferSize, false)
+		opt = m.IsEdns0()
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	if subnet := p.option(clientSubnet(req)); subnet != nil {
+		options = append(options, subnet)
+	}
+	opt.Option = options
+
+	return m
+}
+
+// ecsUpstream applies an ECS policy to every query of the wrapped upstream.
+type ecsUpstream struct {
+	Upstream
+	policy *ECSPolicy
+}
+
+func (u *ecsUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return u.Upstream.Exchange(u.policy.apply(req))
+}
+
+func clientSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+func subnetOption(prefix netip.Prefix) *dns.EDNS0_SUBNET {
+	prefix = prefix.Masked()
+	family := uint16(1)
+	if prefix.Addr().Is6() {
+		family = 2
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(prefix.Bits()),
+		Address:       net.IP(prefix.Addr().AsSlice()),
+	}
+}
+
+// scopedCacheName keys answers that are only valid for one client subnet.
+func scopedCacheName(name string, subnet *dns.EDNS0_SUBNET) string {
+	addr, ok := netip.AddrFromSlice(subnet.Address)
+	if !ok {
+		return name
+	}
+	prefix, err := addr.Unmap().Prefix(int(subnet.SourceNetmask))
+	if err != nil {
+		return name
+	}
+	return name + "/ecs=" + prefix.String()
+}
+
+// responseCacheName keys a response by the subnet it was answered for.
+// Answers with scope 0 apply to every subnet and are shared.
+func responseCacheName(name string, resp *dns.Msg) string {
+	if subnet := clientSubnet(resp); subnet != nil && subnet.SourceScope > 0 {
+		return scopedCacheName(name, subnet)
+	}
+	return name
+}
+
+// cachedAnswer looks up shared answers first, then answers scoped to the
+// subnets the profile upstreams would send for req.
+func (r *Resolver) cachedAnswer(profile *Profile, req *dns.Msg, name string) *dns.Msg {
+	qtype := req.Question[0].Qtype
+	if cached := r.cache.Get(name, qtype); cached != nil {
+		return cached
+	}
+
+	client := clientSubnet(req)
+	for _, upstream := range profile.upstreams {
+		u, ok := upstream.(*ecsUpstream)
+		if !ok {
+			continue
+		}
+		if subnet := u.policy.option(client); subnet != nil {
+			if cached := r.cache.Get(scopedCacheName(name, subnet), qtype); cached != nil {
+				return cached
+			}
+		}
+	}
+	return nil
+}
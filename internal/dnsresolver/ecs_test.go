@@ -0,0 +1,165 @@
+package dnsresolver
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+)
+
+// withSubnet adds a client subnet option to m.
+func withSubnet(m *dns.Msg, prefix string) *dns.Msg {
+	m.SetEdns0(ednsBufferSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, subnetOption(netip.MustParsePrefix(prefix)))
+	return m
+}
+
+// subnetString is the client subnet of m as a prefix, empty when it has none.
+func subnetString(m *dns.Msg) string {
+	subnet := clientSubnet(m)
+	if subnet == nil {
+		return ""
+	}
+	addr, _ := netip.AddrFromSlice(subnet.Address)
+	return netip.PrefixFrom(addr.Unmap(), int(subnet.SourceNetmask)).String()
+}
+
+// ecsEchoUpstream answers A queries by the client subnet it gets: 192.0.2.1
+// for 203.0.113.0/24, 192.0.2.2 for any other subnet and 192.0.2.3 without
+// one. The subnet is echoed with scope, names under "global." with scope 0.
+type ecsEchoUpstream struct {
+	subnets []string
+	mu      sync.Mutex
+}
+
+func (u *ecsEchoUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	u.mu.Lock()
+	u.subnets = append(u.subnets, subnetString(req))
+	u.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	ip := net.IPv4(192, 0, 2, 3)
+	if subnet := clientSubnet(req); subnet != nil {
+		ip = net.IPv4(192, 0, 2, 2)
+		if subnetString(req) == "203.0.113.0/24" {
+			ip = net.IPv4(192, 0, 2, 1)
+		}
+		echo := *subnet
+		if !dns.IsSubDomain("global.", req.Question[0].Name) {
+			echo.SourceScope = echo.SourceNetmask
+		}
+		resp.SetEdns0(ednsBufferSize, false)
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &echo)
+	}
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   ip,
+	}}
+	return resp, nil
+}
+
+func (u *ecsEchoUpstream) Address() string { return "echo" }
+
+func (u *ecsEchoUpstream) count() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.subnets)
+}
+
+func TestECSPolicy(t *testing.T) {
+	cfg := config.ECSConfig{
+		ECSPolicyConfig: config.ECSPolicyConfig{Mode: ECSStrip},
+		Upstreams: map[string]config.ECSPolicyConfig{
+			"forward.example": {Mode: ECSForward},
+			"replace.example": {Mode: ECSReplace, Subnet: "198.51.100.7/24"},
+			"broken.example":  {Mode: ECSReplace, Subnet: "not a subnet"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		upstream string
+		client   string // client subnet of the query, empty for none
+		want     string // subnet the upstream sees
+	}{
+		{name: "default strips", upstream: "1.1.1.1:853", client: "203.0.113.0/24"},
+		{name: "forward", upstream: "forward.example", client: "203.0.113.0/24", want: "203.0.113.0/24"},
+		{name: "forward without client subnet", upstream: "forward.example"},
+		{name: "replace", upstream: "replace.example", client: "203.0.113.0/24", want: "198.51.100.0/24"},
+		{name: "replace without client subnet", upstream: "replace.example", want: "198.51.100.0/24"},
+		{name: "invalid override strips", upstream: "broken.example", client: "203.0.113.0/24"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := &ecsEchoUpstream{}
+			u := &ecsUpstream{echo, policyFor(cfg, tt.upstream)}
+
+			req := question("example.com.", dns.TypeA, dns.ClassINET)
+			if tt.client != "" {
+				withSubnet(req, tt.client)
+			}
+			if _, err := u.Exchange(req); err != nil {
+				t.Fatal(err)
+			}
+			if got := echo.subnets[0]; got != tt.want {
+				t.Fatalf("upstream saw subnet %q, want %q", got, tt.want)
+			}
+			if tt.client != "" && subnetString(req) != tt.client {
+				t.Fatal("client query modified")
+			}
+		})
+	}
+}
+
+func TestECSScopedCache(t *testing.T) {
+	r := NewResolver(config.DNSConfig{
+		CacheSize: 100,
+		CacheTTL:  300,
+		Rewrites:  []config.RewriteConfig{{Domain: "video.home", Answer: "cdn.example.net"}},
+	})
+	echo := &ecsEchoUpstream{}
+	r.profiles[DefaultProfile].upstreams = []Upstream{
+		&ecsUpstream{echo, policyFor(config.ECSConfig{ECSPolicyConfig: config.ECSPolicyConfig{Mode: ECSForward}}, "echo")},
+	}
+
+	resolve := func(name, subnet string) string {
+		t.Helper()
+		w := newRecorder()
+		r.ServeDNS(w, withSubnet(question(name, dns.TypeA, dns.ClassINET), subnet))
+		if w.msg == nil || len(w.msg.Answer) == 0 {
+			t.Fatalf("no answer for %s from %s: %v", name, subnet, w.msg)
+		}
+		return w.msg.Answer[len(w.msg.Answer)-1].(*dns.A).A.String()
+	}
+
+	for _, name := range []string{"www.example.com.", "video.home."} {
+		// Scoped answers are kept per subnet
+		if got := resolve(name, "203.0.113.0/24"); got != "192.0.2.1" {
+			t.Fatalf("%s: first subnet got %s", name, got)
+		}
+		if got := resolve(name, "198.51.100.0/24"); got != "192.0.2.2" {
+			t.Fatalf("%s: second subnet got the answer of the first: %s", name, got)
+		}
+		queries := echo.count()
+		if got := resolve(name, "203.0.113.0/24"); got != "192.0.2.1" {
+			t.Fatalf("%s: cached answer for the first subnet is %s", name, got)
+		}
+		if echo.count() != queries {
+			t.Fatalf("%s: scoped answer not cached", name)
+		}
+	}
+
+	// Answers with scope 0 hold for every subnet
+	resolve("www.global.", "203.0.113.0/24")
+	queries := echo.count()
+	if got := resolve("www.global.", "198.51.100.0/24"); got != "192.0.2.1" || echo.count() != queries {
+		t.Fatalf("scope 0 answer not shared: %s", got)
+	}
+}
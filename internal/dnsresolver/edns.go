@@ -0,0 +1,98 @@
+package dnsresolver
+
+import (
+	"github.com/miekg/dns"
+)
+
+const (
+	// ednsBufferSize is advertised to clients and upstreams, the DNS flag day
+	// 2020 recommendation that avoids IP fragmentation
+	ednsBufferSize = 1232
+
+	// paddingBlockSize follows the RFC 8467 recommendation for queries
+	paddingBlockSize = 128
+)
+
+// upstreamQuery builds a fresh query for forwarding: a new random ID, only
+// the RD and CD flags of the client, and our own OPT record. Client EDNS
+// options, such as the client-id, stay on this side; only the DO bit and
+// the client subnet are passed on, the latter is left to the ECS policy of
+// each upstream.
+func upstreamQuery(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.Id = dns.Id()
+	m.RecursionDesired = true
+	m.CheckingDisabled = req.CheckingDisabled
+	m.Question = []dns.Question{req.Question[0]}
+
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	m.SetEdns0(ednsBufferSize, do)
+
+	if subnet := clientSubnet(req); subnet != nil {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, subnet)
+	}
+	return m
+}
+
+// padQuery adds RFC 7830 padding so the packed query is a multiple of
+// paddingBlockSize. Only meant for encrypted transports.
+func padQuery(req *dns.Msg) *dns.Msg {
+	m := req.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(ednsBufferSize, false)
+		opt = m.IsEdns0()
+	}
+
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+
+	// Option header is counted by Len, only the payload needs sizing
+	if rem := m.Len() % paddingBlockSize; rem != 0 {
+		padding.Padding = make([]byte, paddingBlockSize-rem)
+	}
+	return m
+}
+
+// finishResponse fits resp to the client: the upstream OPT record is replaced
+// by ours when the client used EDNS, and UDP answers larger than the client
+// buffer are truncated with TC set. A client subnet the client sent is
+// echoed with the scope the upstream answered for (RFC 7871 section 7.2).
+func finishResponse(req, resp *dns.Msg, network string) {
+	var scope uint8
+	if subnet := clientSubnet(resp); subnet != nil {
+		scope = subnet.SourceScope
+	}
+	resp.Extra = withoutOPT(resp.Extra)
+
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(ednsBufferSize, opt.Do())
+		size = max(int(opt.UDPSize()), dns.MinMsgSize)
+
+		if subnet := clientSubnet(req); subnet != nil {
+			echo := *subnet
+			echo.SourceScope = scope
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &echo)
+		}
+	}
+
+	if network == "tcp" {
+		size = dns.MaxMsgSize
+	}
+	resp.Truncate(size)
+}
+
+func withoutOPT(rrs []dns.RR) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
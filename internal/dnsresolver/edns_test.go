@@ -0,0 +1,144 @@
+package dnsresolver
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// bigResponse answers req with n A records.
+func bigResponse(req *dns.Msg, n int) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for i := 0; i < n; i++ {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	return resp
+}
+
+func TestFinishResponseBufferSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		edns    uint16 // 0 sends no OPT
+		network string
+		answers int
+		opt     bool
+		tc      bool
+		maxLen  int
+	}{
+		{name: "plain DNS fits 512", network: "udp", answers: 5, maxLen: dns.MinMsgSize},
+		{name: "plain DNS truncated at 512", network: "udp", answers: 60, tc: true, maxLen: dns.MinMsgSize},
+		{name: "client buffer below minimum", edns: 256, network: "udp", answers: 60, opt: true, tc: true, maxLen: dns.MinMsgSize},
+		{name: "client buffer honoured", edns: 4096, network: "udp", answers: 60, opt: true, maxLen: 4096},
+		{name: "client buffer truncates", edns: 1232, network: "udp", answers: 200, opt: true, tc: true, maxLen: 1232},
+		{name: "TCP is never truncated", network: "tcp", answers: 200, maxLen: dns.MaxMsgSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			if tt.edns > 0 {
+				req.SetEdns0(tt.edns, false)
+			}
+
+			// Upstream OPT with another buffer size must not leak through
+			resp := bigResponse(req, tt.answers)
+			resp.SetEdns0(4096, true)
+			finishResponse(req, resp, tt.network)
+
+			opt := resp.IsEdns0()
+			if (opt != nil) != tt.opt {
+				t.Fatalf("OPT present %v, want %v", opt != nil, tt.opt)
+			}
+			if opt != nil && opt.UDPSize() != ednsBufferSize {
+				t.Fatalf("advertised buffer %d, want %d", opt.UDPSize(), ednsBufferSize)
+			}
+			if optCount(resp) > 1 {
+				t.Fatalf("%d OPT records", optCount(resp))
+			}
+			if resp.Truncated != tt.tc {
+				t.Fatalf("TC %v, want %v", resp.Truncated, tt.tc)
+			}
+			if n := resp.Len(); n > tt.maxLen {
+				t.Fatalf("response is %d bytes, limit %d", n, tt.maxLen)
+			}
+		})
+	}
+}
+
+func TestFinishResponseEchoesClientSubnet(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	sent := subnetOption(netip.MustParsePrefix("198.51.100.0/24"))
+	req.IsEdns0().Option = append(req.IsEdns0().Option, sent)
+
+	resp := bigResponse(req, 1)
+	resp.SetEdns0(4096, false)
+	answered := subnetOption(netip.MustParsePrefix("198.51.100.0/24"))
+	answered.SourceScope = 20
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, answered)
+
+	finishResponse(req, resp, "udp")
+
+	subnet := clientSubnet(resp)
+	if subnet == nil {
+		t.Fatal("client subnet not echoed")
+	}
+	if subnet.SourceNetmask != 24 || subnet.SourceScope != 20 || !subnet.Address.Equal(net.ParseIP("198.51.100.0")) {
+		t.Fatalf("echoed %s/%d scope %d", subnet.Address, subnet.SourceNetmask, subnet.SourceScope)
+	}
+
+	// Clients that sent no subnet get none back
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	plain.SetEdns0(1232, false)
+	resp = bigResponse(plain, 1)
+	resp.SetEdns0(4096, false)
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, answered)
+
+	finishResponse(plain, resp, "udp")
+	if clientSubnet(resp) != nil {
+		t.Fatal("upstream subnet passed to a client that sent none")
+	}
+}
+
+func TestPadQuery(t *testing.T) {
+	for _, name := range []string{"a.", "example.com.", "a-much-longer-name.for-padding.example.org."} {
+		t.Run(name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeAAAA)
+			before := req.Len()
+
+			padded := padQuery(req)
+			packed, err := padded.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packed)%paddingBlockSize != 0 {
+				t.Fatalf("padded query is %d bytes, not a multiple of %d", len(packed), paddingBlockSize)
+			}
+			if req.Len() != before || req.IsEdns0() != nil {
+				t.Fatal("padQuery modified the original query")
+			}
+			if padded.IsEdns0().UDPSize() != ednsBufferSize {
+				t.Fatalf("buffer size %d", padded.IsEdns0().UDPSize())
+			}
+		})
+	}
+
+	// Padding is appended to an existing OPT record
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	padded := padQuery(req)
+	if optCount(padded) != 1 || !padded.IsEdns0().Do() {
+		t.Fatalf("OPT not reused: %v", padded.Extra)
+	}
+}
@@ -5,79 +5,179 @@ import (
 	"sync"
 )
 
+const (
+	ListBlocklist = "blocklist"
+	ListAllowlist = "allowlist"
+
+	// Rules with this suffix win over non-important rules regardless of
+	// specificity, e.g. "ads.example.com$important".
+	importantSuffix = "$important"
+)
+
+// Decision describes which rule matched a domain. The zero value means no
+// rule matched and the domain is allowed.
+type Decision struct {
+	Blocked   bool   `json:"blocked"`
+	Rule      string `json:"rule,omitempty"`
+	List      string `json:"list,omitempty"`
+	Important bool   `json:"important,omitempty"`
+
+	// number of labels of the matched rule, more is more specific
+	labels int
+}
+
+func (d Decision) Matched() bool {
+	return d.Rule != ""
+}
+
+// prefer picks the winning decision: important rules first, then the most
+// specific rule, then allow over block.
+func prefer(a, b Decision) Decision {
+	switch {
+	case !a.Matched():
+		return b
+	case !b.Matched():
+		return a
+	case a.Important != b.Important:
+		if a.Important {
+			return a
+		}
+		return b
+	case a.labels != b.labels:
+		if a.labels > b.labels {
+			return a
+		}
+		return b
+	case a.Blocked != b.Blocked:
+		if !a.Blocked {
+			return a
+		}
+		return b
+	default:
+		return a
+	}
+}
+
+type rule struct {
+	allow     bool
+	important bool
+	list      string
+}
+
 type Filter struct {
-	blocklist map[string]bool
-	allowlist map[string]bool
-	enabled   bool
-	mu        sync.RWMutex
+	rules   map[string][]rule
+	enabled bool
+	mu      sync.RWMutex
 }
 
 func NewFilter(blocklist, allowlist []string, enabled bool) *Filter {
 	f := &Filter{
-		blocklist: make(map[string]bool),
-		allowlist: make(map[string]bool),
-		enabled:   enabled,
+		rules:   make(map[string][]rule),
+		enabled: enabled,
+	}
+
+	f.AddList(ListBlocklist, false, blocklist)
+	f.AddList(ListAllowlist, true, allowlist)
+
+	return f
+}
+
+// AddList adds entries under the list name reported in decisions.
+func (f *Filter) AddList(list string, allow bool, entries []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, entry := range entries {
+		f.add(list, allow, entry)
 	}
+}
 
-	for _, domain := range blocklist {
-		f.blocklist[normalizeDomain(domain)] = true
+func (f *Filter) add(list string, allow bool, entry string) {
+	domain, important := strings.CutSuffix(entry, importantSuffix)
+	domain = normalizeDomain(domain)
+
+	for _, existing := range f.rules[domain] {
+		if existing.list == list && existing.allow == allow && existing.important == important {
+			return
+		}
 	}
+	f.rules[domain] = append(f.rules[domain], rule{allow: allow, important: important, list: list})
+}
 
-	for _, domain := range allowlist {
-		f.allowlist[normalizeDomain(domain)] = true
+func (f *Filter) remove(list string, allow bool, domain string) {
+	domain = normalizeDomain(strings.TrimSuffix(domain, importantSuffix))
+
+	kept := f.rules[domain][:0]
+	for _, existing := range f.rules[domain] {
+		if existing.list != list || existing.allow != allow {
+			kept = append(kept, existing)
+		}
 	}
 
-	return f
+	if len(kept) == 0 {
+		delete(f.rules, domain)
+		return
+	}
+	f.rules[domain] = kept
 }
 
-func (f *Filter) IsBlocked(domain string) bool {
+// IsBlocked walks the domain and its parents and returns the winning rule.
+func (f *Filter) IsBlocked(domain string) Decision {
 	if !f.enabled {
-		return false
+		return Decision{}
 	}
 
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
 	domain = normalizeDomain(domain)
+	parts := strings.Split(domain, ".")
 
-	// Check allowlist first
-	if f.allowlist[domain] {
-		return false
+	var decision Decision
+	for i := range parts {
+		name := strings.Join(parts[i:], ".")
+		for _, r := range f.rules[name] {
+			decision = prefer(decision, r.decision(name, len(parts)-i))
+		}
 	}
 
-	// Check blocklist
-	if f.blocklist[domain] {
-		return true
-	}
+	return decision
+}
 
-	// Check parent domains
-	parts := strings.Split(domain, ".")
-	for i := 1; i < len(parts); i++ {
-		parent := strings.Join(parts[i:], ".")
-		if f.blocklist[parent] {
-			return true
-		}
+func (r rule) decision(domain string, labels int) Decision {
+	text := domain
+	if r.important {
+		text += importantSuffix
+	}
+	if r.allow {
+		text = "@@" + text
 	}
 
-	return false
+	return Decision{
+		Blocked:   !r.allow,
+		Rule:      text,
+		List:      r.list,
+		Important: r.important,
+		labels:    labels,
+	}
 }
 
 func (f *Filter) AddToBlocklist(domain string) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.blocklist[normalizeDomain(domain)] = true
+	f.add(ListBlocklist, false, domain)
 }
 
 func (f *Filter) RemoveFromBlocklist(domain string) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	delete(f.blocklist, normalizeDomain(domain))
+	f.remove(ListBlocklist, false, domain)
 }
 
 func (f *Filter) AddToAllowlist(domain string) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.allowlist[normalizeDomain(domain)] = true
+	f.add(ListAllowlist, true, domain)
 }
 
 func normalizeDomain(domain string) string {
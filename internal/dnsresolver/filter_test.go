@@ -0,0 +1,104 @@
+package dnsresolver
+
+import "testing"
+
+func TestFilterPrecedence(t *testing.T) {
+	tests := []struct {
+		name      string
+		blocklist []string
+		allowlist []string
+		domain    string
+		blocked   bool
+		rule      string
+	}{
+		{
+			name:      "no rule",
+			blocklist: []string{"ads.example.com"},
+			domain:    "www.example.com",
+		},
+		{
+			name:      "block matches subdomains",
+			blocklist: []string{"example.com"},
+			domain:    "www.example.com",
+			blocked:   true,
+			rule:      "example.com",
+		},
+		{
+			name:      "specific allow overrides broader block",
+			blocklist: []string{"example.com"},
+			allowlist: []string{"cdn.example.com"},
+			domain:    "img.cdn.example.com",
+			rule:      "@@cdn.example.com",
+		},
+		{
+			name:      "specific block overrides broader allow",
+			blocklist: []string{"ads.example.com"},
+			allowlist: []string{"example.com"},
+			domain:    "ads.example.com",
+			blocked:   true,
+			rule:      "ads.example.com",
+		},
+		{
+			name:      "equal specificity prefers allow",
+			blocklist: []string{"example.com"},
+			allowlist: []string{"example.com"},
+			domain:    "www.example.com",
+			rule:      "@@example.com",
+		},
+		{
+			name:      "important block wins over more specific allow",
+			blocklist: []string{"example.com$important"},
+			allowlist: []string{"www.example.com"},
+			domain:    "www.example.com",
+			blocked:   true,
+			rule:      "example.com$important",
+		},
+		{
+			name:      "important allow wins over more specific block",
+			blocklist: []string{"ads.example.com"},
+			allowlist: []string{"example.com$important"},
+			domain:    "ads.example.com",
+			rule:      "@@example.com$important",
+		},
+		{
+			name:      "both important, most specific wins",
+			blocklist: []string{"ads.example.com$important"},
+			allowlist: []string{"example.com$important"},
+			domain:    "x.ads.example.com",
+			blocked:   true,
+			rule:      "ads.example.com$important",
+		},
+		{
+			name:      "both important and equally specific, allow wins",
+			blocklist: []string{"example.com$important"},
+			allowlist: []string{"example.com$important"},
+			domain:    "example.com",
+			rule:      "@@example.com$important",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewFilter(tt.blocklist, tt.allowlist, true).IsBlocked(tt.domain)
+			if d.Blocked != tt.blocked || d.Rule != tt.rule {
+				t.Fatalf("got blocked=%v rule %q, want blocked=%v rule %q", d.Blocked, d.Rule, tt.blocked, tt.rule)
+			}
+		})
+	}
+}
+
+func TestPreferAcrossSources(t *testing.T) {
+	// Schedules are merged with profile decisions by prefer, so order of
+	// the arguments must not matter
+	block := Decision{Blocked: true, Rule: "example.com", List: "schedule", labels: 2}
+	allow := Decision{Rule: "@@example.com", List: "allowlist", labels: 2}
+
+	for _, d := range []Decision{prefer(block, allow), prefer(allow, block)} {
+		if d.Blocked {
+			t.Fatalf("equal specificity picked %q, want the allow rule", d.Rule)
+		}
+	}
+	if d := prefer(Decision{}, block); d != block {
+		t.Fatalf("unmatched decision won over %q", block.Rule)
+	}
+}
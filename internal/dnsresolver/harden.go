@@ -0,0 +1,73 @@
+package dnsresolver
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// randomizeCase flips the case of letters at random (draft-vixie-dnsext-
+// dns0x20). Upstreams echo the question unchanged, so the pattern adds
+// entropy a spoofed reply has to guess on top of the ID.
+func randomizeCase(name string) string {
+	bits := make([]byte, len(name))
+	rand.Read(bits)
+
+	b := []byte(name)
+	for i, c := range b {
+		if bits[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// verifyReply checks that resp answers query. With exactCase the question
+// name must also carry the 0x20 pattern that was sent.
+func verifyReply(query, resp *dns.Msg, exactCase bool) error {
+	if resp == nil {
+		return fmt.Errorf("empty reply")
+	}
+	if !resp.Response || resp.Id != query.Id {
+		return fmt.Errorf("reply id %d does not match query id %d", resp.Id, query.Id)
+	}
+	if len(resp.Question) != 1 {
+		return fmt.Errorf("reply has %d questions", len(resp.Question))
+	}
+
+	sent, got := query.Question[0], resp.Question[0]
+	if got.Qtype != sent.Qtype || got.Qclass != sent.Qclass {
+		return fmt.Errorf("reply question %s does not match query", got.String())
+	}
+	if exactCase && got.Name != sent.Name {
+		return fmt.Errorf("reply name %s does not match 0x20 query %s", got.Name, sent.Name)
+	}
+	if !strings.EqualFold(got.Name, sent.Name) {
+		return fmt.Errorf("reply name %s does not match query %s", got.Name, sent.Name)
+	}
+	return nil
+}
+
+// restoreCase puts the client's spelling back on records owned by the
+// randomized name.
+func restoreCase(resp *dns.Msg, sent, original string) {
+	if sent == original {
+		return
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Name == sent {
+				h.Name = original
+			}
+		}
+	}
+	resp.Question[0].Name = original
+}
@@ -0,0 +1,138 @@
+package dnsresolver
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+)
+
+// mangleUpstream answers from fakeUpstream after passing the reply to mangle.
+type mangleUpstream struct {
+	*fakeUpstream
+	mangle func(resp *dns.Msg)
+}
+
+func (u *mangleUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp, err := u.fakeUpstream.Exchange(req)
+	if err == nil {
+		u.mangle(resp)
+	}
+	return resp, err
+}
+
+// swapCase flips the case of every letter of name.
+func swapCase(name string) string {
+	return strings.Map(func(c rune) rune {
+		if unicode.IsUpper(c) {
+			return unicode.ToLower(c)
+		}
+		return unicode.ToUpper(c)
+	}, name)
+}
+
+func TestRandomizeCase(t *testing.T) {
+	name := "www.example-domain.com."
+	changed := false
+	for i := 0; i < 32; i++ {
+		got := randomizeCase(name)
+		if strings.ToLower(got) != name {
+			t.Fatalf("randomizeCase(%q) = %q", name, got)
+		}
+		changed = changed || got != name
+	}
+	if !changed {
+		t.Fatal("case never randomized")
+	}
+}
+
+func TestVerifyReply(t *testing.T) {
+	query := question("wWw.ExAmple.com.", dns.TypeA, dns.ClassINET)
+	query.Id = 4242
+
+	tests := []struct {
+		name      string
+		mangle    func(resp *dns.Msg)
+		exactCase bool
+		err       string
+	}{
+		{name: "matching reply", exactCase: true},
+		{name: "id mismatch", mangle: func(resp *dns.Msg) { resp.Id++ }, err: "does not match query id"},
+		{name: "not a response", mangle: func(resp *dns.Msg) { resp.Response = false }, err: "does not match query id"},
+		{name: "case mismatch", mangle: func(resp *dns.Msg) { resp.Question[0].Name = "www.example.com." }, exactCase: true, err: "does not match 0x20 query"},
+		{name: "case ignored without randomize_case", mangle: func(resp *dns.Msg) { resp.Question[0].Name = "www.example.com." }},
+		{name: "other name", mangle: func(resp *dns.Msg) { resp.Question[0].Name = "www.example.net." }, err: "does not match query"},
+		{name: "qtype mismatch", mangle: func(resp *dns.Msg) { resp.Question[0].Qtype = dns.TypeAAAA }, err: "does not match query"},
+		{name: "qclass mismatch", mangle: func(resp *dns.Msg) { resp.Question[0].Qclass = dns.ClassCHAOS }, err: "does not match query"},
+		{name: "no question", mangle: func(resp *dns.Msg) { resp.Question = nil }, err: "0 questions"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			if tt.mangle != nil {
+				tt.mangle(resp)
+			}
+
+			err := verifyReply(query, resp, tt.exactCase)
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	if err := verifyReply(query, nil, false); err == nil {
+		t.Fatal("nil reply accepted")
+	}
+}
+
+func TestRestoreCase(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("wWw.ExAmple.com.", dns.TypeA)
+	resp.Answer = []dns.RR{
+		mustRR(t, "wWw.ExAmple.com. 60 IN CNAME cdn.example.net."),
+		mustRR(t, "cdn.example.net. 60 IN A 192.0.2.1"),
+	}
+	resp.Ns = []dns.RR{mustRR(t, "wWw.ExAmple.com. 60 IN NS ns1.example.com.")}
+
+	restoreCase(resp, "wWw.ExAmple.com.", "www.example.com.")
+
+	want := []string{"www.example.com.", "www.example.com.", "cdn.example.net.", "www.example.com."}
+	got := []string{resp.Question[0].Name, resp.Answer[0].Header().Name, resp.Answer[1].Header().Name, resp.Ns[0].Header().Name}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("names %v, want %v", got, want)
+	}
+}
+
+func TestForwardRejectsMismatch(t *testing.T) {
+	r := NewResolver(config.DNSConfig{CacheSize: 100, CacheTTL: 300, RandomizeCase: true})
+
+	// An off-path reply that guessed the ID but not the 0x20 pattern
+	spoofed := &mangleUpstream{newFakeUpstream(), func(resp *dns.Msg) {
+		name := swapCase(resp.Question[0].Name)
+		resp.Question[0].Name = name
+		resp.Answer = []dns.RR{mustRR(t, name+" 60 IN A 203.0.113.66")}
+	}}
+	good := &mangleUpstream{newFakeUpstream(), func(resp *dns.Msg) {
+		resp.Answer = []dns.RR{mustRR(t, resp.Question[0].Name+" 60 IN A 192.0.2.1")}
+	}}
+	r.profiles[DefaultProfile].upstreams = []Upstream{spoofed, good}
+
+	w := newRecorder()
+	r.ServeDNS(w, question("www.example.com.", dns.TypeA, dns.ClassINET))
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("answer %v", w.msg)
+	}
+	if a := w.msg.Answer[0].(*dns.A); a.A.String() != "192.0.2.1" || a.Hdr.Name != "www.example.com." {
+		t.Fatalf("answer %s, want 192.0.2.1 for www.example.com.", a)
+	}
+	if w.msg.Question[0].Name != "www.example.com." {
+		t.Fatalf("question %s not restored", w.msg.Question[0].Name)
+	}
+}
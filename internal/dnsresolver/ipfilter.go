@@ -0,0 +1,317 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/miekg/dns"
+)
+
+const (
+	IPBlockModeStrip = "strip"
+	IPBlockModeBlock = "block"
+)
+
+// IPFilter checks A/AAAA records and SVCB/HTTPS address hints of upstream
+// answers against blocked networks.
+type IPFilter struct {
+	prefixes           []netip.Prefix
+	mode               string
+	rebinding          bool
+	rebindingAllowlist map[string]bool
+	mu                 sync.RWMutex
+}
+
+func NewIPFilter(blocklist []string, mode string, rebinding bool, rebindingAllowlist []string) *IPFilter {
+	if mode == "" {
+		mode = IPBlockModeStrip
+	}
+
+	f := &IPFilter{
+		mode:               mode,
+		rebinding:          rebinding,
+		rebindingAllowlist: make(map[string]bool),
+	}
+
+	for _, entry := range blocklist {
+		if err := f.Add(entry); err != nil {
+			logger.Warnf("Skipping IP blocklist entry %q: %v", entry, err)
+		}
+	}
+
+	for _, domain := range rebindingAllowlist {
+		f.rebindingAllowlist[normalizeDomain(domain)] = true
+	}
+
+	return f
+}
+
+// Add accepts a CIDR or a single address.
+func (f *IPFilter) Add(entry string) error {
+	prefix, err := parsePrefix(entry)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prefixes = append(f.prefixes, prefix)
+	return nil
+}
+
+// Apply strips blocked records from msg and reports whether the whole
+// response must be blocked instead. Answers left without any address are
+// blocked too, an empty NOERROR would be cached as "no such record".
+// Additional records are only ever dropped.
+func (f *IPFilter) Apply(domain string, msg *dns.Msg) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if len(f.prefixes) == 0 && !f.rebinding {
+		return false
+	}
+
+	domain = normalizeDomain(domain)
+	checkRebinding := f.rebinding && isPublicName(domain) && !f.rebindingAllowed(domain)
+
+	answer, stripped, block := f.filterRecords(domain, msg.Answer, checkRebinding)
+	if block || (stripped && !hasAddress(answer)) {
+		return true
+	}
+	msg.Answer = answer
+
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if kept, _, block := f.filterRecords(domain, []dns.RR{rr}, checkRebinding); !block {
+			extra = append(extra, kept...)
+		}
+	}
+	msg.Extra = extra
+
+	return false
+}
+
+// Rebinding returns an error when the answer holds an internal address for
+// domain that the rebinding protection blocks.
+func (f *IPFilter) Rebinding(domain string, msg *dns.Msg) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	domain = normalizeDomain(domain)
+	if !f.rebinding || !isPublicName(domain) || f.rebindingAllowed(domain) {
+		return nil
+	}
+
+	for _, rr := range msg.Answer {
+		var addrs []netip.Addr
+		if svcb, ok := svcbData(rr); ok {
+			addrs = hintAddrs(svcb)
+		} else if addr, ok := rrAddr(rr); ok {
+			addrs = append(addrs, addr)
+		}
+		for _, addr := range addrs {
+			if isInternalAddr(addr) {
+				return fmt.Errorf("%s resolved to internal address %s", domain, addr)
+			}
+		}
+	}
+	return nil
+}
+
+// filterRecords drops blocked addresses from rrs in place and reports
+// whether any was dropped or the response must be blocked.
+func (f *IPFilter) filterRecords(domain string, rrs []dns.RR, checkRebinding bool) (kept []dns.RR, stripped, block bool) {
+	kept = rrs[:0]
+	for _, rr := range rrs {
+		if svcb, ok := svcbData(rr); ok {
+			if f.filterHints(domain, svcb, checkRebinding) {
+				return nil, false, true
+			}
+			kept = append(kept, rr)
+			continue
+		}
+
+		addr, ok := rrAddr(rr)
+		if !ok {
+			kept = append(kept, rr)
+			continue
+		}
+
+		keep, block := f.check(domain, addr, checkRebinding)
+		if block {
+			return nil, false, true
+		}
+		if keep {
+			kept = append(kept, rr)
+		} else {
+			stripped = true
+		}
+	}
+	return kept, stripped, false
+}
+
+// hasAddress reports whether rrs hold an address or SVCB record.
+func hasAddress(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if _, ok := rrAddr(rr); ok {
+			return true
+		}
+		if _, ok := svcbData(rr); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterHints applies the filter to the ipv4hint and ipv6hint keys of SVCB
+// and HTTPS records, which clients may connect to without an A/AAAA lookup.
+// Keys left without addresses are removed.
+func (f *IPFilter) filterHints(domain string, svcb *dns.SVCB, checkRebinding bool) bool {
+	kept := svcb.Value[:0]
+	for _, kv := range svcb.Value {
+		var hint *[]net.IP
+		switch v := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			hint = &v.Hint
+		case *dns.SVCBIPv6Hint:
+			hint = &v.Hint
+		default:
+			kept = append(kept, kv)
+			continue
+		}
+
+		ips := (*hint)[:0]
+		for _, ip := range *hint {
+			addr, ok := netip.AddrFromSlice(ip)
+			if !ok {
+				continue
+			}
+			keep, block := f.check(domain, addr.Unmap(), checkRebinding)
+			if block {
+				return true
+			}
+			if keep {
+				ips = append(ips, ip)
+			}
+		}
+		*hint = ips
+		if len(ips) > 0 {
+			kept = append(kept, kv)
+		}
+	}
+	svcb.Value = kept
+
+	return false
+}
+
+// hintAddrs returns the ipv4hint and ipv6hint addresses of svcb.
+func hintAddrs(svcb *dns.SVCB) []netip.Addr {
+	var addrs []netip.Addr
+	for _, kv := range svcb.Value {
+		var hint []net.IP
+		switch v := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			hint = v.Hint
+		case *dns.SVCBIPv6Hint:
+			hint = v.Hint
+		}
+		for _, ip := range hint {
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}
+	}
+	return addrs
+}
+
+// check decides on one resolved address: keep it, strip it, or block the
+// whole response.
+func (f *IPFilter) check(domain string, addr netip.Addr, checkRebinding bool) (keep, block bool) {
+	if checkRebinding && isInternalAddr(addr) {
+		logger.Warnf("Rebinding protection: %s resolved to %s", domain, addr)
+		return false, true
+	}
+
+	if f.contains(addr) {
+		if f.mode == IPBlockModeBlock {
+			return false, true
+		}
+		logger.Debugf("Stripped %s from answer for %s", addr, domain)
+		return false, false
+	}
+
+	return true, false
+}
+
+func (f *IPFilter) contains(addr netip.Addr) bool {
+	for _, prefix := range f.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *IPFilter) rebindingAllowed(domain string) bool {
+	parts := strings.Split(domain, ".")
+	for i := range parts {
+		if f.rebindingAllowlist[strings.Join(parts[i:], ".")] {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePrefix(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func rrAddr(rr dns.RR) (netip.Addr, bool) {
+	var ip net.IP
+	switch v := rr.(type) {
+	case *dns.A:
+		ip = v.A
+	case *dns.AAAA:
+		ip = v.AAAA
+	default:
+		return netip.Addr{}, false
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
+
+func isInternalAddr(addr netip.Addr) bool {
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified()
+}
+
+// isPublicName reports whether domain belongs to the global DNS namespace
+// rather than a local one, where private answers are expected.
+func isPublicName(domain string) bool {
+	if !strings.Contains(domain, ".") {
+		return false
+	}
+
+	for _, suffix := range []string{"local", "lan", "home", "internal", "home.arpa", "localhost"} {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package dnsresolver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+)
+
+// rrStrings is rrs in presentation format, one record per line.
+func rrStrings(rrs []dns.RR) string {
+	var out []string
+	for _, rr := range rrs {
+		out = append(out, rr.String())
+	}
+	return strings.Join(out, "\n")
+}
+
+func TestIPFilter(t *testing.T) {
+	blocklist := []string{"203.0.113.0/24", "2001:db8:bad::/48", "198.51.100.7"}
+
+	tests := []struct {
+		name      string
+		mode      string
+		rebinding bool
+		domain    string
+		answer    []string
+		extra     []string
+		wantBlock bool
+		want      []string // answer left, when not blocked
+		wantExtra []string
+	}{
+		{
+			name:   "strip mode strips",
+			mode:   IPBlockModeStrip,
+			domain: "example.com",
+			answer: []string{"example.com. 60 IN A 192.0.2.1", "example.com. 60 IN A 203.0.113.5", "example.com. 60 IN AAAA 2001:db8:bad::1"},
+			want:   []string{"example.com. 60 IN A 192.0.2.1"},
+		},
+		{
+			name:      "strip mode blocks an answer stripped empty",
+			mode:      IPBlockModeStrip,
+			domain:    "example.com",
+			answer:    []string{"example.com. 60 IN CNAME cdn.example.net.", "cdn.example.net. 60 IN A 198.51.100.7"},
+			wantBlock: true,
+		},
+		{
+			name:      "block mode blocks",
+			mode:      IPBlockModeBlock,
+			domain:    "example.com",
+			answer:    []string{"example.com. 60 IN A 192.0.2.1", "example.com. 60 IN A 203.0.113.5"},
+			wantBlock: true,
+		},
+		{
+			name:   "clean answer untouched",
+			mode:   IPBlockModeBlock,
+			domain: "example.com",
+			answer: []string{"example.com. 60 IN A 192.0.2.1"},
+			want:   []string{"example.com. 60 IN A 192.0.2.1"},
+		},
+		{
+			name:      "additional glue dropped",
+			mode:      IPBlockModeBlock,
+			domain:    "example.com",
+			answer:    []string{"example.com. 60 IN NS ns1.example.com."},
+			extra:     []string{"ns1.example.com. 60 IN A 203.0.113.5", "ns1.example.com. 60 IN A 192.0.2.53"},
+			want:      []string{"example.com. 60 IN NS ns1.example.com."},
+			wantExtra: []string{"ns1.example.com. 60 IN A 192.0.2.53"},
+		},
+		{
+			name:      "rebinding blocks public name",
+			rebinding: true,
+			domain:    "evil.example.com",
+			answer:    []string{"evil.example.com. 60 IN A 192.0.2.1", "evil.example.com. 60 IN A 192.168.1.1"},
+			wantBlock: true,
+		},
+		{
+			name:      "rebinding loopback",
+			rebinding: true,
+			domain:    "evil.example.com",
+			answer:    []string{"evil.example.com. 60 IN AAAA ::1"},
+			wantBlock: true,
+		},
+		{
+			name:      "rebinding drops internal glue",
+			rebinding: true,
+			domain:    "example.com",
+			answer:    []string{"example.com. 60 IN A 192.0.2.1"},
+			extra:     []string{"ns1.example.com. 60 IN A 10.0.0.53"},
+			want:      []string{"example.com. 60 IN A 192.0.2.1"},
+		},
+		{
+			name:      "rebinding allowlist",
+			rebinding: true,
+			domain:    "1-2-3-4.abc.plex.direct",
+			answer:    []string{"1-2-3-4.abc.plex.direct. 60 IN A 192.168.1.10"},
+			want:      []string{"1-2-3-4.abc.plex.direct. 60 IN A 192.168.1.10"},
+		},
+		{
+			name:      "rebinding local name",
+			rebinding: true,
+			domain:    "nas.lan",
+			answer:    []string{"nas.lan. 60 IN A 192.168.1.10"},
+			want:      []string{"nas.lan. 60 IN A 192.168.1.10"},
+		},
+		{
+			name:      "rebinding single label",
+			rebinding: true,
+			domain:    "nas",
+			answer:    []string{"nas. 60 IN A 192.168.1.10"},
+			want:      []string{"nas. 60 IN A 192.168.1.10"},
+		},
+		{
+			name:   "svcb hints stripped",
+			mode:   IPBlockModeStrip,
+			domain: "example.com",
+			answer: []string{`example.com. 60 IN HTTPS 1 . alpn="h2" ipv4hint="192.0.2.1,203.0.113.5" ipv6hint="2001:db8:bad::1"`},
+			want:   []string{`example.com. 60 IN HTTPS 1 . alpn="h2" ipv4hint="192.0.2.1"`},
+		},
+		{
+			name:      "svcb hints block",
+			mode:      IPBlockModeBlock,
+			domain:    "example.com",
+			answer:    []string{`example.com. 60 IN HTTPS 1 . ipv4hint="192.0.2.1,203.0.113.5"`},
+			wantBlock: true,
+		},
+		{
+			name:      "svcb hints rebinding",
+			rebinding: true,
+			domain:    "example.com",
+			answer:    []string{`example.com. 60 IN HTTPS 1 . ipv6hint="fe80::1"`},
+			wantBlock: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewIPFilter(blocklist, tt.mode, tt.rebinding, []string{"plex.direct"})
+
+			msg := new(dns.Msg)
+			for _, s := range tt.answer {
+				msg.Answer = append(msg.Answer, mustRR(t, s))
+			}
+			for _, s := range tt.extra {
+				msg.Extra = append(msg.Extra, mustRR(t, s))
+			}
+
+			if got := f.Apply(tt.domain, msg); got != tt.wantBlock {
+				t.Fatalf("block %v, want %v", got, tt.wantBlock)
+			}
+			if tt.wantBlock {
+				return
+			}
+
+			var want, wantExtra []dns.RR
+			for _, s := range tt.want {
+				want = append(want, mustRR(t, s))
+			}
+			for _, s := range tt.wantExtra {
+				wantExtra = append(wantExtra, mustRR(t, s))
+			}
+			if got := rrStrings(msg.Answer); got != rrStrings(want) {
+				t.Fatalf("answer:\n%s\nwant:\n%s", got, rrStrings(want))
+			}
+			if got := rrStrings(msg.Extra); got != rrStrings(wantExtra) {
+				t.Fatalf("additional:\n%s\nwant:\n%s", got, rrStrings(wantExtra))
+			}
+		})
+	}
+}
+
+func TestIPFilterStrippedNotCached(t *testing.T) {
+	r := NewResolver(config.DNSConfig{CacheSize: 100, CacheTTL: 300, IPBlocklist: []string{"203.0.113.0/24"}})
+	upstream := newFakeUpstream()
+	upstream.answer[dns.TypeA] = []dns.RR{mustRR(t, "example.com. 60 IN A 203.0.113.5")}
+	r.profiles[DefaultProfile].upstreams = []Upstream{upstream}
+
+	for i := 0; i < 2; i++ {
+		w := newRecorder()
+		r.ServeDNS(w, question("example.com.", dns.TypeA, dns.ClassINET))
+		if w.msg == nil || len(w.msg.Answer) != 0 && w.msg.Answer[0].(*dns.A).A.String() == "203.0.113.5" {
+			t.Fatalf("blocked address answered: %v", w.msg)
+		}
+	}
+	if got := upstream.count(dns.TypeA); got != 2 {
+		t.Fatalf("%d upstream queries, want 2: stripped answer was cached", got)
+	}
+}
@@ -0,0 +1,110 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+)
+
+// First file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// plainServers builds the UDP and TCP servers, either on the configured
+// addresses or on the sockets handed over by systemd.
+func plainServers(cfg config.DNSConfig, handler dns.Handler) ([]*dns.Server, error) {
+	var servers []*dns.Server
+
+	if cfg.SocketActivation {
+		conns, listeners, err := systemdSockets()
+		if err != nil {
+			return nil, err
+		}
+		if len(conns) == 0 && len(listeners) == 0 {
+			return nil, fmt.Errorf("socket activation enabled but no sockets were passed")
+		}
+
+		for _, pc := range conns {
+			servers = append(servers, &dns.Server{
+				Addr:          pc.LocalAddr().String(),
+				Net:           "udp",
+				PacketConn:    pc,
+				Handler:       handler,
+				UDPSize:       dns.MaxMsgSize,
+				MsgAcceptFunc: acceptMsg,
+			})
+		}
+		for _, l := range listeners {
+			servers = append(servers, &dns.Server{
+				Addr:          l.Addr().String(),
+				Net:           "tcp",
+				Listener:      l,
+				Handler:       handler,
+				MsgAcceptFunc: acceptMsg,
+			})
+		}
+		return servers, nil
+	}
+
+	// The UDP read buffer takes any query size, responses are sized per
+	// client in ServeDNS
+	for _, addr := range cfg.UDPAddrs() {
+		servers = append(servers, &dns.Server{
+			Addr:          addr,
+			Net:           "udp",
+			Handler:       handler,
+			UDPSize:       dns.MaxMsgSize,
+			MsgAcceptFunc: acceptMsg,
+		})
+	}
+	for _, addr := range cfg.TCPAddrs() {
+		servers = append(servers, &dns.Server{
+			Addr:          addr,
+			Net:           "tcp",
+			Handler:       handler,
+			MsgAcceptFunc: acceptMsg,
+		})
+	}
+	return servers, nil
+}
+
+// systemdSockets takes over the sockets of the LISTEN_FDS protocol,
+// datagram sockets serve UDP and stream sockets TCP.
+func systemdSockets() ([]net.PacketConn, []net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid LISTEN_FDS: %v", err)
+	}
+
+	// Not inherited by child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var conns []net.PacketConn
+	var listeners []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+
+		if pc, err := net.FilePacketConn(f); err == nil {
+			conns = append(conns, pc)
+		} else if l, err := net.FileListener(f); err == nil {
+			listeners = append(listeners, l)
+		} else {
+			f.Close()
+			return nil, nil, fmt.Errorf("unsupported socket fd %d: %v", fd, err)
+		}
+		// The net package holds its own duplicate
+		f.Close()
+	}
+
+	return conns, listeners, nil
+}
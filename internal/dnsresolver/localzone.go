@@ -0,0 +1,260 @@
+package dnsresolver
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const localTTL = 300
+
+// LocalZone is an in-memory authoritative store for names we own, loaded
+// from hosts and RFC 1035 zone files.
+type LocalZone struct {
+	records map[string]map[uint16][]dns.RR
+	soa     map[string]*dns.SOA
+	mu      sync.RWMutex
+}
+
+func NewLocalZone() *LocalZone {
+	return &LocalZone{
+		records: make(map[string]map[uint16][]dns.RR),
+		soa:     make(map[string]*dns.SOA),
+	}
+}
+
+// LoadHostsFile reads /etc/hosts style lines: address followed by names.
+func (z *LocalZone) LoadHostsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		z.AddHost(ip, fields[1:]...)
+	}
+
+	return scanner.Err()
+}
+
+func (z *LocalZone) LoadZoneFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zp := dns.NewZoneParser(f, "", path)
+	zp.SetDefaultTTL(localTTL)
+
+	var records []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	for _, rr := range records {
+		if soa, ok := rr.(*dns.SOA); ok {
+			z.soa[strings.ToLower(soa.Hdr.Name)] = soa
+		}
+		z.add(rr)
+	}
+	return nil
+}
+
+// AddHost registers address records for names and a PTR record pointing to
+// the first (canonical) name.
+func (z *LocalZone) AddHost(ip net.IP, names ...string) {
+	if len(names) == 0 {
+		return
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	for _, name := range names {
+		hdr := dns.RR_Header{Name: dns.Fqdn(name), Class: dns.ClassINET, Ttl: localTTL}
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			z.add(&dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			z.add(&dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return
+	}
+	z.add(&dns.PTR{
+		Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: localTTL},
+		Ptr: dns.Fqdn(names[0]),
+	})
+}
+
+// RemoveHost drops what AddHost registered for ip and names.
+func (z *LocalZone) RemoveHost(ip net.IP, names ...string) {
+	if len(names) == 0 {
+		return
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	for _, name := range names {
+		z.remove(dns.Fqdn(name), func(rr dns.RR) bool {
+			switch rr := rr.(type) {
+			case *dns.A:
+				return rr.A.Equal(ip)
+			case *dns.AAAA:
+				return rr.AAAA.Equal(ip)
+			}
+			return false
+		})
+	}
+
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return
+	}
+	z.remove(reverse, func(rr dns.RR) bool {
+		ptr, ok := rr.(*dns.PTR)
+		return ok && strings.EqualFold(ptr.Ptr, dns.Fqdn(names[0]))
+	})
+}
+
+func (z *LocalZone) remove(name string, match func(dns.RR) bool) {
+	name = strings.ToLower(name)
+	for rrtype, rrs := range z.records[name] {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			if !match(rr) {
+				kept = append(kept, rr)
+			}
+		}
+		if len(kept) == 0 {
+			delete(z.records[name], rrtype)
+		} else {
+			z.records[name][rrtype] = kept
+		}
+	}
+	if len(z.records[name]) == 0 {
+		delete(z.records, name)
+	}
+}
+
+func (z *LocalZone) add(rr dns.RR) {
+	name := strings.ToLower(rr.Header().Name)
+	rrtype := rr.Header().Rrtype
+
+	if z.records[name] == nil {
+		z.records[name] = make(map[uint16][]dns.RR)
+	}
+	for _, existing := range z.records[name][rrtype] {
+		if dns.IsDuplicate(existing, rr) {
+			return
+		}
+	}
+	z.records[name][rrtype] = append(z.records[name][rrtype], rr)
+}
+
+// Response answers req authoritatively, or returns nil when the name is not
+// ours.
+func (z *LocalZone) Response(req *dns.Msg) *dns.Msg {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	soa := z.zoneSOA(name)
+
+	types, exists := z.records[name]
+	if !exists && soa == nil {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+
+	switch {
+	case !exists && z.hasChildren(name):
+		// An empty non-terminal exists, it just holds no records
+	case !exists:
+		m.Rcode = dns.RcodeNameError
+	case len(types[q.Qtype]) > 0:
+		m.Answer = copyRRs(types[q.Qtype], q.Name)
+	case len(types[dns.TypeCNAME]) > 0:
+		m.Answer = copyRRs(types[dns.TypeCNAME], q.Name)
+		target := strings.ToLower(types[dns.TypeCNAME][0].(*dns.CNAME).Target)
+		m.Answer = append(m.Answer, copyRRs(z.records[target][q.Qtype], "")...)
+	}
+
+	if len(m.Answer) == 0 && soa != nil {
+		m.Ns = []dns.RR{dns.Copy(soa)}
+	}
+
+	return m
+}
+
+// hasChildren reports whether records exist below name.
+func (z *LocalZone) hasChildren(name string) bool {
+	for owner := range z.records {
+		if owner != name && dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneSOA returns the SOA of the closest loaded zone containing name.
+func (z *LocalZone) zoneSOA(name string) *dns.SOA {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if soa, ok := z.soa[name[off:]]; ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+func (z *LocalZone) Size() int {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return len(z.records)
+}
+
+// copyRRs copies records, keeping the owner name case of the question.
+func copyRRs(rrs []dns.RR, owner string) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		c := dns.Copy(rr)
+		if owner != "" {
+			c.Header().Name = owner
+		}
+		out = append(out, c)
+	}
+	return out
+}
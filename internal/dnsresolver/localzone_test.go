@@ -0,0 +1,143 @@
+package dnsresolver
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testHosts = `# static hosts
+127.0.0.1	localhost
+192.168.1.10	nas.lan nas   # storage
+192.168.1.20	printer.lan
+fd00::10	nas.lan
+not-an-ip	broken.lan
+192.168.1.30
+`
+
+const testZone = `$ORIGIN home.arpa.
+$TTL 600
+@		IN SOA	ns.home.arpa. admin.home.arpa. 1 3600 600 86400 60
+@		IN NS	ns.home.arpa.
+ns		IN A	192.168.1.1
+pc.office	IN A	192.168.1.40
+www		IN CNAME pc.office
+`
+
+func writeZoneFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLocalZone(t *testing.T) {
+	z := NewLocalZone()
+	if err := z.LoadHostsFile(writeZoneFile(t, "hosts", testHosts)); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.LoadZoneFile(writeZoneFile(t, "home.arpa.zone", testZone)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		notOurs bool // nil response, the query goes upstream
+		rcode   int
+		answer  []string
+		soa     bool
+	}{
+		{name: "hosts A", qname: "nas.lan.", qtype: dns.TypeA, answer: []string{"nas.lan. 300 IN A 192.168.1.10"}},
+		{name: "hosts AAAA", qname: "nas.lan.", qtype: dns.TypeAAAA, answer: []string{"nas.lan. 300 IN AAAA fd00::10"}},
+		{name: "hosts alias", qname: "nas.", qtype: dns.TypeA, answer: []string{"nas. 300 IN A 192.168.1.10"}},
+		{name: "question case kept", qname: "NAS.lan.", qtype: dns.TypeA, answer: []string{"NAS.lan. 300 IN A 192.168.1.10"}},
+		{name: "hosts without type", qname: "printer.lan.", qtype: dns.TypeAAAA},
+		{name: "PTR to first name", qname: "10.1.168.192.in-addr.arpa.", qtype: dns.TypePTR, answer: []string{"10.1.168.192.in-addr.arpa. 300 IN PTR nas.lan."}},
+		{name: "IPv6 PTR", qname: "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", qtype: dns.TypePTR,
+			answer: []string{"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. 300 IN PTR nas.lan."}},
+		{name: "unknown hosts name", qname: "broken.lan.", qtype: dns.TypeA, notOurs: true},
+		{name: "hosts parent not ours", qname: "lan.", qtype: dns.TypeA, notOurs: true},
+		{name: "zone A", qname: "pc.office.home.arpa.", qtype: dns.TypeA, answer: []string{"pc.office.home.arpa. 600 IN A 192.168.1.40"}},
+		{name: "zone CNAME chased", qname: "www.home.arpa.", qtype: dns.TypeA,
+			answer: []string{"www.home.arpa. 600 IN CNAME pc.office.home.arpa.", "pc.office.home.arpa. 600 IN A 192.168.1.40"}},
+		{name: "zone NODATA", qname: "pc.office.home.arpa.", qtype: dns.TypeMX, soa: true},
+		{name: "zone NXDOMAIN", qname: "tv.home.arpa.", qtype: dns.TypeA, rcode: dns.RcodeNameError, soa: true},
+		{name: "empty non-terminal", qname: "office.home.arpa.", qtype: dns.TypeA, soa: true},
+		{name: "below a name", qname: "x.pc.office.home.arpa.", qtype: dns.TypeA, rcode: dns.RcodeNameError, soa: true},
+		{name: "other zone", qname: "example.com.", qtype: dns.TypeA, notOurs: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := z.Response(question(tt.qname, tt.qtype, dns.ClassINET))
+			if (resp == nil) != tt.notOurs {
+				t.Fatalf("response %v, want local %v", resp, !tt.notOurs)
+			}
+			if resp == nil {
+				return
+			}
+
+			if resp.Rcode != tt.rcode || !resp.Authoritative {
+				t.Fatalf("rcode %s aa %v, want %s aa", dns.RcodeToString[resp.Rcode], resp.Authoritative, dns.RcodeToString[tt.rcode])
+			}
+			var want []dns.RR
+			for _, s := range tt.answer {
+				want = append(want, mustRR(t, s))
+			}
+			if got := rrStrings(resp.Answer); got != rrStrings(want) {
+				t.Fatalf("answer:\n%s\nwant:\n%s", got, rrStrings(want))
+			}
+			if gotSOA := len(resp.Ns) == 1 && resp.Ns[0].Header().Rrtype == dns.TypeSOA; gotSOA != tt.soa {
+				t.Fatalf("authority %v, want SOA %v", resp.Ns, tt.soa)
+			}
+		})
+	}
+}
+
+func TestLocalZoneAddRemoveHost(t *testing.T) {
+	z := NewLocalZone()
+	ip := net.ParseIP("192.168.1.50")
+	z.AddHost(ip, "tv.lan", "tv")
+	z.AddHost(ip, "tv.lan") // duplicates are ignored
+	z.AddHost(net.ParseIP("192.168.1.51"), "tv.lan")
+
+	answers := func(qname string, qtype uint16) int {
+		t.Helper()
+		resp := z.Response(question(qname, qtype, dns.ClassINET))
+		if resp == nil {
+			return -1
+		}
+		return len(resp.Answer)
+	}
+
+	if got := answers("tv.lan.", dns.TypeA); got != 2 {
+		t.Fatalf("%d A records, want 2", got)
+	}
+	if got := answers("50.1.168.192.in-addr.arpa.", dns.TypePTR); got != 1 {
+		t.Fatalf("%d PTR records, want 1", got)
+	}
+
+	z.RemoveHost(ip, "tv.lan", "tv")
+	if got := answers("tv.lan.", dns.TypeA); got != 1 {
+		t.Fatalf("%d A records after removal, want the other address", got)
+	}
+	if got := answers("tv.", dns.TypeA); got != -1 {
+		t.Fatalf("removed alias still answered")
+	}
+	if got := answers("50.1.168.192.in-addr.arpa.", dns.TypePTR); got != -1 {
+		t.Fatalf("PTR of the removed address still answered")
+	}
+	if got := answers("51.1.168.192.in-addr.arpa.", dns.TypePTR); got != 1 {
+		t.Fatalf("PTR of the remaining address removed")
+	}
+	if z.Size() != 2 {
+		t.Fatalf("size %d, want 2", z.Size())
+	}
+}
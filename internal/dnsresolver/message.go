@@ -0,0 +1,122 @@
+package dnsresolver
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ChaosRefuse = "refuse"
+	ChaosAnswer = "answer"
+
+	defaultChaosVersion = "privacy-hub"
+
+	// QR bit of the header flags
+	headerResponse = 1 << 15
+)
+
+// acceptMsg leaves everything but responses to ServeDNS, which answers
+// unsupported opcodes and malformed questions itself. Messages that do not
+// unpack are still answered with FORMERR by the server.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&headerResponse != 0 {
+		return dns.MsgIgnore
+	}
+	return dns.MsgAccept
+}
+
+// precheck answers requests that never reach the resolver pipeline:
+// unsupported opcodes, malformed questions, zone transfers and CHAOS
+// queries. It returns nil for regular queries.
+func (r *Resolver) precheck(req *dns.Msg) *dns.Msg {
+	switch {
+	case req.Response:
+		return errorResponse(req, dns.RcodeFormatError)
+	case req.Opcode != dns.OpcodeQuery:
+		// UPDATE, NOTIFY and the obsolete opcodes
+		return errorResponse(req, dns.RcodeNotImplemented)
+	case len(req.Question) != 1:
+		return errorResponse(req, dns.RcodeFormatError)
+	case optCount(req) > 1:
+		return errorResponse(req, dns.RcodeFormatError)
+	}
+
+	if opt := req.IsEdns0(); opt != nil && opt.Version() != 0 {
+		return errorResponse(req, dns.RcodeBadVers)
+	}
+
+	question := req.Question[0]
+	switch question.Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		return errorResponse(req, dns.RcodeRefused)
+	}
+
+	switch question.Qclass {
+	case dns.ClassINET:
+		return nil
+	case dns.ClassCHAOS:
+		return r.chaos(req)
+	default:
+		return errorResponse(req, dns.RcodeRefused)
+	}
+}
+
+// chaos answers the server identification queries when the policy allows.
+func (r *Resolver) chaos(req *dns.Msg) *dns.Msg {
+	question := req.Question[0]
+	if r.cfg.Chaos.Policy != ChaosAnswer || (question.Qtype != dns.TypeTXT && question.Qtype != dns.TypeANY) {
+		return errorResponse(req, dns.RcodeRefused)
+	}
+
+	var value string
+	switch strings.ToLower(question.Name) {
+	case "version.bind.", "version.server.":
+		value = r.cfg.Chaos.Version
+		if value == "" {
+			value = defaultChaosVersion
+		}
+	case "id.server.", "hostname.bind.":
+		value = r.cfg.Chaos.ID
+		if value == "" {
+			value, _ = os.Hostname()
+		}
+	default:
+		return errorResponse(req, dns.RcodeRefused)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{value},
+	}}
+	return m
+}
+
+// replyTo turns an upstream answer into the reply to req. Unlike SetReply
+// it keeps the upstream rcode.
+func replyTo(resp, req *dns.Msg) *dns.Msg {
+	rcode := resp.Rcode
+	resp.SetReply(req)
+	resp.Rcode = rcode
+	return resp
+}
+
+func errorResponse(req *dns.Msg, rcode int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	return m
+}
+
+func optCount(m *dns.Msg) int {
+	n := 0
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,218 @@
+package dnsresolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+)
+
+// recorder is a dns.ResponseWriter that keeps the written message.
+type recorder struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *recorder) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *recorder) RemoteAddr() net.Addr        { return w.remote }
+func (w *recorder) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *recorder) Write(b []byte) (int, error) { return len(b), nil }
+func (w *recorder) Close() error                { return nil }
+func (w *recorder) TsigStatus() error           { return nil }
+func (w *recorder) TsigTimersOnly(bool)         {}
+func (w *recorder) Hijack()                     {}
+
+func newRecorder() *recorder {
+	return &recorder{remote: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 40000}}
+}
+
+func question(name string, qtype, qclass uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Question[0].Qclass = qclass
+	return m
+}
+
+func TestServeDNSRejectsUnsupportedQueries(t *testing.T) {
+	withEDNS := func(m *dns.Msg) *dns.Msg {
+		m.SetEdns0(4096, true)
+		return m
+	}
+
+	tests := []struct {
+		name  string
+		chaos config.ChaosConfig
+		req   func() *dns.Msg
+		rcode int
+		edns  bool
+		txt   string
+	}{
+		{
+			name: "update",
+			req: func() *dns.Msg {
+				m := new(dns.Msg)
+				m.SetUpdate("example.com.")
+				return m
+			},
+			rcode: dns.RcodeNotImplemented,
+		},
+		{
+			name: "notify",
+			req: func() *dns.Msg {
+				m := new(dns.Msg)
+				m.SetNotify("example.com.")
+				return m
+			},
+			rcode: dns.RcodeNotImplemented,
+		},
+		{
+			name: "no question",
+			req: func() *dns.Msg {
+				m := new(dns.Msg)
+				m.Id = dns.Id()
+				return m
+			},
+			rcode: dns.RcodeFormatError,
+		},
+		{
+			name: "two questions",
+			req: func() *dns.Msg {
+				m := question("a.example.com.", dns.TypeA, dns.ClassINET)
+				m.Question = append(m.Question, dns.Question{Name: "b.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+				return m
+			},
+			rcode: dns.RcodeFormatError,
+		},
+		{
+			name: "two OPT records",
+			req: func() *dns.Msg {
+				m := withEDNS(question("example.com.", dns.TypeA, dns.ClassINET))
+				m.Extra = append(m.Extra, dns.Copy(m.IsEdns0()))
+				return m
+			},
+			rcode: dns.RcodeFormatError,
+			edns:  true,
+		},
+		{
+			name: "response as query",
+			req: func() *dns.Msg {
+				m := question("example.com.", dns.TypeA, dns.ClassINET)
+				m.Response = true
+				return m
+			},
+			rcode: dns.RcodeFormatError,
+		},
+		{
+			name:  "axfr",
+			req:   func() *dns.Msg { return question("example.com.", dns.TypeAXFR, dns.ClassINET) },
+			rcode: dns.RcodeRefused,
+		},
+		{
+			name:  "ixfr with edns",
+			req:   func() *dns.Msg { return withEDNS(question("example.com.", dns.TypeIXFR, dns.ClassINET)) },
+			rcode: dns.RcodeRefused,
+			edns:  true,
+		},
+		{
+			name: "unknown edns version",
+			req: func() *dns.Msg {
+				m := withEDNS(question("example.com.", dns.TypeA, dns.ClassINET))
+				m.IsEdns0().SetVersion(1)
+				return m
+			},
+			rcode: dns.RcodeBadVers,
+			edns:  true,
+		},
+		{
+			name:  "hesiod class",
+			req:   func() *dns.Msg { return question("example.com.", dns.TypeA, dns.ClassHESIOD) },
+			rcode: dns.RcodeRefused,
+		},
+		{
+			name:  "chaos refused by default",
+			req:   func() *dns.Msg { return question("version.bind.", dns.TypeTXT, dns.ClassCHAOS) },
+			rcode: dns.RcodeRefused,
+		},
+		{
+			name:  "chaos version",
+			chaos: config.ChaosConfig{Policy: ChaosAnswer, Version: "test-1.0"},
+			req:   func() *dns.Msg { return withEDNS(question("VERSION.BIND.", dns.TypeTXT, dns.ClassCHAOS)) },
+			rcode: dns.RcodeSuccess,
+			edns:  true,
+			txt:   "test-1.0",
+		},
+		{
+			name:  "chaos id",
+			chaos: config.ChaosConfig{Policy: ChaosAnswer, ID: "hub-1"},
+			req:   func() *dns.Msg { return question("id.server.", dns.TypeTXT, dns.ClassCHAOS) },
+			rcode: dns.RcodeSuccess,
+			txt:   "hub-1",
+		},
+		{
+			name:  "chaos unknown name",
+			chaos: config.ChaosConfig{Policy: ChaosAnswer},
+			req:   func() *dns.Msg { return question("authors.bind.", dns.TypeTXT, dns.ClassCHAOS) },
+			rcode: dns.RcodeRefused,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewResolver(config.DNSConfig{CacheSize: 10, Chaos: tt.chaos})
+			req := tt.req()
+			w := newRecorder()
+
+			r.ServeDNS(w, req)
+
+			if w.msg == nil {
+				t.Fatal("no response written")
+			}
+			if w.msg.Id != req.Id {
+				t.Errorf("id = %d, want %d", w.msg.Id, req.Id)
+			}
+			if w.msg.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[w.msg.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if got := w.msg.IsEdns0() != nil; got != tt.edns {
+				t.Errorf("response EDNS = %v, want %v", got, tt.edns)
+			}
+			if _, err := w.msg.Pack(); err != nil {
+				t.Errorf("response does not pack: %v", err)
+			}
+
+			if tt.txt != "" {
+				if len(w.msg.Answer) != 1 {
+					t.Fatalf("answers = %d, want 1", len(w.msg.Answer))
+				}
+				txt, ok := w.msg.Answer[0].(*dns.TXT)
+				if !ok || len(txt.Txt) != 1 || txt.Txt[0] != tt.txt {
+					t.Errorf("answer = %v, want TXT %q", w.msg.Answer[0], tt.txt)
+				}
+				if txt.Hdr.Class != dns.ClassCHAOS {
+					t.Errorf("class = %d, want CHAOS", txt.Hdr.Class)
+				}
+			}
+		})
+	}
+}
+
+func TestAcceptMsg(t *testing.T) {
+	tests := []struct {
+		name string
+		bits uint16
+		want dns.MsgAcceptAction
+	}{
+		{"query", 0, dns.MsgAccept},
+		{"update", uint16(dns.OpcodeUpdate) << 11, dns.MsgAccept},
+		{"response", headerResponse, dns.MsgIgnore},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := acceptMsg(dns.Header{Bits: tt.bits, Qdcount: 2}); got != tt.want {
+				t.Errorf("acceptMsg = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Oblivious DoH, RFC 9230
+const (
+	odohVersion         = 0x0001
+	odohMessageQuery    = 0x01
+	odohMessageResponse = 0x02
+
+	odohContentType = "application/oblivious-dns-message"
+	odohConfigPath  = "/.well-known/odohconfigs"
+	odohConfigTTL   = 1 * time.Hour
+	odohMaxBody     = 64 << 10
+)
+
+// errODoHKeyRejected means the target no longer accepts our key id and the
+// configuration has to be fetched again.
+var errODoHKeyRejected = errors.New("target rejected key id")
+
+// odohConfig is one ObliviousDoHConfigContents of a target.
+type odohConfig struct {
+	kem       hpke.KEM
+	kdf       hpke.KDF
+	aead      hpke.AEAD
+	publicKey kem.PublicKey
+	keyID     []byte
+}
+
+// parseODoHConfigs returns the first configuration of a supported version
+// and cipher suite.
+func parseODoHConfigs(data []byte) (*odohConfig, error) {
+	s := cryptobyte.String(data)
+	var configs cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&configs) || !s.Empty() {
+		return nil, fmt.Errorf("malformed odoh configs")
+	}
+
+	for !configs.Empty() {
+		var version uint16
+		var contents cryptobyte.String
+		if !configs.ReadUint16(&version) || !configs.ReadUint16LengthPrefixed(&contents) {
+			return nil, fmt.Errorf("malformed odoh config")
+		}
+		if version != odohVersion {
+			continue
+		}
+		if cfg, err := parseODoHConfigContents(contents); err == nil {
+			return cfg, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no supported odoh config")
+}
+
+func parseODoHConfigContents(contents []byte) (*odohConfig, error) {
+	s := cryptobyte.String(contents)
+	var kemID, kdfID, aeadID uint16
+	var publicKey cryptobyte.String
+	if !s.ReadUint16(&kemID) || !s.ReadUint16(&kdfID) || !s.ReadUint16(&aeadID) ||
+		!s.ReadUint16LengthPrefixed(&publicKey) || !s.Empty() {
+		return nil, fmt.Errorf("malformed odoh config contents")
+	}
+
+	cfg := &odohConfig{kem: hpke.KEM(kemID), kdf: hpke.KDF(kdfID), aead: hpke.AEAD(aeadID)}
+	if !cfg.kem.IsValid() || !cfg.kdf.IsValid() || !cfg.aead.IsValid() {
+		return nil, fmt.Errorf("unsupported suite %#x/%#x/%#x", kemID, kdfID, aeadID)
+	}
+
+	pk, err := cfg.kem.Scheme().UnmarshalBinaryPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	cfg.publicKey = pk
+
+	// key_id = Expand(Extract("", config), "odoh key id", Nh)
+	cfg.keyID = cfg.kdf.Expand(cfg.kdf.Extract(contents, nil), []byte("odoh key id"), uint(cfg.kdf.ExtractSize()))
+
+	return cfg, nil
+}
+
+// encodeODoHConfigs is the inverse of parseODoHConfigs for one config.
+func encodeODoHConfigs(kemID hpke.KEM, kdfID hpke.KDF, aeadID hpke.AEAD, publicKey []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(odohVersion)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(odohConfigContents(kemID, kdfID, aeadID, publicKey))
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func odohConfigContents(kemID hpke.KEM, kdfID hpke.KDF, aeadID hpke.AEAD, publicKey []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(kemID))
+	b.AddUint16(uint16(kdfID))
+	b.AddUint16(uint16(aeadID))
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(publicKey)
+	})
+	return b.BytesOrPanic()
+}
+
+// odohMessage is an ObliviousDoHMessage, keyID carries the response nonce
+// in responses.
+type odohMessage struct {
+	messageType uint8
+	keyID       []byte
+	encrypted   []byte
+}
+
+func (m odohMessage) marshal() []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(m.messageType)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(m.keyID) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(m.encrypted) })
+	return b.BytesOrPanic()
+}
+
+func parseODoHMessage(data []byte) (odohMessage, error) {
+	s := cryptobyte.String(data)
+	var m odohMessage
+	var keyID, encrypted cryptobyte.String
+	if !s.ReadUint8(&m.messageType) || !s.ReadUint16LengthPrefixed(&keyID) ||
+		!s.ReadUint16LengthPrefixed(&encrypted) || !s.Empty() {
+		return m, fmt.Errorf("malformed odoh message")
+	}
+	m.keyID, m.encrypted = keyID, encrypted
+	return m, nil
+}
+
+// odohPlaintext encodes an ObliviousDoHMessagePlaintext. Queries are padded
+// with EDNS padding already, so the padding field stays empty.
+func odohPlaintext(msg []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(msg) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {})
+	return b.BytesOrPanic()
+}
+
+func parseODoHPlaintext(data []byte) ([]byte, error) {
+	s := cryptobyte.String(data)
+	var msg, padding cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&msg) || !s.ReadUint16LengthPrefixed(&padding) || !s.Empty() {
+		return nil, fmt.Errorf("malformed odoh plaintext")
+	}
+	return msg, nil
+}
+
+func odohAAD(messageType uint8, keyID []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(messageType)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(keyID) })
+	return b.BytesOrPanic()
+}
+
+// odohResponseAEAD derives the response key and nonce from the exported
+// secret of the query context, shared by client and target.
+func odohResponseAEAD(kdf hpke.KDF, aead hpke.AEAD, ctx hpke.Context, queryPlain, responseNonce []byte) (cipher.AEAD, []byte, error) {
+	secret := ctx.Export([]byte("odoh response"), aead.KeySize())
+
+	var salt cryptobyte.Builder
+	salt.AddBytes(queryPlain)
+	salt.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(responseNonce) })
+
+	prk := kdf.Extract(secret, salt.BytesOrPanic())
+	key := kdf.Expand(prk, []byte("odoh key"), aead.KeySize())
+	nonce := kdf.Expand(prk, []byte("odoh nonce"), aead.NonceSize())
+
+	c, err := aead.New(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, nonce, nil
+}
+
+// odohUpstream sends HPKE encrypted queries to a target through a relay:
+// the relay learns our address but not the names, the target the names
+// but not our address.
+type odohUpstream struct {
+	target    *url.URL
+	relay     *url.URL
+	client    *http.Client
+	config    *odohConfig
+	fetchedAt time.Time
+	mu        sync.Mutex
+}
+
+// newODoHUpstream accepts URLs or sdns:// stamps for target and relay.
+func newODoHUpstream(target, relay string, client *http.Client) (*odohUpstream, error) {
+	target, err := stampURL(target, stampODoHTarget)
+	if err != nil {
+		return nil, fmt.Errorf("invalid odoh target: %v", err)
+	}
+	relay, err = stampURL(relay, stampODoHRelay)
+	if err != nil {
+		return nil, fmt.Errorf("invalid odoh relay: %v", err)
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil || targetURL.Host == "" {
+		return nil, fmt.Errorf("invalid odoh target %q", target)
+	}
+	relayURL, err := url.Parse(relay)
+	if err != nil || relayURL.Host == "" {
+		return nil, fmt.Errorf("invalid odoh relay %q", relay)
+	}
+
+	return &odohUpstream{target: targetURL, relay: relayURL, client: client}, nil
+}
+
+func (u *odohUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	cfg, err := u.targetConfig(false)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.exchange(cfg, req)
+	if errors.Is(err, errODoHKeyRejected) {
+		// The target rotated its key
+		if cfg, err = u.targetConfig(true); err != nil {
+			return nil, err
+		}
+		resp, err = u.exchange(cfg, req)
+	}
+	return resp, err
+}
+
+func (u *odohUpstream) Address() string {
+	return "odoh://" + u.target.Host + u.target.Path
+}
+
+// targetConfig returns the cached target configuration, fetching it when
+// missing, expired or refresh is set.
+func (u *odohUpstream) targetConfig(refresh bool) (*odohConfig, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !refresh && u.config != nil && time.Since(u.fetchedAt) < odohConfigTTL {
+		return u.config, nil
+	}
+
+	configURL := url.URL{Scheme: u.target.Scheme, Host: u.target.Host, Path: odohConfigPath}
+	resp, err := u.client.Get(configURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch odoh config: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch odoh config: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, odohMaxBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read odoh config: %v", err)
+	}
+
+	cfg, err := parseODoHConfigs(body)
+	if err != nil {
+		return nil, err
+	}
+
+	u.config = cfg
+	u.fetchedAt = time.Now()
+	return cfg, nil
+}
+
+func (u *odohUpstream) exchange(cfg *odohConfig, req *dns.Msg) (*dns.Msg, error) {
+	wire, err := padQuery(req).Pack()
+	if err != nil {
+		return nil, err
+	}
+	queryPlain := odohPlaintext(wire)
+
+	suite := hpke.NewSuite(cfg.kem, cfg.kdf, cfg.aead)
+	sender, err := suite.NewSender(cfg.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+	enc, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := sealer.Seal(queryPlain, odohAAD(odohMessageQuery, cfg.keyID))
+	if err != nil {
+		return nil, err
+	}
+
+	body := odohMessage{
+		messageType: odohMessageQuery,
+		keyID:       cfg.keyID,
+		encrypted:   append(enc, ct...),
+	}.marshal()
+
+	relayURL := *u.relay
+	params := relayURL.Query()
+	params.Set("targethost", u.target.Host)
+	params.Set("targetpath", u.target.Path)
+	relayURL.RawQuery = params.Encode()
+
+	httpReq, err := http.NewRequest(http.MethodPost, relayURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", odohContentType)
+	httpReq.Header.Set("Accept", odohContentType)
+
+	httpResp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	switch {
+	case httpResp.StatusCode == http.StatusUnauthorized:
+		return nil, errODoHKeyRejected
+	case httpResp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("odoh relay: %s", httpResp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, odohMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	msg, err := parseODoHMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if msg.messageType != odohMessageResponse {
+		return nil, fmt.Errorf("unexpected odoh message type %d", msg.messageType)
+	}
+
+	aead, nonce, err := odohResponseAEAD(cfg.kdf, cfg.aead, sealer, queryPlain, msg.keyID)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, msg.encrypted, odohAAD(odohMessageResponse, msg.keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt odoh response: %v", err)
+	}
+	respWire, err := parseODoHPlaintext(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(respWire); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,258 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+)
+
+var odohTestSuite = struct {
+	kem  hpke.KEM
+	kdf  hpke.KDF
+	aead hpke.AEAD
+}{hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM}
+
+// odohTarget is a stand-in ODoH target answering every A query with
+// 192.0.2.1.
+type odohTarget struct {
+	t          *testing.T
+	privateKey kem.PrivateKey
+	configs    []byte
+	keyID      []byte
+	fetches    int
+	mu         sync.Mutex
+}
+
+func newODoHTarget(t *testing.T) *odohTarget {
+	target := &odohTarget{t: t}
+	target.rotateKey()
+	return target
+}
+
+func (target *odohTarget) rotateKey() {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	pk, sk, err := odohTestSuite.kem.Scheme().GenerateKeyPair()
+	if err != nil {
+		target.t.Fatal(err)
+	}
+	publicKey, _ := pk.MarshalBinary()
+
+	target.privateKey = sk
+	target.configs = encodeODoHConfigs(odohTestSuite.kem, odohTestSuite.kdf, odohTestSuite.aead, publicKey)
+	cfg, err := parseODoHConfigs(target.configs)
+	if err != nil {
+		target.t.Fatal(err)
+	}
+	target.keyID = cfg.keyID
+}
+
+func (target *odohTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	if r.URL.Path == odohConfigPath {
+		target.fetches++
+		w.Write(target.configs)
+		return
+	}
+
+	if r.Header.Get("Content-Type") != odohContentType {
+		http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	msg, err := parseODoHMessage(body)
+	if err != nil || msg.messageType != odohMessageQuery {
+		http.Error(w, "bad message", http.StatusBadRequest)
+		return
+	}
+	if !bytes.Equal(msg.keyID, target.keyID) {
+		http.Error(w, "unknown key", http.StatusUnauthorized)
+		return
+	}
+
+	suite := hpke.NewSuite(odohTestSuite.kem, odohTestSuite.kdf, odohTestSuite.aead)
+	receiver, _ := suite.NewReceiver(target.privateKey, []byte("odoh query"))
+	encSize := odohTestSuite.kem.Scheme().CiphertextSize()
+	opener, err := receiver.Setup(msg.encrypted[:encSize])
+	if err != nil {
+		http.Error(w, "bad enc", http.StatusBadRequest)
+		return
+	}
+	queryPlain, err := opener.Open(msg.encrypted[encSize:], odohAAD(odohMessageQuery, msg.keyID))
+	if err != nil {
+		http.Error(w, "decrypt failed", http.StatusBadRequest)
+		return
+	}
+	wire, _ := parseODoHPlaintext(queryPlain)
+
+	req := new(dns.Msg)
+	if err := req.Unpack(wire); err != nil {
+		http.Error(w, "bad dns message", http.StatusBadRequest)
+		return
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	}}
+	respWire, _ := resp.Pack()
+
+	nonce := make([]byte, max(odohTestSuite.aead.KeySize(), odohTestSuite.aead.NonceSize()))
+	rand.Read(nonce)
+	aead, aeadNonce, err := odohResponseAEAD(odohTestSuite.kdf, odohTestSuite.aead, opener, queryPlain, nonce)
+	if err != nil {
+		target.t.Fatal(err)
+	}
+	ct := aead.Seal(nil, aeadNonce, odohPlaintext(respWire), odohAAD(odohMessageResponse, nonce))
+
+	w.Header().Set("Content-Type", odohContentType)
+	w.Write(odohMessage{messageType: odohMessageResponse, keyID: nonce, encrypted: ct}.marshal())
+}
+
+// odohRelay is a stand-in relay that forwards opaque bodies and records
+// what it saw.
+type odohRelay struct {
+	client *http.Client
+	scheme string
+	bodies [][]byte
+	mu     sync.Mutex
+}
+
+func (relay *odohRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	relay.mu.Lock()
+	relay.bodies = append(relay.bodies, body)
+	relay.mu.Unlock()
+
+	targetURL := relay.scheme + "://" + r.URL.Query().Get("targethost") + r.URL.Query().Get("targetpath")
+	req, _ := http.NewRequest(http.MethodPost, targetURL, bytes.NewReader(body))
+	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+
+	resp, err := relay.client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func newODoHTestUpstream(t *testing.T) (*odohUpstream, *odohTarget, *odohRelay) {
+	target := newODoHTarget(t)
+	targetServer := httptest.NewServer(target)
+	t.Cleanup(targetServer.Close)
+
+	relay := &odohRelay{client: targetServer.Client(), scheme: "http"}
+	relayServer := httptest.NewServer(relay)
+	t.Cleanup(relayServer.Close)
+
+	u, err := newODoHUpstream(targetServer.URL+"/dns-query", relayServer.URL+"/proxy", relayServer.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, target, relay
+}
+
+func odohQuery(name string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	return req
+}
+
+func TestODoHExchangeThroughRelay(t *testing.T) {
+	u, target, relay := newODoHTestUpstream(t)
+
+	for _, name := range []string{"secret.example.com.", "other.example.com."} {
+		resp, err := u.Exchange(odohQuery(name))
+		if err != nil {
+			t.Fatalf("exchange %s: %v", name, err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != name {
+			t.Fatalf("answer = %v, want A record for %s", resp.Answer, name)
+		}
+	}
+
+	if target.fetches != 1 {
+		t.Errorf("config fetched %d times, want 1", target.fetches)
+	}
+
+	if len(relay.bodies) != 2 {
+		t.Fatalf("relay saw %d requests, want 2", len(relay.bodies))
+	}
+	for _, body := range relay.bodies {
+		if bytes.Contains(body, []byte("secret")) || strings.Contains(string(body), "example") {
+			t.Error("relay saw the query name in clear text")
+		}
+	}
+}
+
+func TestODoHRefetchesConfigAfterKeyRotation(t *testing.T) {
+	u, target, _ := newODoHTestUpstream(t)
+
+	if _, err := u.Exchange(odohQuery("a.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	target.rotateKey()
+
+	resp, err := u.Exchange(odohQuery("b.example.com."))
+	if err != nil {
+		t.Fatalf("exchange after rotation: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Errorf("answers = %d, want 1", len(resp.Answer))
+	}
+	if target.fetches != 2 {
+		t.Errorf("config fetched %d times, want 2", target.fetches)
+	}
+}
+
+func TestParseODoHConfigsSkipsUnsupported(t *testing.T) {
+	pk, _, _ := odohTestSuite.kem.Scheme().GenerateKeyPair()
+	publicKey, _ := pk.MarshalBinary()
+
+	unsupported := encodeODoHConfigs(hpke.KEM(0xffff), odohTestSuite.kdf, odohTestSuite.aead, publicKey)
+	if _, err := parseODoHConfigs(unsupported); err == nil {
+		t.Error("expected an error for an unsupported KEM")
+	}
+
+	if _, err := parseODoHConfigs([]byte{0x00}); err == nil {
+		t.Error("expected an error for truncated configs")
+	}
+
+	supported := encodeODoHConfigs(odohTestSuite.kem, odohTestSuite.kdf, odohTestSuite.aead, publicKey)
+	cfg, err := parseODoHConfigs(supported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.keyID) != odohTestSuite.kdf.ExtractSize() {
+		t.Errorf("key id length = %d, want %d", len(cfg.keyID), odohTestSuite.kdf.ExtractSize())
+	}
+
+	// An unsupported config ahead of a supported one is skipped.
+	list := append(append([]byte{}, unsupported[2:]...), supported[2:]...)
+	mixed := append([]byte{byte(len(list) >> 8), byte(len(list))}, list...)
+	cfg, err = parseODoHConfigs(mixed)
+	if err != nil {
+		t.Fatalf("mixed configs: %v", err)
+	}
+	if cfg.kem != odohTestSuite.kem {
+		t.Errorf("kem = %v, want %v", cfg.kem, odohTestSuite.kem)
+	}
+}
@@ -0,0 +1,347 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/identity"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/querylog"
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultProfile = "default"
+
+	BlockModeNXDomain = "nxdomain"
+	BlockModeNullIP   = "null_ip"
+	BlockModeRefused  = "refused"
+
+	// EDNS0 option used by dnsmasq --add-cpe-id to tag queries with a client id
+	EDNS0ClientIDCode = 65074
+)
+
+// Profile is a filtering policy applied to a group of clients.
+type Profile struct {
+	Name       string
+	filter     *Filter
+	blockMode  string
+	safeSearch bool
+	svcbPolicy string
+	upstreams  []Upstream
+	logPolicy  *querylog.Policy
+	cfg        config.ProfileConfig
+}
+
+func newProfile(base config.DNSConfig, cfg config.ProfileConfig) *Profile {
+	enabled := base.EnableFiltering
+	if cfg.EnableFiltering != nil {
+		enabled = *cfg.EnableFiltering
+	}
+
+	safeSearch := base.SafeSearch
+	if cfg.SafeSearch != nil {
+		safeSearch = *cfg.SafeSearch
+	}
+
+	blockMode := cfg.BlockMode
+	if blockMode == "" {
+		blockMode = base.BlockMode
+	}
+	if blockMode == "" {
+		blockMode = BlockModeNXDomain
+	}
+
+	svcbPolicy := cfg.SVCBPolicy
+	if svcbPolicy == "" {
+		svcbPolicy = base.SVCBPolicy
+	}
+	if svcbPolicy == "" {
+		svcbPolicy = SVCBPolicyKeep
+	}
+
+	upstreams, dohUpstreams, dnscryptUpstreams, odohUpstreams := base.Upstreams, base.DoHUpstreams, base.DNSCryptUpstreams, base.ODoHUpstreams
+	if len(cfg.Upstreams) > 0 || len(cfg.DoHUpstreams) > 0 || len(cfg.DNSCryptUpstreams) > 0 {
+		upstreams, dohUpstreams, dnscryptUpstreams, odohUpstreams = cfg.Upstreams, cfg.DoHUpstreams, cfg.DNSCryptUpstreams, nil
+	}
+
+	filter := NewFilter(base.Blocklist, base.Allowlist, enabled)
+	filter.AddList(cfg.Name+"/"+ListBlocklist, false, cfg.Blocklist)
+	filter.AddList(cfg.Name+"/"+ListAllowlist, true, cfg.Allowlist)
+
+	// Profiles without their own policy use the query log default
+	var logPolicy *querylog.Policy
+	if cfg.QueryLog != nil {
+		logPolicy = querylog.NewPolicy(*cfg.QueryLog)
+	}
+
+	return &Profile{
+		Name:       cfg.Name,
+		filter:     filter,
+		blockMode:  blockMode,
+		safeSearch: safeSearch,
+		svcbPolicy: svcbPolicy,
+		upstreams:  newUpstreams(upstreams, dohUpstreams, dnscryptUpstreams, odohUpstreams, base.Timeout, base.ECS),
+		logPolicy:  logPolicy,
+		cfg:        cfg,
+	}
+}
+
+// hasOwnUpstreams reports whether answers for this profile may differ from
+// the default ones and so must not share cache entries.
+func (p *Profile) hasOwnUpstreams() bool {
+	return len(p.cfg.Upstreams) > 0 || len(p.cfg.DoHUpstreams) > 0 || len(p.cfg.DNSCryptUpstreams) > 0
+}
+
+type clientRule struct {
+	prefix netip.Prefix
+	client config.ClientConfig
+}
+
+// ClientMatcher resolves a query's source to a configured client.
+type ClientMatcher struct {
+	byID     map[string]config.ClientConfig
+	prefixes []clientRule
+}
+
+func NewClientMatcher(clients []config.ClientConfig) (*ClientMatcher, error) {
+	m := &ClientMatcher{byID: make(map[string]config.ClientConfig)}
+
+	for _, c := range clients {
+		for _, id := range c.IDs {
+			if prefix, err := parsePrefix(id); err == nil {
+				m.prefixes = append(m.prefixes, clientRule{prefix: prefix, client: c})
+				continue
+			}
+			if hw, err := net.ParseMAC(id); err == nil {
+				id = hw.String()
+			}
+			if _, exists := m.byID[id]; exists {
+				return nil, fmt.Errorf("duplicate client id %q", id)
+			}
+			m.byID[id] = c
+		}
+	}
+
+	// Most specific network first
+	sort.SliceStable(m.prefixes, func(i, j int) bool {
+		return m.prefixes[i].prefix.Bits() > m.prefixes[j].prefix.Bits()
+	})
+
+	return m, nil
+}
+
+// Match looks the client up by EDNS client-id, MAC and host name before
+// trying the configured networks.
+func (m *ClientMatcher) Match(addr net.Addr, req *dns.Msg, who identity.Client) (config.ClientConfig, bool) {
+	for _, id := range []string{clientID(req), who.MAC, who.Name} {
+		if id == "" {
+			continue
+		}
+		if c, ok := m.byID[id]; ok {
+			return c, true
+		}
+	}
+
+	ip, ok := addrIP(addr)
+	if !ok {
+		return config.ClientConfig{}, false
+	}
+
+	for _, rule := range m.prefixes {
+		if rule.prefix.Contains(ip) {
+			return rule.client, true
+		}
+	}
+
+	return config.ClientConfig{}, false
+}
+
+func clientID(req *dns.Msg) string {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == EDNS0ClientIDCode {
+			return string(local.Data)
+		}
+	}
+	return ""
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		if addr == nil {
+			return netip.Addr{}, false
+		}
+		ap, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		return ap.Addr().Unmap(), true
+	}
+
+	ipAddr, ok := netip.AddrFromSlice(ip)
+	return ipAddr.Unmap(), ok
+}
+
+func blockedResponse(req *dns.Msg, mode string) *dns.Msg {
+	m := new(dns.Msg)
+
+	switch mode {
+	case BlockModeRefused:
+		m.SetRcode(req, dns.RcodeRefused)
+	case BlockModeNullIP:
+		m.SetReply(req)
+		q := req.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: uint32(time.Hour.Seconds())}
+		switch q.Qtype {
+		case dns.TypeA:
+			hdr.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	default:
+		m.SetRcode(req, dns.RcodeNameError)
+	}
+
+	return m
+}
+
+func (r *Resolver) Profiles() []config.ProfileConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]config.ProfileConfig, 0, len(r.profiles))
+	for _, p := range r.profiles {
+		out = append(out, p.cfg)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (r *Resolver) Profile(name string) (config.ProfileConfig, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	p, ok := r.profiles[name]
+	if !ok {
+		return config.ProfileConfig{}, false
+	}
+	return p.cfg, true
+}
+
+// SetProfile creates or replaces a profile.
+func (r *Resolver) SetProfile(cfg config.ProfileConfig) error {
+	if cfg.Name == "" {
+		return fmt.Errorf("profile name is required")
+	}
+	if err := config.ValidateBlockMode(cfg.BlockMode); err != nil {
+		return err
+	}
+	if err := config.ValidateSVCBPolicy(cfg.SVCBPolicy); err != nil {
+		return err
+	}
+
+	profile := newProfile(r.cfg, cfg)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.profiles[cfg.Name] = profile
+	r.cache.Clear()
+	return nil
+}
+
+func (r *Resolver) DeleteProfile(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if name == DefaultProfile {
+		return fmt.Errorf("default profile can not be deleted")
+	}
+	if _, ok := r.profiles[name]; !ok {
+		return fmt.Errorf("profile %q not found", name)
+	}
+	for _, c := range r.cfg.Clients {
+		if c.Profile == name {
+			return fmt.Errorf("profile %q is used by client %q", name, c.Name)
+		}
+	}
+
+	delete(r.profiles, name)
+	return nil
+}
+
+func (r *Resolver) Clients() []config.ClientConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]config.ClientConfig(nil), r.cfg.Clients...)
+}
+
+// SetClient creates or replaces a client definition by name.
+func (r *Resolver) SetClient(c config.ClientConfig) error {
+	if c.Name == "" {
+		return fmt.Errorf("client name is required")
+	}
+	if len(c.IDs) == 0 {
+		return fmt.Errorf("at least one client id is required")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.profiles[c.Profile]; !ok {
+		return fmt.Errorf("profile %q not found", c.Profile)
+	}
+
+	clients := make([]config.ClientConfig, 0, len(r.cfg.Clients)+1)
+	for _, existing := range r.cfg.Clients {
+		if existing.Name != c.Name {
+			clients = append(clients, existing)
+		}
+	}
+	clients = append(clients, c)
+
+	return r.setClients(clients)
+}
+
+func (r *Resolver) DeleteClient(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients := make([]config.ClientConfig, 0, len(r.cfg.Clients))
+	for _, existing := range r.cfg.Clients {
+		if existing.Name != name {
+			clients = append(clients, existing)
+		}
+	}
+	if len(clients) == len(r.cfg.Clients) {
+		return fmt.Errorf("client %q not found", name)
+	}
+
+	return r.setClients(clients)
+}
+
+func (r *Resolver) setClients(clients []config.ClientConfig) error {
+	matcher, err := NewClientMatcher(clients)
+	if err != nil {
+		return err
+	}
+
+	r.clients = matcher
+	r.cfg.Clients = clients
+	return nil
+}
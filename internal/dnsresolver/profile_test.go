@@ -0,0 +1,89 @@
+package dnsresolver
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/identity"
+	"github.com/miekg/dns"
+)
+
+func TestClientMatcher(t *testing.T) {
+	m, err := NewClientMatcher([]config.ClientConfig{
+		{Name: "lan", IDs: []string{"192.168.1.0/24"}, Profile: "default"},
+		{Name: "tablets", IDs: []string{"192.168.1.32/28", "2001:db8::/64"}, Profile: "kids"},
+		{Name: "tv", IDs: []string{"192.168.1.40"}, Profile: "kids"},
+		{Name: "laptop", IDs: []string{"3C-22-FB-12-34-56", "laptop-anna"}, Profile: "work"},
+		{Name: "router-tagged", IDs: []string{"cpe-7"}, Profile: "work"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withClientID := func(id string) *dns.Msg {
+		req := question("example.com.", dns.TypeA, dns.ClassINET)
+		req.SetEdns0(ednsBufferSize, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EDNS0ClientIDCode, Data: []byte(id)})
+		return req
+	}
+
+	tests := []struct {
+		name string
+		ip   string
+		req  *dns.Msg
+		who  identity.Client
+		want string // client name, empty for no match
+	}{
+		{name: "network", ip: "192.168.1.100", want: "lan"},
+		{name: "longest prefix wins", ip: "192.168.1.33", want: "tablets"},
+		{name: "single address wins", ip: "192.168.1.40", want: "tv"},
+		{name: "IPv6 network", ip: "2001:db8::1", want: "tablets"},
+		{name: "IPv4-mapped address", ip: "::ffff:192.168.1.33", want: "tablets"},
+		{name: "no match", ip: "10.0.0.1"},
+		{name: "MAC normalised", ip: "10.0.0.1", who: identity.Client{MAC: "3c:22:fb:12:34:56"}, want: "laptop"},
+		{name: "host name", ip: "10.0.0.1", who: identity.Client{Name: "laptop-anna"}, want: "laptop"},
+		{name: "MAC before network", ip: "192.168.1.33", who: identity.Client{MAC: "3c:22:fb:12:34:56"}, want: "laptop"},
+		{name: "client id before MAC", ip: "192.168.1.33", req: withClientID("cpe-7"), who: identity.Client{MAC: "aa:bb:cc:dd:ee:ff"}, want: "router-tagged"},
+		{name: "client id before name", ip: "10.0.0.1", req: withClientID("cpe-7"), who: identity.Client{Name: "laptop-anna"}, want: "router-tagged"},
+		{name: "unknown client id falls through", ip: "192.168.1.33", req: withClientID("cpe-9"), want: "tablets"},
+		{name: "unknown MAC falls through", ip: "192.168.1.100", who: identity.Client{MAC: "aa:bb:cc:dd:ee:ff"}, want: "lan"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			if req == nil {
+				req = question("example.com.", dns.TypeA, dns.ClassINET)
+			}
+			addr := &net.UDPAddr{IP: net.ParseIP(tt.ip), Port: 40000}
+			c, ok := m.Match(addr, req, tt.who)
+			if ok != (tt.want != "") || c.Name != tt.want {
+				t.Fatalf("matched %q (%v), want %q", c.Name, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientMatcherDuplicates(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  [2]string
+	}{
+		{name: "same name", ids: [2]string{"laptop", "laptop"}},
+		{name: "same MAC written differently", ids: [2]string{"3c:22:fb:12:34:56", "3C-22-FB-12-34-56"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewClientMatcher([]config.ClientConfig{
+				{Name: "a", IDs: []string{tt.ids[0]}},
+				{Name: "b", IDs: []string{tt.ids[1]}},
+			})
+			if err == nil || !strings.Contains(err.Error(), "duplicate client id") {
+				t.Fatalf("error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package dnsresolver
+
+import (
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultRRLIPv4Prefix = 24
+	defaultRRLIPv6Prefix = 56
+
+	// IPv6 clients are limited per /64, a single host usually owns one
+	clientIPv6Prefix = 64
+
+	// Idle limiter state is dropped after this long
+	limiterIdle = 1 * time.Minute
+	// Floods from many sources are swept early once a table is this big
+	maxLimiterEntries = 100000
+
+	// RFC 8482 recommends a long TTL for the synthesized HINFO
+	anyTTL = 3600
+)
+
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+type limiterState struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+	limited  uint64
+}
+
+// ClientLimit is the limiter state of one client in API responses.
+type ClientLimit struct {
+	Client   string    `json:"client"`
+	Tokens   float64   `json:"tokens"`
+	Limited  uint64    `json:"limited"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// RRLEntry is a limited response stream in API responses.
+type RRLEntry struct {
+	Network  string    `json:"network"`
+	Response string    `json:"response"`
+	Limited  uint64    `json:"limited"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type RateLimitStatus struct {
+	QPS            float64       `json:"qps"`
+	Burst          int           `json:"burst"`
+	RRLRate        float64       `json:"rrl_responses_per_second"`
+	RRLSlip        int           `json:"rrl_slip"`
+	AllowedClients []string      `json:"allowed_clients"`
+	Clients        []ClientLimit `json:"clients"`
+	RRL            []RRLEntry    `json:"rrl"`
+}
+
+// RateLimiter protects the listeners from floods and reflection: an access
+// list of client subnets, a token bucket per client and response rate
+// limiting of identical UDP answers per client network.
+type RateLimiter struct {
+	cfg     config.RateLimitConfig
+	allowed []netip.Prefix
+	clients map[netip.Addr]*limiterState
+	rrl     map[string]*limiterState
+	// last sweeps of full tables
+	clientsSwept time.Time
+	rrlSwept     time.Time
+	mu           sync.Mutex
+}
+
+func NewRateLimiter(cfg config.RateLimitConfig, allowed []string) *RateLimiter {
+	if cfg.Burst <= 0 {
+		cfg.Burst = max(1, int(cfg.QPS))
+	}
+	if cfg.IPv4Prefix <= 0 || cfg.IPv4Prefix > 32 {
+		cfg.IPv4Prefix = defaultRRLIPv4Prefix
+	}
+	if cfg.IPv6Prefix <= 0 || cfg.IPv6Prefix > 128 {
+		cfg.IPv6Prefix = defaultRRLIPv6Prefix
+	}
+
+	l := &RateLimiter{
+		cfg:     cfg,
+		clients: make(map[netip.Addr]*limiterState),
+		rrl:     make(map[string]*limiterState),
+	}
+
+	for _, entry := range allowed {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			logger.Errorf("Invalid allowed client %q: %v", entry, err)
+			continue
+		}
+		l.allowed = append(l.allowed, prefix)
+	}
+
+	go l.cleanup()
+
+	return l
+}
+
+// Allowed reports whether the access list admits the client.
+func (l *RateLimiter) Allowed(client netip.Addr) bool {
+	if len(l.allowed) == 0 {
+		return true
+	}
+	for _, prefix := range l.allowed {
+		if prefix.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow takes a token from the bucket of the client.
+func (l *RateLimiter) Allow(client netip.Addr, now time.Time) bool {
+	if l.cfg.QPS <= 0 {
+		return true
+	}
+
+	key := client
+	if client.Is6() {
+		prefix, _ := client.Prefix(clientIPv6Prefix)
+		key = prefix.Addr()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st, ok := l.clients[key]
+	if !ok {
+		if !room(l.clients, &l.clientsSwept, now) {
+			return true
+		}
+		st = &limiterState{limiter: rate.NewLimiter(rate.Limit(l.cfg.QPS), l.cfg.Burst)}
+		l.clients[key] = st
+	}
+	st.lastSeen = now
+
+	if st.limiter.AllowN(now, 1) {
+		return true
+	}
+	st.limited++
+	return false
+}
+
+// respond decides whether a UDP response is sent, dropped or replaced by a
+// truncated one that makes genuine clients retry over TCP. Clients of the
+// access list are trusted and never limited.
+func (l *RateLimiter) respond(client netip.Addr, resp *dns.Msg, now time.Time) rrlAction {
+	if l.cfg.RRLRate <= 0 || (len(l.allowed) > 0 && l.Allowed(client)) {
+		return rrlSend
+	}
+
+	bits := l.cfg.IPv4Prefix
+	if client.Is6() {
+		bits = l.cfg.IPv6Prefix
+	}
+	network, _ := client.Prefix(bits)
+	key := network.String() + " " + responseKey(resp)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st, ok := l.rrl[key]
+	if !ok {
+		if !room(l.rrl, &l.rrlSwept, now) {
+			return rrlSend
+		}
+		st = &limiterState{limiter: rate.NewLimiter(rate.Limit(l.cfg.RRLRate), max(1, int(l.cfg.RRLRate)))}
+		l.rrl[key] = st
+	}
+	st.lastSeen = now
+
+	if st.limiter.AllowN(now, 1) {
+		return rrlSend
+	}
+	st.limited++
+	if l.cfg.RRLSlip > 0 && st.limited%uint64(l.cfg.RRLSlip) == 0 {
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+// responseKey identifies identical responses. NXDOMAIN is keyed by the zone
+// from the SOA, so random subdomain floods of one zone share a bucket while
+// other zones are not affected. Other errors are grouped by rcode only.
+func responseKey(resp *dns.Msg) string {
+	rcode := dns.RcodeToString[resp.Rcode]
+	if len(resp.Question) == 0 {
+		return rcode
+	}
+	q := resp.Question[0]
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		return normalizeDomain(q.Name) + "/" + dns.TypeToString[q.Qtype] + "/" + rcode + "/" + strconv.Itoa(len(resp.Answer))
+	case dns.RcodeNameError:
+		zone := q.Name
+		for _, rr := range resp.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				zone = rr.Header().Name
+				break
+			}
+		}
+		return normalizeDomain(zone) + "/" + rcode
+	}
+	return rcode
+}
+
+func (l *RateLimiter) Status() RateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := RateLimitStatus{
+		QPS:            l.cfg.QPS,
+		Burst:          l.cfg.Burst,
+		RRLRate:        l.cfg.RRLRate,
+		RRLSlip:        l.cfg.RRLSlip,
+		AllowedClients: []string{},
+		Clients:        []ClientLimit{},
+		RRL:            []RRLEntry{},
+	}
+	for _, prefix := range l.allowed {
+		s.AllowedClients = append(s.AllowedClients, prefix.String())
+	}
+
+	now := time.Now()
+	for client, st := range l.clients {
+		s.Clients = append(s.Clients, ClientLimit{
+			Client:   client.String(),
+			Tokens:   st.limiter.TokensAt(now),
+			Limited:  st.limited,
+			LastSeen: st.lastSeen,
+		})
+	}
+	sort.Slice(s.Clients, func(i, j int) bool {
+		if s.Clients[i].Limited != s.Clients[j].Limited {
+			return s.Clients[i].Limited > s.Clients[j].Limited
+		}
+		return s.Clients[i].Client < s.Clients[j].Client
+	})
+
+	for key, st := range l.rrl {
+		if st.limited == 0 {
+			continue
+		}
+		network, response, _ := strings.Cut(key, " ")
+		s.RRL = append(s.RRL, RRLEntry{
+			Network:  network,
+			Response: response,
+			Limited:  st.limited,
+			LastSeen: st.lastSeen,
+		})
+	}
+	sort.Slice(s.RRL, func(i, j int) bool { return s.RRL[i].Limited > s.RRL[j].Limited })
+
+	return s
+}
+
+func (l *RateLimiter) cleanup() {
+	ticker := time.NewTicker(limiterIdle)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		l.mu.Lock()
+		sweep(l.clients, now, false)
+		sweep(l.rrl, now, false)
+		l.mu.Unlock()
+	}
+}
+
+// room reports whether states may take a new entry. Full tables are swept
+// at most once a second, so a flood from many sources does not walk them on
+// every query. Sources that find no room are not limited.
+func room[K comparable](states map[K]*limiterState, swept *time.Time, now time.Time) bool {
+	if len(states) < maxLimiterEntries {
+		return true
+	}
+	if now.Sub(*swept) >= time.Second {
+		sweep(states, now, true)
+		*swept = now
+	}
+	return len(states) < maxLimiterEntries
+}
+
+// sweep drops entries idle for longer than limiterIdle. Under pressure it
+// also drops those whose bucket has refilled, which behave exactly like a
+// new limiter.
+func sweep[K comparable](states map[K]*limiterState, now time.Time, pressure bool) {
+	for key, st := range states {
+		refilled := pressure && st.limiter.TokensAt(now) >= float64(st.limiter.Burst())
+		if refilled || now.Sub(st.lastSeen) > limiterIdle {
+			delete(states, key)
+		}
+	}
+}
+
+// anyResponse answers ANY queries with a single HINFO record (RFC 8482).
+func anyResponse(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyTTL},
+		Cpu: "RFC8482",
+		Os:  "",
+	}}
+	return m
+}
+
+// slipResponse is an empty truncated answer, so the client retries over TCP.
+func slipResponse(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Truncated = true
+	return m
+}
@@ -0,0 +1,141 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+func TestResponseKey(t *testing.T) {
+	nxdomain := func(name, zone string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeNameError)
+		if zone != "" {
+			resp.Ns = []dns.RR{mustRR(t, zone+" 300 IN SOA ns."+zone+" host."+zone+" 1 7200 3600 1209600 300")}
+		}
+		return resp
+	}
+	answer := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		return bigResponse(req, 1)
+	}
+
+	tests := []struct {
+		name string
+		a, b *dns.Msg
+		same bool
+	}{
+		{name: "NXDOMAIN in one zone", a: nxdomain("x1.example.com.", "example.com."), b: nxdomain("x2.example.com.", "example.com."), same: true},
+		{name: "NXDOMAIN in different zones", a: nxdomain("x.example.com.", "example.com."), b: nxdomain("x.example.org.", "example.org.")},
+		{name: "NXDOMAIN without SOA", a: nxdomain("a.example.", ""), b: nxdomain("b.example.", "")},
+		{name: "same answer", a: answer("www.example.com."), b: answer("WWW.example.com."), same: true},
+		{name: "different answers", a: answer("a.example.com."), b: answer("b.example.com.")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := responseKey(tt.a), responseKey(tt.b)
+			if (a == b) != tt.same {
+				t.Fatalf("keys %q and %q, want same=%v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestRRLExemptions(t *testing.T) {
+	rateLimit := config.RateLimitConfig{RRLRate: 1}
+
+	tests := []struct {
+		name    string
+		cfg     config.DNSConfig
+		qname   func(i int) string
+		limited bool
+	}{
+		{
+			name:    "upstream NXDOMAIN",
+			qname:   func(i int) string { return fmt.Sprintf("x%d.example.com.", i) },
+			limited: true,
+		},
+		{
+			name:  "blocked domain",
+			cfg:   config.DNSConfig{EnableFiltering: true, Blocklist: []string{"ads.example.net"}},
+			qname: func(int) string { return "ads.example.net." },
+		},
+		{
+			name:  "local name",
+			cfg:   config.DNSConfig{Rewrites: []config.RewriteConfig{{Domain: "nas.home", Answer: "192.168.1.10"}}},
+			qname: func(int) string { return "nas.home." },
+		},
+		{
+			name:  "client in allowed_clients",
+			cfg:   config.DNSConfig{AllowedClients: []string{"192.168.1.0/24"}},
+			qname: func(i int) string { return fmt.Sprintf("x%d.example.com.", i) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newFakeUpstream()
+			upstream.rcode[dns.TypeA] = dns.RcodeNameError
+			upstream.ns[dns.TypeA] = []dns.RR{mustRR(t, "example.com. 300 IN SOA ns.example.com. host.example.com. 1 7200 3600 1209600 300")}
+
+			cfg := tt.cfg
+			cfg.CacheSize, cfg.CacheTTL, cfg.RateLimit = 100, 300, rateLimit
+			r := NewResolver(cfg)
+			r.profiles[DefaultProfile].upstreams = []Upstream{upstream}
+
+			limited := false
+			for i := 0; i < 10; i++ {
+				w := newRecorder()
+				r.ServeDNS(w, question(tt.qname(i), dns.TypeA, dns.ClassINET))
+				if w.msg == nil || w.msg.Truncated {
+					limited = true
+				}
+			}
+			if limited != tt.limited {
+				t.Fatalf("limited %v, want %v", limited, tt.limited)
+			}
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	used := rate.NewLimiter(1, 5)
+	used.AllowN(now, 5)
+
+	states := map[string]*limiterState{
+		"idle":     {limiter: rate.NewLimiter(1, 5), lastSeen: now.Add(-2 * limiterIdle)},
+		"refilled": {limiter: rate.NewLimiter(1, 5), lastSeen: now},
+		"active":   {limiter: used, lastSeen: now},
+	}
+
+	sweep(states, now, false)
+	if _, ok := states["idle"]; ok || len(states) != 2 {
+		t.Fatalf("after periodic sweep: %v", states)
+	}
+	sweep(states, now, true)
+	if _, ok := states["active"]; !ok || len(states) != 1 {
+		t.Fatalf("after sweep under pressure: %v", states)
+	}
+
+	// Full tables take no new entries until a sweep frees room
+	full := make(map[netip.Addr]*limiterState, maxLimiterEntries)
+	for i := 0; i < maxLimiterEntries; i++ {
+		full[netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})] = &limiterState{limiter: used, lastSeen: now}
+	}
+	var swept time.Time
+	if room(full, &swept, now) {
+		t.Fatal("room in a table of active entries")
+	}
+	if swept != now {
+		t.Fatal("full table not swept")
+	}
+}
@@ -5,192 +5,642 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
 	"sync"
 	"time"
 
 	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/dhcpserver"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/identity"
 	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/metrics"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/querylog"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/stats"
 	"github.com/miekg/dns"
 )
 
 type Resolver struct {
+	cfg         config.DNSConfig
 	cache       *Cache
-	filter      *Filter
-	upstreams   []string
-	dohUpstream []string
-	client      *dns.Client
-	dohClient   *dns.Client
-	timeout     time.Duration
+	ipFilter    *IPFilter
+	rewriter    *Rewriter
+	local       *LocalZone
+	profiles    map[string]*Profile
+	clients     *ClientMatcher
+	identities  *identity.Registry
+	dhcp        *dhcpserver.Server
+	schedules   *Scheduler
+	queryLog    *querylog.Log
+	stats       *stats.Engine
+	limiter     *RateLimiter
+	lanResolver Upstream // answers reverse lookups of private addresses
+	proxies     []netip.Prefix
+	dns64       *DNS64
+	sanitizer   *Sanitizer
 	mu          sync.RWMutex
 }
 
 func NewResolver(cfg config.DNSConfig) *Resolver {
 	r := &Resolver{
-		cache:       NewCache(cfg.CacheSize, time.Duration(cfg.CacheTTL)*time.Second),
-		filter:      NewFilter(cfg.Blocklist, cfg.Allowlist, cfg.EnableFiltering),
-		upstreams:   cfg.Upstreams,
-		dohUpstream: cfg.DoHUpstreams,
-		timeout:     cfg.Timeout,
-		client: &dns.Client{
-			Net:     "tcp-tls",
-			Timeout: cfg.Timeout,
-			TLSConfig: &tls.Config{
-				MinVersion: tls.VersionTLS12,
-			},
-		},
-		dohClient: &dns.Client{
-			Net:     "tcp",
-			Timeout: cfg.Timeout,
-		},
+		cfg:       cfg,
+		cache:     NewCache(cfg.CacheSize, time.Duration(cfg.CacheTTL)*time.Second),
+		ipFilter:  NewIPFilter(cfg.IPBlocklist, cfg.IPBlockMode, cfg.RebindingProtection, cfg.RebindingAllowlist),
+		rewriter:  NewRewriter(cfg.Rewrites),
+		local:     NewLocalZone(),
+		profiles:  make(map[string]*Profile),
+		stats:     stats.New(),
+		limiter:   NewRateLimiter(cfg.RateLimit, cfg.AllowedClients),
+		sanitizer: NewSanitizer(cfg.Sanitize),
 	}
+
+	for _, entry := range cfg.TrustedProxies {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			logger.Errorf("Invalid trusted proxy %q: %v", entry, err)
+			continue
+		}
+		r.proxies = append(r.proxies, prefix)
+	}
+
+	// Clients of the built-in DHCP server are named from its leases
+	identityCfg := cfg.ClientIdentity
+	if cfg.DHCP.Enabled && cfg.DHCP.LeaseFile != "" {
+		identityCfg.LeaseFiles = append(append([]string(nil), identityCfg.LeaseFiles...), cfg.DHCP.LeaseFile)
+	}
+	r.identities = identity.New(identityCfg)
+
+	if cfg.DNS64.Enabled {
+		dns64, err := NewDNS64(cfg.DNS64)
+		if err != nil {
+			logger.Errorf("DNS64 disabled: %v", err)
+		}
+		r.dns64 = dns64
+	}
+
+	if cfg.LANResolver != "" {
+		r.lanResolver = newPlainUpstream(cfg.LANResolver, cfg.Timeout)
+	}
+
+	for _, path := range cfg.HostsFiles {
+		if err := r.local.LoadHostsFile(path); err != nil {
+			logger.Errorf("Failed to load hosts file %s: %v", path, err)
+		}
+	}
+	for _, path := range cfg.ZoneFiles {
+		if err := r.local.LoadZoneFile(path); err != nil {
+			logger.Errorf("Failed to load zone file %s: %v", path, err)
+		}
+	}
+
+	if cfg.DHCP.Enabled {
+		dhcp, err := dhcpserver.New(cfg.DHCP, r.local)
+		if err != nil {
+			logger.Errorf("DHCP server disabled: %v", err)
+		}
+		r.dhcp = dhcp
+	}
+
+	r.profiles[DefaultProfile] = newProfile(cfg, config.ProfileConfig{Name: DefaultProfile})
+	for _, p := range cfg.Profiles {
+		r.profiles[p.Name] = newProfile(cfg, p)
+	}
+
+	clients, err := NewClientMatcher(cfg.Clients)
+	if err != nil {
+		logger.Errorf("Ignoring client definitions: %v", err)
+		clients, _ = NewClientMatcher(nil)
+	}
+	r.clients = clients
+
+	schedules, err := NewScheduler(cfg.Schedules, cfg.Timezone, systemClock{})
+	if err != nil {
+		logger.Errorf("Ignoring schedules: %v", err)
+		schedules, _ = NewScheduler(nil, "", systemClock{})
+	}
+	r.schedules = schedules
+
+	if cfg.QueryLog.Enabled {
+		queryLog, err := querylog.New(cfg.QueryLog)
+		if err != nil {
+			logger.Errorf("Query log disabled: %v", err)
+		}
+		r.queryLog = queryLog
+	}
+
 	return r
 }
 
+// query carries per-request state through the resolver pipeline.
+type query struct {
+	req      *dns.Msg
+	client   net.Addr
+	who      identity.Client // name and MAC behind the client address
+	profile  *Profile
+	decision string
+	rule     Decision
+	cached   bool
+	upstream string
+	latency  time.Duration // upstream round trip
+}
+
 func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
-	if len(req.Question) == 0 {
-		dns.HandleFailed(w, req)
+	start := time.Now()
+	client, _ := addrIP(w.RemoteAddr())
+	network := w.RemoteAddr().Network()
+	udp := network == "udp"
+
+	if !r.limiter.Allowed(client) {
+		metrics.DNSLimited.WithLabelValues("acl").Inc()
+		resp := errorResponse(req, dns.RcodeRefused)
+		finishResponse(req, resp, network)
+		w.WriteMsg(resp)
 		return
 	}
+	if !r.limiter.Allow(client, start) {
+		metrics.DNSLimited.WithLabelValues("rate_limit").Inc()
+		// A UDP reply would still feed reflection, so floods are dropped
+		if !udp {
+			resp := errorResponse(req, dns.RcodeRefused)
+			finishResponse(req, resp, network)
+			w.WriteMsg(resp)
+		}
+		return
+	}
+
+	var q *query
+	resp := r.precheck(req)
+	if resp == nil {
+		who := r.identify(client)
+		q = &query{
+			req:     req,
+			client:  w.RemoteAddr(),
+			who:     who,
+			profile: r.profileFor(w.RemoteAddr(), req, who),
+		}
+		resp = r.handle(q)
+	}
+	finishResponse(req, resp, network)
 
+	out := resp
+	if udp && !rrlExempt(q) {
+		switch r.limiter.respond(client, resp, start) {
+		case rrlDrop:
+			metrics.DNSLimited.WithLabelValues("rrl_drop").Inc()
+			out = nil
+		case rrlSlip:
+			metrics.DNSLimited.WithLabelValues("rrl_slip").Inc()
+			out = slipResponse(req)
+		}
+	}
+	if out != nil {
+		w.WriteMsg(out)
+	}
+
+	// Only queries that went through the pipeline are logged
+	if q != nil {
+		r.record(q, resp, time.Since(start))
+	}
+}
+
+// rrlExempt reports whether the answer was made here rather than taken
+// from an upstream. Such answers are small, and limiting them would make
+// blocked domains slow down normal browsing.
+func rrlExempt(q *query) bool {
+	return q != nil && (q.decision == querylog.DecisionLocal || q.decision == querylog.DecisionBlocked)
+}
+
+func (r *Resolver) handle(q *query) *dns.Msg {
+	req, profile := q.req, q.profile
 	question := req.Question[0]
 	domain := question.Name
 	qtype := dns.TypeToString[question.Qtype]
 
-	logger.Debugf("DNS query: %s %s from %s", domain, qtype, w.RemoteAddr())
+	logger.Debugf("DNS query: %s %s from %s (profile %s)", domain, qtype, q.who.Label(), profile.Name)
+
+	// Minimal answer to ANY (RFC 8482)
+	if question.Qtype == dns.TypeANY && r.cfg.RefuseAny {
+		q.decision = querylog.DecisionLocal
+		return anyResponse(req)
+	}
+
+	// Answer names we are authoritative for
+	if local := r.local.Response(req); local != nil {
+		logger.Debugf("Local answer: %s %s", domain, qtype)
+		q.decision = querylog.DecisionLocal
+		return local
+	}
+
+	// Reverse lookups of private addresses never leave the LAN
+	if isPrivateReverse(domain) {
+		return r.privateReverse(q)
+	}
 
 	// Check filter
-	if r.filter.IsBlocked(domain) {
-		logger.Infof("Blocked domain: %s", domain)
-		r.sendNXDomain(w, req)
-		return
+	q.rule = r.decide(profile, domain)
+	if q.rule.Blocked {
+		logger.Infof("Blocked domain: %s (rule %s from %s)", domain, q.rule.Rule, q.rule.List)
+		q.decision = querylog.DecisionBlocked
+		return blockedResponse(req, profile.blockMode)
+	}
+
+	// Answer rewritten names locally
+	if answers, ok := r.rewriteFor(profile, domain); ok {
+		logger.Debugf("Rewrite: %s -> %v", domain, answers)
+		q.decision = querylog.DecisionLocal
+		return rewriteResponse(req, answers, func(name string, qtype uint16) []dns.RR {
+			return r.lookup(profile, clientSubnet(req), name, qtype)
+		})
+	}
+
+	q.decision = querylog.DecisionForwarded
+	if q.rule.Matched() {
+		q.decision = querylog.DecisionAllowed
 	}
 
 	// Check cache
-	if cached := r.cache.Get(domain, question.Qtype); cached != nil {
+	cacheName := r.cacheName(profile, domain)
+	if cached := r.cachedAnswer(profile, req, cacheName); cached != nil {
 		logger.Debugf("Cache hit: %s %s", domain, qtype)
-		cached.SetReply(req)
-		w.WriteMsg(cached)
-		return
+		metrics.DNSCacheHits.Inc()
+		q.cached = true
+		if !q.rule.Matched() {
+			q.decision = querylog.DecisionCached
+		}
+		r.filterSVCB(profile, cached)
+		replyTo(cached, req)
+		return cached
 	}
 
+	metrics.DNSCacheMisses.Inc()
+
 	// Forward to upstream
-	resp, err := r.forward(req)
+	start := time.Now()
+	resp, upstream, err := r.forward(req, profile.upstreams)
 	if err != nil {
 		logger.Errorf("Forward failed for %s: %v", domain, err)
-		dns.HandleFailed(w, req)
-		return
+		return servFail(req)
+	}
+	q.upstream = upstream.Address()
+	q.latency = time.Since(start)
+
+	// Check resolved addresses
+	if r.ipFilter.Apply(domain, resp) {
+		logger.Infof("Blocked response for %s by IP filter", domain)
+		q.decision = querylog.DecisionBlocked
+		q.rule = Decision{Blocked: true, Rule: "resolved address", List: "ip_blocklist"}
+		return blockedResponse(req, profile.blockMode)
+	}
+
+	// Synthesize AAAA records for NAT64 from the A records
+	if r.dns64.applies(req, resp) {
+		synthesized, blocked := r.synthesizeAAAA(q, resp, cacheName)
+		if blocked {
+			logger.Infof("Blocked DNS64 answer for %s by IP filter", domain)
+			q.decision = querylog.DecisionBlocked
+			q.rule = Decision{Blocked: true, Rule: "resolved address", List: "ip_blocklist"}
+			return blockedResponse(req, profile.blockMode)
+		}
+		resp = synthesized
 	}
 
 	// Cache successful response
 	if resp.Rcode == dns.RcodeSuccess {
-		r.cache.Set(domain, question.Qtype, resp)
+		r.cache.Set(responseCacheName(cacheName, resp), question.Qtype, resp)
 	}
+	r.filterSVCB(profile, resp)
 
-	// Send response
-	resp.SetReply(req)
-	w.WriteMsg(resp)
-
+	replyTo(resp, req)
 	logger.Debugf("Resolved: %s %s -> %d answers", domain, qtype, len(resp.Answer))
+	return resp
 }
 
-func (r *Resolver) forward(req *dns.Msg) (*dns.Msg, error) {
-	var lastErr error
+func (r *Resolver) record(q *query, resp *dns.Msg, latency time.Duration) {
+	qtype, rcode := dns.TypeToString[q.req.Question[0].Qtype], dns.RcodeToString[resp.Rcode]
+	metrics.DNSQueries.WithLabelValues(qtype, rcode).Inc()
+	if q.decision == querylog.DecisionBlocked {
+		metrics.DNSFilterBlocks.WithLabelValues(q.rule.List).Inc()
+	}
+
+	rec := querylog.Record{
+		Time:       time.Now(),
+		Client:     q.who.IP,
+		ClientName: q.who.Name,
+		Profile:    q.profile.Name,
+		QName:      q.req.Question[0].Name,
+		QType:      qtype,
+		Decision:   q.decision,
+		Rule:       q.rule.Rule,
+		List:       q.rule.List,
+		Upstream:   q.upstream,
+		Rcode:      rcode,
+		Answers:    len(resp.Answer),
+		Latency:    latency,
+	}
 
-	// Try DNS-over-TLS first
-	for _, upstream := range r.upstreams {
-		resp, _, err := r.client.Exchange(req, upstream)
-		if err == nil && resp != nil {
-			return resp, nil
+	// Statistics name clients and domains as the query log stores them
+	redacted := r.queryLog.Redact(rec, q.profile.logPolicy)
+	r.stats.Record(stats.Event{
+		Time:     rec.Time,
+		Client:   identity.Client{IP: redacted.Client, Name: redacted.ClientName}.Label(),
+		Domain:   normalizeDomain(redacted.QName),
+		Blocked:  q.decision == querylog.DecisionBlocked,
+		Cached:   q.cached,
+		Upstream: q.upstream,
+		Latency:  q.latency,
+	})
+
+	r.queryLog.Add(rec, q.profile.logPolicy)
+}
+
+func (r *Resolver) QueryLog() *querylog.Log {
+	return r.queryLog
+}
+
+func (r *Resolver) Stats() *stats.Engine {
+	return r.stats
+}
+
+func (r *Resolver) RateLimits() RateLimitStatus {
+	return r.limiter.Status()
+}
+
+func servFail(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	return m
+}
+
+func (r *Resolver) Schedules() []ScheduleStatus {
+	return r.schedules.Status()
+}
+
+// identify returns what the identity registry knows about ip, at least the
+// address itself.
+func (r *Resolver) identify(ip netip.Addr) identity.Client {
+	if who, ok := r.identities.Lookup(ip); ok {
+		return who
+	}
+	if !ip.IsValid() {
+		return identity.Client{}
+	}
+	return identity.Client{IP: ip.String()}
+}
+
+// Identities lists the clients known by name or MAC.
+func (r *Resolver) Identities() []identity.Client {
+	return r.identities.List()
+}
+
+// DHCPLeases returns the leases of the built-in DHCP server, nil when it
+// is disabled.
+func (r *Resolver) DHCPLeases() []dhcpserver.Lease {
+	if r.dhcp == nil {
+		return nil
+	}
+	return r.dhcp.Leases()
+}
+
+func (r *Resolver) profileFor(addr net.Addr, req *dns.Msg, who identity.Client) *Profile {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if client, ok := r.clients.Match(addr, req, who); ok {
+		if p, exists := r.profiles[client.Profile]; exists {
+			return p
 		}
-		lastErr = err
-		logger.Debugf("DoT upstream %s failed: %v", upstream, err)
 	}
+	return r.profiles[DefaultProfile]
+}
+
+// decide applies the profile lists and active schedules together, so the
+// most specific rule wins across all of them.
+func (r *Resolver) decide(profile *Profile, domain string) Decision {
+	return prefer(profile.filter.IsBlocked(domain), r.schedules.Match(profile.Name, domain))
+}
+
+// Check reports the filtering decision for domain as seen by a client,
+// identified by address, MAC, host name or EDNS client-id.
+func (r *Resolver) Check(client, domain string) (string, Decision) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+
+	var addr net.Addr
+	var who identity.Client
+	if ip, err := netip.ParseAddr(client); err == nil {
+		addr = &net.UDPAddr{IP: ip.AsSlice()}
+		who = r.identify(ip.Unmap())
+	} else if hw, err := net.ParseMAC(client); err == nil {
+		who.MAC = hw.String()
+	} else if client != "" {
+		// Host names are matched like client-ids
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EDNS0ClientIDCode, Data: []byte(client)})
+	}
+
+	profile := r.profileFor(addr, req, who)
+	return profile.Name, r.decide(profile, domain)
+}
 
-	// Fallback to DNS-over-HTTPS
-	for _, dohURL := range r.dohUpstream {
-		resp, err := r.queryDoH(req, dohURL)
-		if err == nil && resp != nil {
-			return resp, nil
+func (r *Resolver) rewriteFor(profile *Profile, domain string) ([]string, bool) {
+	if answers, ok := r.rewriter.Match(domain); ok {
+		return answers, true
+	}
+	if profile.safeSearch {
+		if target, ok := safeSearchTarget(domain); ok {
+			return []string{target}, true
 		}
-		lastErr = err
-		logger.Debugf("DoH upstream %s failed: %v", dohURL, err)
 	}
+	return nil, false
+}
 
-	return nil, fmt.Errorf("all upstreams failed: %v", lastErr)
+// lookup resolves name internally, for example a CNAME target of a rewrite.
+// Rewrites come first, then local names, and only then the upstreams, so
+// LAN names never leave the network. subnet is the client subnet of the
+// query the lookup is made for, nil when it has none.
+func (r *Resolver) lookup(profile *Profile, subnet *dns.EDNS0_SUBNET, name string, qtype uint16) []dns.RR {
+	return r.lookupDepth(profile, subnet, name, qtype, 0)
 }
 
-func (r *Resolver) queryDoH(req *dns.Msg, url string) (*dns.Msg, error) {
-	// Simple DoH implementation via DNS wire format over HTTPS
-	// In production, use a proper DoH library
-	host, _, err := net.SplitHostPort(url)
-	if err != nil {
-		host = url
+func (r *Resolver) lookupDepth(profile *Profile, subnet *dns.EDNS0_SUBNET, name string, qtype uint16, depth int) []dns.RR {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	if subnet != nil {
+		req.SetEdns0(ednsBufferSize, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, subnet)
 	}
 
-	conn, err := tls.DialWithDialer(
-		&net.Dialer{Timeout: r.timeout},
-		"tcp",
-		host+":443",
-		&tls.Config{ServerName: host},
-	)
-	if err != nil {
-		return nil, err
+	if answers, ok := r.rewriteFor(profile, name); ok {
+		if depth >= maxRewriteDepth {
+			logger.Warnf("Rewrite chain for %s is too long", name)
+			return nil
+		}
+		return rewriteResponse(req, answers, func(name string, qtype uint16) []dns.RR {
+			return r.lookupDepth(profile, subnet, name, qtype, depth+1)
+		}).Answer
 	}
-	defer conn.Close()
 
-	co := &dns.Conn{Conn: conn}
-	if err := co.WriteMsg(req); err != nil {
-		return nil, err
+	if local := r.local.Response(req); local != nil {
+		return local.Answer
 	}
 
-	return co.ReadMsg()
+	// Same keys as handle, answers may be scoped to a client subnet
+	cacheName := r.cacheName(profile, name)
+	if cached := r.cachedAnswer(profile, req, cacheName); cached != nil {
+		return cached.Answer
+	}
+
+	resp, _, err := r.forward(req, profile.upstreams)
+	if err != nil {
+		logger.Errorf("Lookup failed for %s: %v", name, err)
+		return nil
+	}
+	if r.ipFilter.Apply(name, resp) {
+		logger.Infof("Blocked lookup of %s by IP filter", name)
+		return nil
+	}
+
+	if resp.Rcode == dns.RcodeSuccess {
+		r.cache.Set(responseCacheName(cacheName, resp), qtype, resp)
+	}
+	return resp.Answer
 }
 
-func (r *Resolver) sendNXDomain(w dns.ResponseWriter, req *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetRcode(req, dns.RcodeNameError)
-	w.WriteMsg(m)
+// cacheName scopes cache entries of profiles that use their own upstreams.
+func (r *Resolver) cacheName(profile *Profile, domain string) string {
+	if profile.hasOwnUpstreams() {
+		return profile.Name + "/" + domain
+	}
+	return domain
 }
 
-func Start(ctx context.Context, cfg config.DNSConfig) error {
-	resolver := NewResolver(cfg)
+// forward sends a fresh query to the upstreams in order and returns the
+// first reply that matches it. A reply failing the rebinding protection may
+// be poisoned at that upstream only, the next one is tried; when all of them
+// agree the reply is returned for the IP filter to block.
+func (r *Resolver) forward(req *dns.Msg, upstreams []Upstream) (*dns.Msg, Upstream, error) {
+	var (
+		lastErr     error
+		rebound     *dns.Msg
+		reboundFrom Upstream
+	)
 
-	// UDP server
-	udpServer := &dns.Server{
-		Addr:    cfg.Listen,
-		Net:     "udp",
-		Handler: resolver,
-		UDPSize: 65535,
+	name := req.Question[0].Name
+	for _, upstream := range upstreams {
+		query := upstreamQuery(req)
+		if r.cfg.RandomizeCase {
+			query.Question[0].Name = randomizeCase(name)
+		}
+
+		start := time.Now()
+		resp, err := upstream.Exchange(query)
+		if err == nil {
+			err = verifyReply(query, resp, r.cfg.RandomizeCase)
+		}
+		if err == nil {
+			err = r.sanitizer.Apply(resp)
+		}
+		if err == nil {
+			metrics.DNSUpstreamDuration.WithLabelValues(upstream.Address()).Observe(time.Since(start).Seconds())
+			restoreCase(resp, query.Question[0].Name, name)
+			if err = r.ipFilter.Rebinding(name, resp); err == nil {
+				return resp, upstream, nil
+			}
+			rebound, reboundFrom = resp, upstream
+		}
+		metrics.DNSUpstreamErrors.WithLabelValues(upstream.Address()).Inc()
+		lastErr = err
+		logger.Debugf("Upstream %s failed: %v", upstream.Address(), err)
 	}
 
-	// TCP server (for large responses)
-	tcpAddr := cfg.Listen
-	if tcpAddr == ":9000" {
-		tcpAddr = ":9001"
+	if rebound != nil {
+		return rebound, reboundFrom, nil
 	}
-	tcpServer := &dns.Server{
-		Addr:    tcpAddr,
-		Net:     "tcp",
-		Handler: resolver,
+	return nil, nil, fmt.Errorf("all upstreams failed: %v", lastErr)
+}
+
+func Start(ctx context.Context, cfg config.DNSConfig) error {
+	return Serve(ctx, cfg, NewResolver(cfg))
+}
+
+// Serve runs the DNS listeners with an existing resolver, so it can be
+// shared with the API.
+func Serve(ctx context.Context, cfg config.DNSConfig, resolver *Resolver) error {
+	servers, err := plainServers(cfg, resolver)
+	if err != nil {
+		return err
 	}
 
-	errChan := make(chan error, 2)
+	var dohServer *http.Server
+
+	if cfg.ListenDoT != "" || cfg.ListenDoH != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
 
-	// Start UDP server
-	go func() {
-		logger.Infof("DNS UDP server listening on %s", udpServer.Addr)
-		if err := udpServer.ListenAndServe(); err != nil {
-			errChan <- fmt.Errorf("UDP server: %v", err)
+		// DNS-over-TLS server
+		if cfg.ListenDoT != "" {
+			servers = append(servers, &dns.Server{
+				Addr:          cfg.ListenDoT,
+				Net:           "tcp-tls",
+				Handler:       resolver,
+				TLSConfig:     tlsConfig,
+				MsgAcceptFunc: acceptMsg,
+			})
 		}
-	}()
 
-	// Start TCP server
-	go func() {
-		logger.Infof("DNS TCP server listening on %s", tcpServer.Addr)
-		if err := tcpServer.ListenAndServe(); err != nil {
-			errChan <- fmt.Errorf("TCP server: %v", err)
+		// DNS-over-HTTPS server
+		if cfg.ListenDoH != "" {
+			dohServer = &http.Server{
+				Addr:         cfg.ListenDoH,
+				Handler:      NewDoHHandler(resolver),
+				TLSConfig:    tlsConfig,
+				ReadTimeout:  10 * time.Second,
+				WriteTimeout: 10 * time.Second,
+				IdleTimeout:  2 * time.Minute,
+			}
 		}
-	}()
+	}
+
+	errChan := make(chan error, len(servers)+2)
+
+	for _, server := range servers {
+		go func() {
+			logger.Infof("DNS %s server listening on %s", serverNames[server.Net], server.Addr)
+
+			serve := server.ListenAndServe
+			if server.PacketConn != nil || server.Listener != nil {
+				serve = server.ActivateAndServe
+			}
+			if err := serve(); err != nil {
+				errChan <- fmt.Errorf("%s server: %v", serverNames[server.Net], err)
+			}
+		}()
+	}
+
+	if dohServer != nil {
+		go func() {
+			logger.Infof("DNS DoH server listening on %s%s", dohServer.Addr, DoHPath)
+			if err := dohServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				errChan <- fmt.Errorf("DoH server: %v", err)
+			}
+		}()
+	}
+
+	if resolver.dhcp != nil {
+		go func() {
+			if err := resolver.dhcp.ListenAndServe(ctx); err != nil {
+				errChan <- fmt.Errorf("DHCP server: %v", err)
+			}
+		}()
+	}
 
 	// Wait for shutdown or error
 	select {
@@ -201,12 +651,26 @@ func Start(ctx context.Context, cfg config.DNSConfig) error {
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		if err := udpServer.ShutdownContext(shutdownCtx); err != nil {
-			logger.Errorf("UDP shutdown error: %v", err)
+		for _, server := range servers {
+			if err := server.ShutdownContext(shutdownCtx); err != nil {
+				logger.Errorf("%s shutdown error: %v", serverNames[server.Net], err)
+			}
+		}
+		if dohServer != nil {
+			if err := dohServer.Shutdown(shutdownCtx); err != nil {
+				logger.Errorf("DoH shutdown error: %v", err)
+			}
 		}
-		if err := tcpServer.ShutdownContext(shutdownCtx); err != nil {
-			logger.Errorf("TCP shutdown error: %v", err)
+		if err := resolver.queryLog.Close(); err != nil {
+			logger.Errorf("Query log close error: %v", err)
 		}
+		resolver.identities.Close()
 		return nil
 	}
 }
+
+var serverNames = map[string]string{
+	"udp":     "UDP",
+	"tcp":     "TCP",
+	"tcp-tls": "DoT",
+}
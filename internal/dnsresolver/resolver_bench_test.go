@@ -48,7 +48,7 @@ func BenchmarkCacheMiss(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		msg := &dns.Msg{}
 		msg.SetQuestion("test.example.com.", dns.TypeA)
-		resolver.forward(msg)
+		resolver.forward(msg, resolver.profiles[DefaultProfile].upstreams)
 	}
 }
 
@@ -0,0 +1,46 @@
+package dnsresolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/querylog"
+	"github.com/miekg/dns"
+)
+
+func TestStatsFollowLogPolicy(t *testing.T) {
+	r := NewResolver(config.DNSConfig{
+		CacheSize: 100,
+		CacheTTL:  300,
+		QueryLog:  config.QueryLogConfig{Enabled: true, MaxRecords: 10},
+		Profiles: []config.ProfileConfig{{
+			Name:     "private",
+			QueryLog: &config.QueryLogPolicyConfig{AnonymizeClientIP: true, HashNames: true},
+		}},
+		Clients: []config.ClientConfig{{Name: "tablet", IDs: []string{"192.168.1.2"}, Profile: "private"}},
+	})
+	defer r.QueryLog().Close()
+	upstream := newFakeUpstream()
+	upstream.answer[dns.TypeA] = []dns.RR{mustRR(t, "example.com. 60 IN A 192.0.2.1")}
+	for _, profile := range r.profiles {
+		profile.upstreams = []Upstream{upstream}
+	}
+
+	r.ServeDNS(newRecorder(), question("example.com.", dns.TypeA, dns.ClassINET))
+
+	records, _ := r.QueryLog().Search(querylog.Query{})
+	if len(records) != 1 {
+		t.Fatalf("%d log records, want 1", len(records))
+	}
+	s, err := r.Stats().Snapshot("1h", 10, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.TopClients) != 1 || s.TopClients[0].Name != records[0].Client || s.TopClients[0].Name != "192.168.1.0" {
+		t.Fatalf("top clients %v, log has %s", s.TopClients, records[0].Client)
+	}
+	if len(s.TopDomains) != 1 || s.TopDomains[0].Name != records[0].QName || s.TopDomains[0].Name == "example.com" {
+		t.Fatalf("top domains %v, log has %s", s.TopDomains, records[0].QName)
+	}
+}
@@ -0,0 +1,113 @@
+package dnsresolver
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/querylog"
+	"github.com/miekg/dns"
+)
+
+// privateRanges are the locally served reverse zones of RFC 6303 section 4
+// plus shared address space; their names must not reach public resolvers.
+var privateRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("255.255.255.255/32"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// reversePrefix parses an in-addr.arpa or ip6.arpa name into the address
+// prefix it covers, so partial names such as 168.192.in-addr.arpa work too.
+func reversePrefix(name string) (netip.Prefix, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa."); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) > 4 {
+			return netip.Prefix{}, false
+		}
+
+		var addr [4]byte
+		for i, label := range octets {
+			n, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return netip.Prefix{}, false
+			}
+			addr[len(octets)-1-i] = byte(n)
+		}
+		return netip.PrefixFrom(netip.AddrFrom4(addr), 8*len(octets)), true
+	}
+
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa."); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) > 32 {
+			return netip.Prefix{}, false
+		}
+
+		var addr [16]byte
+		for i, label := range nibbles {
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return netip.Prefix{}, false
+			}
+			pos := len(nibbles) - 1 - i
+			if pos%2 == 0 {
+				addr[pos/2] |= byte(n) << 4
+			} else {
+				addr[pos/2] |= byte(n)
+			}
+		}
+		return netip.PrefixFrom(netip.AddrFrom16(addr), 4*len(nibbles)), true
+	}
+
+	return netip.Prefix{}, false
+}
+
+// isPrivateReverse reports whether name lies inside a private reverse zone.
+func isPrivateReverse(name string) bool {
+	prefix, ok := reversePrefix(name)
+	if !ok {
+		return false
+	}
+	for _, r := range privateRanges {
+		if r.Bits() <= prefix.Bits() && r.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateReverse answers a reverse lookup of a private address that the
+// local zone does not know: from the LAN resolver if one is configured,
+// NXDOMAIN otherwise.
+func (r *Resolver) privateReverse(q *query) *dns.Msg {
+	if r.lanResolver == nil {
+		q.decision = querylog.DecisionLocal
+		return errorResponse(q.req, dns.RcodeNameError)
+	}
+
+	q.decision = querylog.DecisionForwarded
+	resp, upstream, err := r.forward(q.req, []Upstream{r.lanResolver})
+	if err != nil {
+		logger.Debugf("LAN resolver failed for %s: %v", q.req.Question[0].Name, err)
+		return errorResponse(q.req, dns.RcodeNameError)
+	}
+	q.upstream = upstream.Address()
+
+	return replyTo(resp, q.req)
+}
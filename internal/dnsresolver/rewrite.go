@@ -0,0 +1,131 @@
+package dnsresolver
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+)
+
+const (
+	rewriteTTL = 300
+	// CNAME rewrites may point at other rewrites, this bounds loops
+	maxRewriteDepth = 8
+)
+
+var safeSearchHosts = map[string]string{
+	"www.youtube.com":          "restrict.youtube.com",
+	"m.youtube.com":            "restrict.youtube.com",
+	"youtubei.googleapis.com":  "restrict.youtube.com",
+	"youtube.googleapis.com":   "restrict.youtube.com",
+	"www.youtube-nocookie.com": "restrict.youtube.com",
+	"www.bing.com":             "strict.bing.com",
+	"bing.com":                 "strict.bing.com",
+	"duckduckgo.com":           "safe.duckduckgo.com",
+	"www.duckduckgo.com":       "safe.duckduckgo.com",
+}
+
+// Rewriter answers configured names locally with an address or a CNAME.
+type Rewriter struct {
+	exact    map[string][]string
+	wildcard map[string][]string
+	mu       sync.RWMutex
+}
+
+func NewRewriter(rules []config.RewriteConfig) *Rewriter {
+	rw := &Rewriter{
+		exact:    make(map[string][]string),
+		wildcard: make(map[string][]string),
+	}
+
+	for _, rule := range rules {
+		rw.Add(rule.Domain, rule.Answer)
+	}
+
+	return rw
+}
+
+func (rw *Rewriter) Add(domain, answer string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	domain = normalizeDomain(domain)
+	if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+		rw.wildcard[suffix] = append(rw.wildcard[suffix], answer)
+		return
+	}
+	rw.exact[domain] = append(rw.exact[domain], answer)
+}
+
+// Match returns the answers for domain. Exact rules win over wildcards and
+// longer wildcard suffixes win over shorter ones.
+func (rw *Rewriter) Match(domain string) ([]string, bool) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+
+	domain = normalizeDomain(domain)
+	if answers, ok := rw.exact[domain]; ok {
+		return answers, true
+	}
+
+	parts := strings.Split(domain, ".")
+	for i := 1; i < len(parts); i++ {
+		if answers, ok := rw.wildcard[strings.Join(parts[i:], ".")]; ok {
+			return answers, true
+		}
+	}
+
+	return nil, false
+}
+
+// safeSearchTarget returns the enforced host for search engines and video
+// sites that support SafeSearch via DNS.
+func safeSearchTarget(domain string) (string, bool) {
+	domain = normalizeDomain(domain)
+	if target, ok := safeSearchHosts[domain]; ok {
+		return target, true
+	}
+
+	// google.<tld> and www.google.<tld>, including two-label TLDs like co.uk
+	parts := strings.Split(strings.TrimPrefix(domain, "www."), ".")
+	if len(parts) >= 2 && len(parts) <= 3 && parts[0] == "google" {
+		return "forcesafesearch.google.com", true
+	}
+
+	return "", false
+}
+
+// rewriteResponse builds a reply for the rewrite answers. CNAME targets are
+// resolved through lookup.
+func rewriteResponse(req *dns.Msg, answers []string, lookup func(name string, qtype uint16) []dns.RR) *dns.Msg {
+	q := req.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: rewriteTTL}
+	}
+
+	for _, answer := range answers {
+		ip := net.ParseIP(answer)
+		switch {
+		case ip == nil:
+			target := dns.Fqdn(answer)
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: target})
+			if q.Qtype != dns.TypeCNAME {
+				m.Answer = append(m.Answer, lookup(target, q.Qtype)...)
+			}
+			// Only one CNAME per name is allowed
+			return m
+		case ip.To4() != nil && q.Qtype == dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr(dns.TypeA), A: ip.To4()})
+		case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+		}
+	}
+
+	return m
+}
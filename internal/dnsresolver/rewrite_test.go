@@ -0,0 +1,116 @@
+package dnsresolver
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+)
+
+func TestRewriteTargets(t *testing.T) {
+	rewrites := []config.RewriteConfig{
+		{Domain: "nas.home", Answer: "192.168.1.10"},
+		{Domain: "*.dev.home", Answer: "nas.home"},
+		{Domain: "www.site.home", Answer: "app.dev.home"},
+		{Domain: "printer.home", Answer: "printer.lan"},
+		{Domain: "video.home", Answer: "cdn.example.net"},
+	}
+
+	tests := []struct {
+		name     string
+		qname    string
+		upstream string // A record the upstream answers with
+		want     string // answer records as "owner type data"
+	}{
+		{
+			name:  "local rewrite target",
+			qname: "app.dev.home.",
+			want:  "app.dev.home. CNAME nas.home., nas.home. A 192.168.1.10",
+		},
+		{
+			name:  "chained rewrites",
+			qname: "www.site.home.",
+			want:  "www.site.home. CNAME app.dev.home., app.dev.home. CNAME nas.home., nas.home. A 192.168.1.10",
+		},
+		{
+			name:  "local zone target",
+			qname: "printer.home.",
+			want:  "printer.home. CNAME printer.lan., printer.lan. A 192.168.1.20",
+		},
+		{
+			name:     "external target",
+			qname:    "video.home.",
+			upstream: "cdn.example.net. 300 IN A 192.0.2.1",
+			want:     "video.home. CNAME cdn.example.net., cdn.example.net. A 192.0.2.1",
+		},
+		{
+			name:     "external target resolving to a private address",
+			qname:    "video.home.",
+			upstream: "cdn.example.net. 300 IN A 10.0.0.1",
+			want:     "video.home. CNAME cdn.example.net.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newFakeUpstream()
+			if tt.upstream != "" {
+				upstream.answer[dns.TypeA] = []dns.RR{mustRR(t, tt.upstream)}
+			}
+			r := NewResolver(config.DNSConfig{CacheSize: 100, CacheTTL: 300, Rewrites: rewrites, RebindingProtection: true})
+			r.profiles[DefaultProfile].upstreams = []Upstream{upstream}
+			r.local.AddHost(net.ParseIP("192.168.1.20"), "printer.lan")
+
+			w := newRecorder()
+			r.ServeDNS(w, question(tt.qname, dns.TypeA, dns.ClassINET))
+			if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+				t.Fatalf("got %v", w.msg)
+			}
+			if got := answerRecords(w.msg); got != tt.want {
+				t.Fatalf("answer %q, want %q", got, tt.want)
+			}
+
+			// Internal names never reach the public upstreams
+			want := 0
+			if tt.upstream != "" {
+				want = 1
+			}
+			if n := upstream.count(dns.TypeA); n != want {
+				t.Fatalf("%d upstream queries, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestRewriteLoop(t *testing.T) {
+	r := NewResolver(config.DNSConfig{CacheSize: 100, CacheTTL: 300, Rewrites: []config.RewriteConfig{
+		{Domain: "a.home", Answer: "b.home"},
+		{Domain: "b.home", Answer: "a.home"},
+	}})
+	upstream := newFakeUpstream()
+	r.profiles[DefaultProfile].upstreams = []Upstream{upstream}
+
+	w := newRecorder()
+	r.ServeDNS(w, question("a.home.", dns.TypeA, dns.ClassINET))
+	if w.msg == nil || len(w.msg.Answer) > maxRewriteDepth+1 {
+		t.Fatalf("got %v", w.msg)
+	}
+	if n := upstream.count(dns.TypeA); n != 0 {
+		t.Fatalf("%d upstream queries for a rewrite loop", n)
+	}
+}
+
+func answerRecords(resp *dns.Msg) string {
+	var out []string
+	for _, rr := range resp.Answer {
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			out = append(out, v.Hdr.Name+" CNAME "+v.Target)
+		case *dns.A:
+			out = append(out, v.Hdr.Name+" A "+v.A.String())
+		}
+	}
+	return strings.Join(out, ", ")
+}
@@ -0,0 +1,199 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/miekg/dns"
+)
+
+const defaultMaxRecords = 200
+
+// Sanitizer cleans upstream answers before they are cached: records that
+// do not belong to the question are dropped, oversized answers are rejected
+// and TTLs are clamped. Private addresses for public names are left to the
+// rebinding protection of the IPFilter, which forward also consults to try
+// the next upstream.
+type Sanitizer struct {
+	maxRecords int
+	minTTL     uint32
+	maxTTL     uint32
+}
+
+func NewSanitizer(cfg config.SanitizeConfig) *Sanitizer {
+	s := &Sanitizer{
+		maxRecords: cfg.MaxRecords,
+		minTTL:     uint32(cfg.MinTTL.Seconds()),
+		maxTTL:     uint32(cfg.MaxTTL.Seconds()),
+	}
+	if s.maxRecords <= 0 {
+		s.maxRecords = defaultMaxRecords
+	}
+	return s
+}
+
+// Apply cleans resp in place. An error means the answer must not be used
+// and the next upstream should be tried.
+func (s *Sanitizer) Apply(resp *dns.Msg) error {
+	if n := len(resp.Answer) + len(resp.Ns) + len(resp.Extra); n > s.maxRecords {
+		return fmt.Errorf("answer has %d records, limit %d", n, s.maxRecords)
+	}
+
+	name := strings.ToLower(resp.Question[0].Name)
+	chain := answerChain(name, resp.Answer)
+
+	resp.Answer = filterRecords(resp.Answer, func(rr dns.RR) bool {
+		owner := strings.ToLower(rr.Header().Name)
+		if chain[owner] {
+			return true
+		}
+		// DNAME owners sit above the names they redirect
+		return rr.Header().Rrtype == dns.TypeDNAME && chainUnder(chain, owner)
+	})
+
+	// Authority data must come from a zone the question lies in
+	zone := ""
+	for _, rr := range resp.Ns {
+		owner := strings.ToLower(rr.Header().Name)
+		if t := rr.Header().Rrtype; (t == dns.TypeSOA || t == dns.TypeNS) && chainUnder(chain, owner) {
+			if zone == "" || dns.CountLabel(owner) > dns.CountLabel(zone) {
+				zone = owner
+			}
+		}
+	}
+	resp.Ns = filterRecords(resp.Ns, func(rr dns.RR) bool {
+		owner := strings.ToLower(rr.Header().Name)
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNS, dns.TypeDS:
+			return chainUnder(chain, owner)
+		}
+		// NSEC, NSEC3 and signatures of the zone
+		return zone != "" && dns.IsSubDomain(zone, owner)
+	})
+
+	// Additional data only for names the answer points at, inside the zone
+	if zone == "" {
+		zone = name
+	}
+	targets := referencedNames(resp)
+	resp.Extra = filterRecords(resp.Extra, func(rr dns.RR) bool {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			return true
+		}
+		owner := strings.ToLower(rr.Header().Name)
+		return targets[owner] && dns.IsSubDomain(zone, owner)
+	})
+
+	s.clampTTLs(resp)
+	return nil
+}
+
+func (s *Sanitizer) clampTTLs(resp *dns.Msg) {
+	for i, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			// The authority SOA sets how long a negative answer is cached,
+			// raising it would keep NXDOMAIN and NODATA around longer
+			negative := i == 1 && hdr.Rrtype == dns.TypeSOA
+			if hdr.Ttl < s.minTTL && !negative {
+				hdr.Ttl = s.minTTL
+			}
+			if s.maxTTL > 0 && hdr.Ttl > s.maxTTL {
+				hdr.Ttl = s.maxTTL
+			}
+		}
+	}
+}
+
+// answerChain returns the question name and the CNAME and DNAME targets
+// reached from it.
+func answerChain(name string, answer []dns.RR) map[string]bool {
+	chain := map[string]bool{name: true}
+
+	// Records may come in any order, follow until nothing is added
+	for added := true; added; {
+		added = false
+		for _, rr := range answer {
+			owner := strings.ToLower(rr.Header().Name)
+			var target string
+			switch v := rr.(type) {
+			case *dns.CNAME:
+				if chain[owner] {
+					target = strings.ToLower(v.Target)
+				}
+			case *dns.DNAME:
+				for n := range chain {
+					if n != owner && dns.IsSubDomain(owner, n) {
+						target = strings.TrimSuffix(n, owner) + strings.ToLower(v.Target)
+						break
+					}
+				}
+			}
+			if target != "" && !chain[target] {
+				chain[target] = true
+				added = true
+			}
+		}
+	}
+
+	return chain
+}
+
+// chainUnder reports whether a name of the chain is at or below parent.
+func chainUnder(chain map[string]bool, parent string) bool {
+	for n := range chain {
+		if dns.IsSubDomain(parent, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedNames returns the host names answer and authority records
+// point at, whose addresses may come along as additional data.
+func referencedNames(resp *dns.Msg) map[string]bool {
+	names := make(map[string]bool)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range section {
+			var target string
+			switch v := rr.(type) {
+			case *dns.NS:
+				target = v.Ns
+			case *dns.MX:
+				target = v.Mx
+			case *dns.SRV:
+				target = v.Target
+			case *dns.CNAME:
+				target = v.Target
+			default:
+				if svcb, ok := svcbData(rr); ok {
+					target = svcb.Target
+					if target == "." {
+						target = svcb.Hdr.Name
+					}
+				}
+			}
+			if target != "" {
+				names[strings.ToLower(target)] = true
+			}
+		}
+	}
+	return names
+}
+
+func filterRecords(rrs []dns.RR, keep func(dns.RR) bool) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if keep(rr) {
+			kept = append(kept, rr)
+		} else {
+			logger.Debugf("Dropped out-of-bailiwick record %s", rr.String())
+		}
+	}
+	return kept
+}
@@ -0,0 +1,234 @@
+package dnsresolver
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+)
+
+// records returns the records of a section as "owner type" strings.
+func records(rrs []dns.RR) string {
+	var out []string
+	for _, rr := range rrs {
+		out = append(out, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+	}
+	sort.Strings(out)
+	return strings.Join(out, ", ")
+}
+
+func TestSanitizerBailiwick(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		answer []string
+		ns     []string
+		extra  []string
+		// kept records per section
+		wantAnswer string
+		wantNs     string
+		wantExtra  string
+	}{
+		{
+			name:       "unrelated answer dropped",
+			qname:      "www.example.com.",
+			answer:     []string{"www.example.com. 60 IN A 192.0.2.1", "bank.example.net. 60 IN A 198.51.100.1"},
+			wantAnswer: "www.example.com. A",
+		},
+		{
+			name:  "CNAME chain kept in any order",
+			qname: "www.example.com.",
+			answer: []string{
+				"cdn.example.net. 60 IN A 192.0.2.1",
+				"www.example.com. 60 IN CNAME cdn.example.net.",
+				"other.example.org. 60 IN A 192.0.2.2",
+			},
+			wantAnswer: "cdn.example.net. A, www.example.com. CNAME",
+		},
+		{
+			name:  "DNAME chain",
+			qname: "www.old.example.",
+			answer: []string{
+				"old.example. 60 IN DNAME new.example.",
+				"www.old.example. 60 IN CNAME www.new.example.",
+				"www.new.example. 60 IN A 192.0.2.1",
+				"unrelated.example. 60 IN DNAME evil.example.",
+			},
+			wantAnswer: "old.example. DNAME, www.new.example. A, www.old.example. CNAME",
+		},
+		{
+			name:       "DNAME without synthesized CNAME",
+			qname:      "a.b.old.example.",
+			answer:     []string{"old.example. 60 IN DNAME new.example.", "a.b.new.example. 60 IN A 192.0.2.1"},
+			wantAnswer: "a.b.new.example. A, old.example. DNAME",
+		},
+		{
+			name:       "out-of-zone authority dropped",
+			qname:      "www.example.com.",
+			answer:     []string{"www.example.com. 60 IN A 192.0.2.1"},
+			ns:         []string{"example.com. 60 IN NS ns1.example.com.", "com. 60 IN NS a.gtld-servers.net.", "example.net. 60 IN NS ns.evil.example."},
+			extra:      []string{"ns1.example.com. 60 IN A 192.0.2.53", "a.gtld-servers.net. 60 IN A 192.0.2.54"},
+			wantAnswer: "www.example.com. A",
+			wantNs:     "com. NS, example.com. NS",
+			wantExtra:  "ns1.example.com. A",
+		},
+		{
+			name:   "negative answer keeps zone SOA",
+			qname:  "missing.example.com.",
+			ns:     []string{"example.com. 60 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300", "example.org. 60 IN SOA ns.example.org. h.example.org. 1 7200 3600 1209600 300"},
+			wantNs: "example.com. SOA",
+		},
+		{
+			name:       "additional only for referenced names",
+			qname:      "example.com.",
+			answer:     []string{"example.com. 60 IN MX 10 mail.example.com."},
+			extra:      []string{"mail.example.com. 60 IN A 192.0.2.25", "www.example.com. 60 IN A 192.0.2.80", "mail.evil.example. 60 IN A 192.0.2.66"},
+			wantAnswer: "example.com. MX",
+			wantExtra:  "mail.example.com. A",
+		},
+		{
+			name:       "additional outside the zone dropped",
+			qname:      "example.com.",
+			answer:     []string{"example.com. 60 IN MX 10 mx.provider.example."},
+			extra:      []string{"mx.provider.example. 60 IN A 192.0.2.25"},
+			wantAnswer: "example.com. MX",
+		},
+	}
+
+	s := NewSanitizer(config.SanitizeConfig{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(dns.Msg)
+			resp.SetQuestion(tt.qname, dns.TypeA)
+			for _, r := range tt.answer {
+				resp.Answer = append(resp.Answer, mustRR(t, r))
+			}
+			for _, r := range tt.ns {
+				resp.Ns = append(resp.Ns, mustRR(t, r))
+			}
+			for _, r := range tt.extra {
+				resp.Extra = append(resp.Extra, mustRR(t, r))
+			}
+			resp.SetEdns0(1232, false)
+
+			if err := s.Apply(resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := records(resp.Answer); got != tt.wantAnswer {
+				t.Errorf("answer %q, want %q", got, tt.wantAnswer)
+			}
+			if got := records(resp.Ns); got != tt.wantNs {
+				t.Errorf("authority %q, want %q", got, tt.wantNs)
+			}
+			if resp.IsEdns0() == nil {
+				t.Error("OPT record dropped")
+			}
+			resp.Extra = filterRecords(resp.Extra, func(rr dns.RR) bool { return rr.Header().Rrtype != dns.TypeOPT })
+			if got := records(resp.Extra); got != tt.wantExtra {
+				t.Errorf("additional %q, want %q", got, tt.wantExtra)
+			}
+		})
+	}
+}
+
+func TestSanitizerTTLClamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max time.Duration
+		ttl      uint32
+		want     uint32
+		soa      uint32 // negative caching TTL is never raised
+	}{
+		{name: "no clamp", ttl: 5, want: 5, soa: 5},
+		{name: "raised to minimum", min: time.Minute, ttl: 5, want: 60, soa: 5},
+		{name: "lowered to maximum", max: time.Hour, ttl: 86400, want: 3600, soa: 3600},
+		{name: "inside the range", min: time.Minute, max: time.Hour, ttl: 300, want: 300, soa: 300},
+		{name: "zero TTL raised", min: 30 * time.Second, ttl: 0, want: 30, soa: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSanitizer(config.SanitizeConfig{MinTTL: tt.min, MaxTTL: tt.max})
+			resp := new(dns.Msg)
+			resp.SetQuestion("example.com.", dns.TypeA)
+			resp.Answer = []dns.RR{mustRR(t, "example.com. 60 IN A 192.0.2.1")}
+			resp.Ns = []dns.RR{
+				mustRR(t, "example.com. 60 IN NS ns1.example.com."),
+				mustRR(t, "example.com. 60 IN SOA ns1.example.com. admin.example.com. 1 3600 600 86400 60"),
+			}
+			resp.Answer[0].Header().Ttl = tt.ttl
+			resp.Ns[0].Header().Ttl = tt.ttl
+			resp.Ns[1].Header().Ttl = tt.ttl
+			resp.SetEdns0(1232, false)
+
+			if err := s.Apply(resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Answer[0].Header().Ttl; got != tt.want {
+				t.Errorf("answer TTL %d, want %d", got, tt.want)
+			}
+			if got := resp.Ns[0].Header().Ttl; got != tt.want {
+				t.Errorf("authority TTL %d, want %d", got, tt.want)
+			}
+			if got := resp.Ns[1].Header().Ttl; got != tt.soa {
+				t.Errorf("SOA TTL %d, want %d", got, tt.soa)
+			}
+			// The OPT header carries flags in its TTL field
+			if opt := resp.IsEdns0(); opt.Hdr.Ttl != 0 {
+				t.Errorf("OPT TTL changed to %d", opt.Hdr.Ttl)
+			}
+		})
+	}
+}
+
+func TestSanitizerSizeLimit(t *testing.T) {
+	s := NewSanitizer(config.SanitizeConfig{MaxRecords: 10})
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	if err := s.Apply(bigResponse(req, 10)); err != nil {
+		t.Fatalf("answer at the limit rejected: %v", err)
+	}
+	if err := s.Apply(bigResponse(req, 11)); err == nil {
+		t.Fatal("oversized answer accepted")
+	}
+}
+
+func TestForwardRetriesRebinding(t *testing.T) {
+	answering := func(addr string) *fakeUpstream {
+		u := newFakeUpstream()
+		u.answer[dns.TypeA] = []dns.RR{mustRR(t, "www.example.com. 60 IN A "+addr)}
+		return u
+	}
+
+	tests := []struct {
+		name      string
+		upstreams []Upstream
+		want      string // answered address, empty when blocked
+	}{
+		{name: "poisoned upstream skipped", upstreams: []Upstream{answering("192.168.1.1"), answering("192.0.2.1")}, want: "192.0.2.1"},
+		{name: "every upstream rebinds", upstreams: []Upstream{answering("192.168.1.1"), answering("10.0.0.1")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewResolver(config.DNSConfig{CacheSize: 100, CacheTTL: 300, RebindingProtection: true, BlockMode: BlockModeRefused})
+			r.profiles[DefaultProfile].upstreams = tt.upstreams
+
+			w := newRecorder()
+			r.ServeDNS(w, question("www.example.com.", dns.TypeA, dns.ClassINET))
+			if tt.want == "" {
+				if w.msg == nil || w.msg.Rcode != dns.RcodeRefused {
+					t.Fatalf("got %v, want the rebinding answer blocked", w.msg)
+				}
+				return
+			}
+			if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != tt.want {
+				t.Fatalf("got %v, want %s", w.msg, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Schedule blocks its domains while the daily window is open.
+type Schedule struct {
+	Name     string
+	days     map[time.Weekday]bool
+	start    int // minutes since midnight
+	end      int
+	filter   *Filter
+	profiles map[string]bool
+	cfg      config.ScheduleConfig
+}
+
+type ScheduleStatus struct {
+	config.ScheduleConfig
+	Active bool `json:"active"`
+}
+
+type Scheduler struct {
+	schedules []*Schedule
+	loc       *time.Location
+	clock     Clock
+}
+
+func NewScheduler(schedules []config.ScheduleConfig, timezone string, clock Clock) (*Scheduler, error) {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %v", err)
+	}
+
+	s := &Scheduler{loc: loc, clock: clock}
+	for _, cfg := range schedules {
+		sched, err := newSchedule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %v", cfg.Name, err)
+		}
+		s.schedules = append(s.schedules, sched)
+	}
+
+	return s, nil
+}
+
+func newSchedule(cfg config.ScheduleConfig) (*Schedule, error) {
+	start, err := parseClock(cfg.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(cfg.End)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := NewFilter(nil, nil, true)
+	filter.AddList("schedule/"+cfg.Name, false, cfg.Blocklist)
+
+	s := &Schedule{
+		Name:     cfg.Name,
+		days:     make(map[time.Weekday]bool),
+		start:    start,
+		end:      end,
+		filter:   filter,
+		profiles: make(map[string]bool),
+		cfg:      cfg,
+	}
+
+	for _, day := range cfg.Days {
+		wd, ok := config.Weekdays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", day)
+		}
+		s.days[wd] = true
+	}
+	for _, p := range cfg.Profiles {
+		s.profiles[p] = true
+	}
+
+	return s, nil
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ActiveAt reports whether the window is open at t. Windows ending before
+// they start span midnight and belong to the day they started on; equal
+// start and end make a 24 hour window.
+func (s *Schedule) ActiveAt(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	var inWindow bool
+	if s.start < s.end {
+		inWindow = minute >= s.start && minute < s.end
+	} else {
+		inWindow = minute >= s.start || minute < s.end
+		if minute < s.end {
+			day = (day + 6) % 7
+		}
+	}
+
+	return inWindow && (len(s.days) == 0 || s.days[day])
+}
+
+func (s *Schedule) appliesTo(profile string) bool {
+	return len(s.profiles) == 0 || s.profiles[profile]
+}
+
+// Match returns the most specific rule of the active schedules of profile.
+func (s *Scheduler) Match(profile, domain string) Decision {
+	now := s.clock.Now().In(s.loc)
+
+	var decision Decision
+	for _, sched := range s.schedules {
+		if sched.appliesTo(profile) && sched.ActiveAt(now) {
+			decision = prefer(decision, sched.filter.IsBlocked(domain))
+		}
+	}
+	return decision
+}
+
+func (s *Scheduler) Status() []ScheduleStatus {
+	now := s.clock.Now().In(s.loc)
+
+	out := make([]ScheduleStatus, 0, len(s.schedules))
+	for _, sched := range s.schedules {
+		out = append(out, ScheduleStatus{
+			ScheduleConfig: sched.cfg,
+			Active:         sched.ActiveAt(now),
+		})
+	}
+	return out
+}
@@ -0,0 +1,172 @@
+package dnsresolver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestSchedulerMatch(t *testing.T) {
+	schedules := []config.ScheduleConfig{
+		{
+			Name:      "work-hours",
+			Days:      []string{"mon", "tue", "wed", "thu", "fri"},
+			Start:     "09:00",
+			End:       "17:00",
+			Blocklist: []string{"facebook.com"},
+		},
+		{
+			Name:      "bedtime",
+			Start:     "22:00",
+			End:       "06:00",
+			Blocklist: []string{"youtube.com"},
+			Profiles:  []string{"kids"},
+		},
+	}
+
+	moscow, _ := time.LoadLocation("Europe/Moscow")
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		profile  string
+		domain   string
+		schedule string
+		blocked  bool
+	}{
+		{"weekday inside window", time.Date(2024, 3, 4, 10, 0, 0, 0, moscow), "default", "facebook.com", "work-hours", true},
+		{"subdomain inside window", time.Date(2024, 3, 4, 10, 0, 0, 0, moscow), "default", "m.facebook.com", "work-hours", true},
+		{"weekday before window", time.Date(2024, 3, 4, 8, 59, 0, 0, moscow), "default", "facebook.com", "", false},
+		{"window end is exclusive", time.Date(2024, 3, 4, 17, 0, 0, 0, moscow), "default", "facebook.com", "", false},
+		{"weekend", time.Date(2024, 3, 9, 10, 0, 0, 0, moscow), "default", "facebook.com", "", false},
+		{"clock in UTC is converted", time.Date(2024, 3, 4, 6, 30, 0, 0, time.UTC), "default", "facebook.com", "work-hours", true},
+		{"unrelated domain", time.Date(2024, 3, 4, 10, 0, 0, 0, moscow), "default", "example.com", "", false},
+		{"overnight before midnight", time.Date(2024, 3, 4, 23, 0, 0, 0, moscow), "kids", "youtube.com", "bedtime", true},
+		{"overnight after midnight", time.Date(2024, 3, 5, 5, 59, 0, 0, moscow), "kids", "youtube.com", "bedtime", true},
+		{"overnight after end", time.Date(2024, 3, 5, 6, 0, 0, 0, moscow), "kids", "youtube.com", "", false},
+		{"other profile", time.Date(2024, 3, 4, 23, 0, 0, 0, moscow), "default", "youtube.com", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewScheduler(schedules, "Europe/Moscow", &fakeClock{now: tt.now})
+			if err != nil {
+				t.Fatalf("NewScheduler: %v", err)
+			}
+
+			d := s.Match(tt.profile, tt.domain)
+			schedule := strings.TrimPrefix(d.List, "schedule/")
+			if d.Blocked != tt.blocked || schedule != tt.schedule {
+				t.Errorf("Match(%q, %q) = %q, %v; want %q, %v",
+					tt.profile, tt.domain, schedule, d.Blocked, tt.schedule, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestSchedulerOvernightFollowsStartDay(t *testing.T) {
+	schedules := []config.ScheduleConfig{
+		{Name: "friday-night", Days: []string{"fri"}, Start: "22:00", End: "02:00", Blocklist: []string{"game.com"}},
+	}
+	clock := &fakeClock{}
+
+	s, err := NewScheduler(schedules, "UTC", clock)
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	// Saturday 01:00 still belongs to the Friday window
+	clock.now = time.Date(2024, 3, 9, 1, 0, 0, 0, time.UTC)
+	if !s.Match("default", "game.com").Blocked {
+		t.Error("expected Saturday 01:00 to be inside the Friday window")
+	}
+
+	// Friday 01:00 belongs to the Thursday window, which is not scheduled
+	clock.now = time.Date(2024, 3, 8, 1, 0, 0, 0, time.UTC)
+	if s.Match("default", "game.com").Blocked {
+		t.Error("expected Friday 01:00 to be outside the window")
+	}
+}
+
+func TestSchedulerFullDay(t *testing.T) {
+	schedules := []config.ScheduleConfig{
+		{Name: "weekend", Days: []string{"sat", "sun"}, Start: "00:00", End: "00:00", Blocklist: []string{"game.com"}},
+		{Name: "monday", Days: []string{"mon"}, Start: "09:00", End: "09:00", Blocklist: []string{"chat.com"}},
+	}
+	clock := &fakeClock{}
+
+	s, err := NewScheduler(schedules, "UTC", clock)
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	tests := []struct {
+		now     time.Time
+		domain  string
+		blocked bool
+	}{
+		{time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC), "game.com", true},
+		{time.Date(2024, 3, 10, 23, 59, 0, 0, time.UTC), "game.com", true},
+		{time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), "game.com", false},
+		{time.Date(2024, 3, 11, 8, 59, 0, 0, time.UTC), "chat.com", false},
+		{time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC), "chat.com", true},
+		{time.Date(2024, 3, 12, 8, 59, 0, 0, time.UTC), "chat.com", true},
+		{time.Date(2024, 3, 12, 9, 0, 0, 0, time.UTC), "chat.com", false},
+	}
+	for _, tt := range tests {
+		clock.now = tt.now
+		if got := s.Match("default", tt.domain).Blocked; got != tt.blocked {
+			t.Errorf("%s at %s: blocked %v, want %v", tt.domain, tt.now.Format(time.RFC1123), got, tt.blocked)
+		}
+	}
+}
+
+func TestSchedulerStatus(t *testing.T) {
+	schedules := []config.ScheduleConfig{
+		{Name: "morning", Start: "06:00", End: "12:00", Blocklist: []string{"a.com"}},
+		{Name: "evening", Start: "18:00", End: "23:00", Blocklist: []string{"b.com"}},
+	}
+
+	s, err := NewScheduler(schedules, "UTC", &fakeClock{now: time.Date(2024, 3, 4, 7, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	status := s.Status()
+	if len(status) != 2 {
+		t.Fatalf("got %d schedules, want 2", len(status))
+	}
+	if !status[0].Active || status[1].Active {
+		t.Errorf("got active = %v, %v; want true, false", status[0].Active, status[1].Active)
+	}
+}
+
+func TestNewSchedulerRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		timezone string
+		schedule config.ScheduleConfig
+	}{
+		{"bad timezone", "Mars/Olympus", config.ScheduleConfig{Name: "x", Start: "09:00", End: "10:00"}},
+		{"bad start", "UTC", config.ScheduleConfig{Name: "x", Start: "9am", End: "10:00"}},
+		{"bad day", "UTC", config.ScheduleConfig{Name: "x", Days: []string{"someday"}, Start: "09:00", End: "10:00"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewScheduler([]config.ScheduleConfig{tt.schedule}, tt.timezone, systemClock{}); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
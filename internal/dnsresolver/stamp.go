@@ -0,0 +1,193 @@
+package dnsresolver
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const stampPrefix = "sdns://"
+
+// Stamp protocol identifiers, see https://dnscrypt.info/stamps-specifications
+const (
+	stampPlain      = 0x00
+	stampDNSCrypt   = 0x01
+	stampDoH        = 0x02
+	stampDoT        = 0x03
+	stampODoHTarget = 0x05
+	stampODoHRelay  = 0x85
+)
+
+// serverStamp is a decoded sdns:// stamp. Fields a protocol does not use
+// stay empty.
+type serverStamp struct {
+	proto        byte
+	props        uint64 // DNSSEC, no logs, no filter bits
+	addr         string // host:port, may be empty for DoH
+	providerKey  []byte // DNSCrypt provider Ed25519 key
+	providerName string // DNSCrypt provider name, e.g. 2.dnscrypt-cert.example.com
+	hashes       [][]byte
+	hostname     string
+	path         string
+}
+
+func isStamp(s string) bool {
+	return strings.HasPrefix(s, stampPrefix)
+}
+
+func parseStamp(s string) (*serverStamp, error) {
+	encoded, ok := strings.CutPrefix(s, stampPrefix)
+	if !ok {
+		return nil, fmt.Errorf("stamp must start with %s", stampPrefix)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp encoding: %v", err)
+	}
+	if len(data) < 1 {
+		return nil, fmt.Errorf("empty stamp")
+	}
+
+	r := &stampReader{data: data[1:]}
+	stamp := &serverStamp{proto: data[0], props: r.props()}
+
+	switch stamp.proto {
+	case stampPlain:
+		stamp.addr = stampAddr(r.lp(), 53)
+	case stampDNSCrypt:
+		stamp.addr = stampAddr(r.lp(), 443)
+		stamp.providerKey = r.lp()
+		stamp.providerName = strings.TrimSuffix(string(r.lp()), ".")
+		if r.err == nil && len(stamp.providerKey) != 32 {
+			return nil, fmt.Errorf("invalid dnscrypt provider key length %d", len(stamp.providerKey))
+		}
+	case stampDoH, stampODoHRelay:
+		stamp.addr = stampAddr(r.lp(), 443)
+		stamp.hashes = r.vlp()
+		stamp.hostname = string(r.lp())
+		stamp.path = string(r.lp())
+		r.vlp() // bootstrap resolvers, we use the system ones
+	case stampDoT:
+		stamp.addr = stampAddr(r.lp(), 853)
+		stamp.hashes = r.vlp()
+		stamp.hostname = string(r.lp())
+		r.vlp()
+	case stampODoHTarget:
+		stamp.hostname = string(r.lp())
+		stamp.path = string(r.lp())
+	default:
+		return nil, fmt.Errorf("unsupported stamp protocol 0x%02x", stamp.proto)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return stamp, nil
+}
+
+// url is the HTTPS endpoint of DoH and ODoH stamps.
+func (s *serverStamp) url() string {
+	return "https://" + s.hostname + s.path
+}
+
+// tlsAddr is the address to dial for DoT: the stamp address, or the host
+// name when the stamp has none.
+func (s *serverStamp) tlsAddr() string {
+	if s.addr != "" {
+		return s.addr
+	}
+	return stampAddr([]byte(s.hostname), 853)
+}
+
+// stampAddr adds the default port to stamp addresses that omit it.
+func stampAddr(addr []byte, port int) string {
+	a := string(addr)
+	if a == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(a); err == nil {
+		return a
+	}
+	return net.JoinHostPort(strings.Trim(a, "[]"), fmt.Sprint(port))
+}
+
+// stampReader reads the length prefixed fields of a stamp. The first error
+// sticks and later reads return nothing.
+type stampReader struct {
+	data []byte
+	err  error
+}
+
+func (r *stampReader) props() uint64 {
+	if r.err != nil || len(r.data) < 8 {
+		r.fail()
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *stampReader) lp() []byte {
+	if r.err != nil || len(r.data) < 1 || len(r.data) < 1+int(r.data[0]) {
+		r.fail()
+		return nil
+	}
+	n := int(r.data[0])
+	v := r.data[1 : 1+n]
+	r.data = r.data[1+n:]
+	return v
+}
+
+// vlp reads a set of values whose length bytes have the high bit set while
+// more values follow. Optional trailing sets may be missing entirely.
+func (r *stampReader) vlp() [][]byte {
+	if r.err != nil || len(r.data) == 0 {
+		return nil
+	}
+
+	var values [][]byte
+	for {
+		if len(r.data) < 1 {
+			r.fail()
+			return nil
+		}
+		more := r.data[0]&0x80 != 0
+		n := int(r.data[0] &^ 0x80)
+		if len(r.data) < 1+n {
+			r.fail()
+			return nil
+		}
+		if n > 0 {
+			values = append(values, r.data[1:1+n])
+		}
+		r.data = r.data[1+n:]
+		if !more {
+			return values
+		}
+	}
+}
+
+func (r *stampReader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("truncated stamp")
+	}
+}
+
+// stampURL returns s unchanged unless it is a stamp of proto, which is
+// turned into its HTTPS endpoint.
+func stampURL(s string, proto byte) (string, error) {
+	if !isStamp(s) {
+		return s, nil
+	}
+	stamp, err := parseStamp(s)
+	if err != nil {
+		return "", err
+	}
+	if stamp.proto != proto {
+		return "", fmt.Errorf("unexpected stamp protocol 0x%02x", stamp.proto)
+	}
+	return stamp.url(), nil
+}
@@ -0,0 +1,106 @@
+package dnsresolver
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// rawStamp encodes data as an sdns:// stamp.
+func rawStamp(data []byte) string {
+	return stampPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// dnscryptStampData is a DNSCrypt stamp before encoding.
+func dnscryptStampData(addr string, key []byte, providerName string) []byte {
+	data := []byte{stampDNSCrypt}
+	data = binary.LittleEndian.AppendUint64(data, 0)
+	data = append(append(data, byte(len(addr))), addr...)
+	data = append(append(data, byte(len(key))), key...)
+	return append(append(data, byte(len(providerName))), providerName...)
+}
+
+func TestParseStamp(t *testing.T) {
+	tests := []struct {
+		name  string
+		stamp string
+		want  serverStamp
+		key   string
+	}{
+		{
+			name:  "Cloudflare DoH",
+			stamp: "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5",
+			want:  serverStamp{proto: stampDoH, props: 7, addr: "1.0.0.1:443", hostname: "dns.cloudflare.com", path: "/dns-query"},
+		},
+		{
+			name:  "Scaleway DNSCrypt",
+			stamp: "sdns://AQcAAAAAAAAADjIxMi40Ny4yMjguMTM2IOgBuE6mBr-wusDOQ0RbsV66ZLAvo8SqMa4QY2oHkDJNHzIuZG5zY3J5cHQtY2VydC5mci5kbnNjcnlwdC5vcmc",
+			want:  serverStamp{proto: stampDNSCrypt, props: 7, addr: "212.47.228.136:443", providerName: "2.dnscrypt-cert.fr.dnscrypt.org"},
+			key:   "e801b84ea606bfb0bac0ce43445bb15eba64b02fa3c4aa31ae10636a0790324d",
+		},
+		{
+			name:  "AdGuard DNSCrypt with port",
+			stamp: "sdns://AQMAAAAAAAAAETk0LjE0MC4xNC4xNDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20",
+			want:  serverStamp{proto: stampDNSCrypt, props: 3, addr: "94.140.14.14:5443", providerName: "2.dnscrypt.default.ns1.adguard.com"},
+			key:   "d12b47f252dcf2c2bbf8991086eaf79ce4495d8b16c8a0c4322e52ca3f390873",
+		},
+		{
+			name:  "Quad9 DoT",
+			stamp: "sdns://AwMAAAAAAAAABzkuOS45LjkADWRucy5xdWFkOS5uZXQ",
+			want:  serverStamp{proto: stampDoT, props: 3, addr: "9.9.9.9:853", hostname: "dns.quad9.net"},
+		},
+		{
+			name:  "IPv6 address",
+			stamp: rawStamp(dnscryptStampData("[2001:db8::1]", make([]byte, 32), "2.dnscrypt-cert.example.")),
+			want:  serverStamp{proto: stampDNSCrypt, addr: "[2001:db8::1]:443", providerName: "2.dnscrypt-cert.example"},
+			key:   strings.Repeat("00", 32),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStamp(tt.stamp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key := hex.EncodeToString(got.providerKey); key != tt.key {
+				t.Fatalf("provider key %s, want %s", key, tt.key)
+			}
+			got.providerKey = nil
+			if got.proto != tt.want.proto || got.props != tt.want.props || got.addr != tt.want.addr ||
+				got.providerName != tt.want.providerName || got.hostname != tt.want.hostname || got.path != tt.want.path {
+				t.Fatalf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStampErrors(t *testing.T) {
+	dnscrypt := dnscryptStampData("192.0.2.1", make([]byte, 32), "2.dnscrypt-cert.example")
+
+	tests := []struct {
+		name  string
+		stamp string
+		err   string
+	}{
+		{name: "no prefix", stamp: "https://dns.example/dns-query", err: "must start with"},
+		{name: "bad encoding", stamp: stampPrefix + "!!!", err: "invalid stamp encoding"},
+		{name: "empty", stamp: stampPrefix, err: "empty stamp"},
+		{name: "truncated props", stamp: rawStamp(dnscrypt[:5]), err: "truncated"},
+		{name: "truncated key", stamp: rawStamp(dnscrypt[:25]), err: "truncated"},
+		{name: "truncated provider name", stamp: rawStamp(dnscrypt[:len(dnscrypt)-1]), err: "truncated"},
+		{name: "short key", stamp: rawStamp(dnscryptStampData("192.0.2.1", make([]byte, 16), "2.dnscrypt-cert.example")), err: "key length 16"},
+		{name: "unknown protocol", stamp: rawStamp([]byte{0x04, 0, 0, 0, 0, 0, 0, 0, 0}), err: "unsupported stamp protocol"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseStamp(tt.stamp)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
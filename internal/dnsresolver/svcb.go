@@ -0,0 +1,70 @@
+package dnsresolver
+
+import (
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/miekg/dns"
+)
+
+const (
+	SVCBPolicyKeep     = "keep"
+	SVCBPolicyStripECH = "strip_ech"
+	SVCBPolicyDrop     = "drop"
+)
+
+// svcbData returns the fields shared by SVCB and HTTPS records.
+func svcbData(rr dns.RR) (*dns.SVCB, bool) {
+	switch v := rr.(type) {
+	case *dns.SVCB:
+		return v, true
+	case *dns.HTTPS:
+		return &v.SVCB, true
+	}
+	return nil, false
+}
+
+// filterSVCB applies the profile to the SVCB and HTTPS records of resp:
+// records pointing at blocked targets are removed, then the ech key or the
+// records themselves as the policy says. It runs on every answer given out,
+// cached ones included, because the cache is shared between profiles.
+func (r *Resolver) filterSVCB(profile *Profile, resp *dns.Msg) {
+	resp.Answer = r.filterSVCBRecords(profile, resp.Answer)
+	resp.Extra = r.filterSVCBRecords(profile, resp.Extra)
+}
+
+func (r *Resolver) filterSVCBRecords(profile *Profile, rrs []dns.RR) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		svcb, ok := svcbData(rr)
+		if !ok {
+			kept = append(kept, rr)
+			continue
+		}
+		if profile.svcbPolicy == SVCBPolicyDrop {
+			continue
+		}
+
+		// "." in service mode means the owner name, which passed the filter
+		if svcb.Target != "." {
+			if d := r.decide(profile, svcb.Target); d.Blocked {
+				logger.Debugf("Dropped %s record for %s: target %s blocked by %s", dns.TypeToString[svcb.Hdr.Rrtype], svcb.Hdr.Name, svcb.Target, d.Rule)
+				continue
+			}
+		}
+
+		if profile.svcbPolicy == SVCBPolicyStripECH {
+			stripSVCBKey(svcb, dns.SVCB_ECHCONFIG)
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+func stripSVCBKey(svcb *dns.SVCB, key dns.SVCBKey) {
+	kept := svcb.Value[:0]
+	for _, kv := range svcb.Value {
+		if kv.Key() != key {
+			kept = append(kept, kv)
+		}
+	}
+	svcb.Value = kept
+}
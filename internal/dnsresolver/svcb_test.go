@@ -0,0 +1,129 @@
+package dnsresolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/miekg/dns"
+)
+
+const svcbTestRecord = `example.com. 60 IN HTTPS 1 . alpn="h2" ech="aGVsbG8="`
+
+// hasECH reports whether any SVCB or HTTPS record of rrs carries an ech key.
+func hasECH(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if svcb, ok := svcbData(rr); ok {
+			for _, kv := range svcb.Value {
+				if kv.Key() == dns.SVCB_ECHCONFIG {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func TestFilterSVCB(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		answer []string
+		want   []string
+	}{
+		{
+			name:   "keep",
+			policy: SVCBPolicyKeep,
+			answer: []string{svcbTestRecord},
+			want:   []string{svcbTestRecord},
+		},
+		{
+			name:   "strip ech",
+			policy: SVCBPolicyStripECH,
+			answer: []string{svcbTestRecord, `example.com. 60 IN SVCB 1 svc.example.net. ech="aGVsbG8=" port="8443"`},
+			want:   []string{`example.com. 60 IN HTTPS 1 . alpn="h2"`, `example.com. 60 IN SVCB 1 svc.example.net. port="8443"`},
+		},
+		{
+			name:   "drop",
+			policy: SVCBPolicyDrop,
+			answer: []string{"example.com. 60 IN CNAME cdn.example.net.", svcbTestRecord},
+			want:   []string{"example.com. 60 IN CNAME cdn.example.net."},
+		},
+		{
+			name:   "blocked target dropped",
+			policy: SVCBPolicyKeep,
+			answer: []string{`example.com. 60 IN HTTPS 1 edge.ads.example.net. alpn="h2"`, `example.com. 60 IN HTTPS 2 cdn.example.net. alpn="h2"`},
+			want:   []string{`example.com. 60 IN HTTPS 2 cdn.example.net. alpn="h2"`},
+		},
+		{
+			name:   "alias to blocked target dropped",
+			policy: SVCBPolicyKeep,
+			answer: []string{`example.com. 60 IN HTTPS 0 ads.example.net.`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewResolver(config.DNSConfig{
+				CacheSize:       100,
+				CacheTTL:        300,
+				EnableFiltering: true,
+				Blocklist:       []string{"ads.example.net"},
+				SVCBPolicy:      tt.policy,
+			})
+
+			resp := new(dns.Msg)
+			var want []dns.RR
+			for _, s := range tt.answer {
+				resp.Answer = append(resp.Answer, mustRR(t, s))
+				resp.Extra = append(resp.Extra, mustRR(t, s))
+			}
+			for _, s := range tt.want {
+				want = append(want, mustRR(t, s))
+			}
+
+			r.filterSVCB(r.profiles[DefaultProfile], resp)
+			if got := rrStrings(resp.Answer); got != rrStrings(want) {
+				t.Fatalf("answer:\n%s\nwant:\n%s", got, rrStrings(want))
+			}
+			if got := rrStrings(resp.Extra); got != rrStrings(want) {
+				t.Fatalf("additional:\n%s\nwant:\n%s", got, rrStrings(want))
+			}
+		})
+	}
+}
+
+func TestFilterSVCBSharedCache(t *testing.T) {
+	r := NewResolver(config.DNSConfig{
+		CacheSize: 100,
+		CacheTTL:  300,
+		Profiles:  []config.ProfileConfig{{Name: "strict", SVCBPolicy: SVCBPolicyStripECH}},
+		Clients:   []config.ClientConfig{{Name: "tablet", IDs: []string{"192.168.1.3"}, Profile: "strict"}},
+	})
+	upstream := newFakeUpstream()
+	upstream.answer[dns.TypeHTTPS] = []dns.RR{mustRR(t, svcbTestRecord)}
+	for _, profile := range r.profiles {
+		profile.upstreams = []Upstream{upstream}
+	}
+
+	resolve := func(client net.IP) *dns.Msg {
+		t.Helper()
+		w := newRecorder()
+		w.remote = &net.UDPAddr{IP: client, Port: 40000}
+		r.ServeDNS(w, question("example.com.", dns.TypeHTTPS, dns.ClassINET))
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("answer for %s: %v", client, w.msg)
+		}
+		return w.msg
+	}
+
+	keep, strict := net.IPv4(192, 168, 1, 2), net.IPv4(192, 168, 1, 3)
+	for i, client := range []net.IP{strict, keep, strict, keep} {
+		if got, want := hasECH(resolve(client).Answer), client.Equal(keep); got != want {
+			t.Fatalf("query %d from %s: ech %v, want %v", i, client, got, want)
+		}
+	}
+	if got := upstream.count(dns.TypeHTTPS); got != 1 {
+		t.Fatalf("%d upstream queries, want 1 from the shared cache", got)
+	}
+}
@@ -0,0 +1,240 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/miekg/dns"
+)
+
+type Upstream interface {
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+	Address() string
+}
+
+// newUpstreams builds the upstream list in the order they are tried.
+// Entries of dot and doh may also be sdns:// stamps, dnscrypt takes only
+// stamps.
+func newUpstreams(dot, doh, dnscrypt []string, odoh []config.ODoHConfig, timeout time.Duration, ecs config.ECSConfig) []Upstream {
+	upstreams := make([]Upstream, 0, len(odoh)+len(dnscrypt)+len(dot)+len(doh))
+
+	// Oblivious DoH first when configured, it hides our address from the
+	// resolver
+	client := &http.Client{Timeout: timeout}
+	for _, o := range odoh {
+		u, err := newODoHUpstream(o.Target, o.Relay, client)
+		if err != nil {
+			logger.Errorf("Skipping ODoH upstream: %v", err)
+			continue
+		}
+		upstreams = append(upstreams, &ecsUpstream{u, policyFor(ecs, o.Target)})
+	}
+
+	// Stamps pick their own protocol, other entries use the list's
+	add := func(addr string, build func() Upstream) {
+		u := Upstream(nil)
+		if isStamp(addr) {
+			var err error
+			if u, err = stampUpstream(addr, client, timeout); err != nil {
+				logger.Errorf("Skipping upstream: %v", err)
+				return
+			}
+		} else if build != nil {
+			u = build()
+		} else {
+			logger.Errorf("Skipping upstream %q: not an sdns:// stamp", addr)
+			return
+		}
+		upstreams = append(upstreams, &ecsUpstream{u, policyFor(ecs, addr)})
+	}
+
+	// Then DNSCrypt, DNS-over-TLS and DNS-over-HTTPS as fallback
+	for _, stamp := range dnscrypt {
+		add(stamp, nil)
+	}
+	for _, addr := range dot {
+		add(addr, func() Upstream { return newDoTUpstream(addr, "", nil, timeout) })
+	}
+	for _, url := range doh {
+		add(url, func() Upstream { return newDoHUpstream(url, nil, client) })
+	}
+
+	return upstreams
+}
+
+// stampUpstream builds the upstream an sdns:// stamp describes.
+func stampUpstream(s string, client *http.Client, timeout time.Duration) (Upstream, error) {
+	stamp, err := parseStamp(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch stamp.proto {
+	case stampDNSCrypt:
+		return newDNSCryptUpstream(stamp, timeout), nil
+	case stampDoT:
+		return newDoTUpstream(stamp.tlsAddr(), stamp.hostname, stamp.hashes, timeout), nil
+	case stampDoH:
+		return newDoHUpstream(stamp.url(), stamp.hashes, client), nil
+	default:
+		// plain DNS would leak queries, ODoH stamps go to odoh_upstreams
+		return nil, fmt.Errorf("stamp protocol 0x%02x cannot be used here", stamp.proto)
+	}
+}
+
+// verifyPins accepts a chain when one of its certificates has a pinned
+// SHA-256 digest of the TBS part, as listed in stamps.
+func verifyPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				digest := sha256.Sum256(cert.RawTBSCertificate)
+				for _, pin := range pins {
+					if bytes.Equal(digest[:], pin) {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("no certificate matches the pinned hashes")
+	}
+}
+
+type dotUpstream struct {
+	addr   string
+	client *dns.Client
+}
+
+// newDoTUpstream dials addr; serverName and pins come from stamps and may
+// be empty.
+func newDoTUpstream(addr, serverName string, pins [][]byte, timeout time.Duration) *dotUpstream {
+	return &dotUpstream{
+		addr: addr,
+		client: &dns.Client{
+			Net:     "tcp-tls",
+			Timeout: timeout,
+			TLSConfig: &tls.Config{
+				MinVersion:            tls.VersionTLS12,
+				ServerName:            serverName,
+				VerifyPeerCertificate: verifyPins(pins),
+			},
+		},
+	}
+}
+
+func (u *dotUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.client.Exchange(padQuery(req), u.addr)
+	return resp, err
+}
+
+func (u *dotUpstream) Address() string {
+	return "tls://" + u.addr
+}
+
+// plainUpstream is a resolver on the local network, queried over UDP with
+// a TCP retry for truncated answers.
+type plainUpstream struct {
+	addr string
+	udp  *dns.Client
+	tcp  *dns.Client
+}
+
+func newPlainUpstream(addr string, timeout time.Duration) *plainUpstream {
+	return &plainUpstream{
+		addr: addr,
+		udp:  &dns.Client{Net: "udp", Timeout: timeout, UDPSize: ednsBufferSize},
+		tcp:  &dns.Client{Net: "tcp", Timeout: timeout},
+	}
+}
+
+func (u *plainUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.udp.Exchange(req, u.addr)
+	if err == nil && resp.Truncated {
+		resp, _, err = u.tcp.Exchange(req, u.addr)
+	}
+	return resp, err
+}
+
+func (u *plainUpstream) Address() string {
+	return "udp://" + u.addr
+}
+
+// dohUpstream speaks RFC 8484, queries are POSTed as application/dns-message.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+// newDoHUpstream shares client with the other HTTPS upstreams unless pins
+// from a stamp need their own TLS configuration.
+func newDoHUpstream(url string, pins [][]byte, client *http.Client) *dohUpstream {
+	if len(pins) > 0 {
+		transport, ok := client.Transport.(*http.Transport)
+		if !ok {
+			transport = http.DefaultTransport.(*http.Transport)
+		}
+		transport = transport.Clone()
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		transport.TLSClientConfig.VerifyPeerCertificate = verifyPins(pins)
+		client = &http.Client{Transport: transport, Timeout: client.Timeout}
+	}
+	return &dohUpstream{url: url, client: client}
+}
+
+func (u *dohUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	// ID 0 keeps answers cacheable by HTTP caches (RFC 8484 section 4.1)
+	query := padQuery(req)
+	query.Id = 0
+	wire, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohContentType)
+	httpReq.Header.Set("Accept", dohContentType)
+
+	httpResp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh upstream: %s", httpResp.Status)
+	}
+	if ct := httpResp.Header.Get("Content-Type"); ct != dohContentType {
+		return nil, fmt.Errorf("doh upstream: unexpected content type %q", ct)
+	}
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(data); err != nil {
+		return nil, fmt.Errorf("doh upstream: %v", err)
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+func (u *dohUpstream) Address() string {
+	return u.url
+}
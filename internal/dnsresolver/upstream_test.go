@@ -0,0 +1,116 @@
+package dnsresolver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohStamp encodes a DoH server stamp for host and path.
+func dohStamp(host, path string, hashes ...[]byte) string {
+	data := []byte{stampDoH}
+	data = binary.LittleEndian.AppendUint64(data, 0)
+	data = append(data, 0) // no address, the host name is resolved
+	if len(hashes) == 0 {
+		data = append(data, 0)
+	}
+	for i, h := range hashes {
+		n := byte(len(h))
+		if i < len(hashes)-1 {
+			n |= 0x80
+		}
+		data = append(append(data, n), h...)
+	}
+	data = append(append(data, byte(len(host))), host...)
+	data = append(append(data, byte(len(path))), path...)
+	data = append(data, 0) // no bootstrap resolvers
+	return stampPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+func newDoHServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != DoHPath || r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil || req.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   []byte{192, 0, 2, 1},
+		})
+		wire, _ := resp.Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(wire)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDoHUpstream(t *testing.T) {
+	srv := newDoHServer(t)
+	host := func() string {
+		u, _ := url.Parse(srv.URL)
+		return u.Host
+	}()
+	pin := sha256.Sum256(srv.Certificate().RawTBSCertificate)
+	wrong := sha256.Sum256([]byte("another certificate"))
+
+	tests := []struct {
+		name    string
+		addr    string
+		wantErr bool
+	}{
+		{name: "URL", addr: srv.URL + DoHPath},
+		{name: "stamp", addr: dohStamp(host, DoHPath)},
+		{name: "stamp with matching pin", addr: dohStamp(host, DoHPath, wrong[:], pin[:])},
+		{name: "stamp with wrong pin", addr: dohStamp(host, DoHPath, wrong[:]), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var u Upstream = newDoHUpstream(tt.addr, nil, srv.Client())
+			if isStamp(tt.addr) {
+				var err error
+				if u, err = stampUpstream(tt.addr, srv.Client(), time.Second); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			resp, err := u.Exchange(req)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("pinned upstream accepted an unknown certificate")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Id != req.Id {
+				t.Fatalf("response ID %d, want %d", resp.Id, req.Id)
+			}
+			if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+				t.Fatalf("answer %v", resp.Answer)
+			}
+		})
+	}
+}
@@ -17,9 +17,10 @@ import (
 type DockerManager struct {
 	cli *client.Client
 	cfg config.DockerContainerConfig
+	dns config.DNSConfig
 }
 
-func NewDockerManager(cfg config.DockerContainerConfig) (*DockerManager, error) {
+func NewDockerManager(cfg config.DockerContainerConfig, dns config.DNSConfig) (*DockerManager, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create docker client: %v", err)
@@ -28,6 +29,7 @@ func NewDockerManager(cfg config.DockerContainerConfig) (*DockerManager, error)
 	return &DockerManager{
 		cli: cli,
 		cfg: cfg,
+		dns: dns,
 	}, nil
 }
 
@@ -50,41 +52,65 @@ func (dm *DockerManager) Start(ctx context.Context) error {
 }
 
 func (dm *DockerManager) createAndStart(ctx context.Context) error {
-	portStr := fmt.Sprintf("%d/udp", dm.cfg.Listen)
-	tcpPortStr := fmt.Sprintf("%d/tcp", dm.cfg.Listen+1)
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+
+	// Publish every DNS listen port, encrypted ones included, on the host
+	// loopback
+	publish := func(ports []int, proto string) {
+		for _, p := range ports {
+			port := nat.Port(fmt.Sprintf("%d/%s", p, proto))
+			exposed[port] = struct{}{}
+			bindings[port] = []nat.PortBinding{
+				{
+					HostIP:   "127.0.0.1",
+					HostPort: fmt.Sprintf("%d", p),
+				},
+			}
+		}
+	}
+	publish(dm.dns.UDPPorts(), "udp")
+	publish(dm.dns.TCPPorts(), "tcp")
+	publish(dm.dns.TLSPorts(), "tcp")
+	publish(dm.dns.APIPorts(), "tcp")
 
 	containerCfg := &container.Config{
-		Image: dm.cfg.Image,
-		ExposedPorts: nat.PortSet{
-			nat.Port(portStr):    struct{}{},
-			nat.Port(tcpPortStr): struct{}{},
-		},
+		Image:        dm.cfg.Image,
+		ExposedPorts: exposed,
 		Env: []string{
 			"LOG_LEVEL=info",
 		},
 	}
 
 	hostCfg := &container.HostConfig{
-		PortBindings: nat.PortMap{
-			nat.Port(portStr): []nat.PortBinding{
-				{
-					HostIP:   "127.0.0.1",
-					HostPort: fmt.Sprintf("%d", dm.cfg.Listen),
-				},
-			},
-			nat.Port(tcpPortStr): []nat.PortBinding{
-				{
-					HostIP:   "127.0.0.1",
-					HostPort: fmt.Sprintf("%d", dm.cfg.Listen+1),
-				},
-			},
-		},
+		PortBindings: bindings,
 		RestartPolicy: container.RestartPolicy{
 			Name: dm.cfg.RestartPolicy,
 		},
 		NetworkMode: container.NetworkMode(dm.cfg.Network),
 	}
 
+	// The DHCP server binds to the LAN interface and needs its broadcasts,
+	// which never reach a bridge network
+	if dm.dns.DHCP.Enabled && !hostCfg.NetworkMode.IsHost() {
+		logger.Infof("DHCP enabled, running %s on the host network", dm.cfg.Name)
+		hostCfg.NetworkMode = "host"
+	}
+	if dm.dns.DHCP.Enabled {
+		hostCfg.CapAdd = []string{"NET_ADMIN", "NET_RAW"}
+	}
+
+	if hostCfg.NetworkMode.IsHost() {
+		// Listen addresses are host addresses, nothing to publish
+		containerCfg.ExposedPorts = nil
+		hostCfg.PortBindings = nil
+	} else if ports := dm.dns.APIPorts(); len(ports) > 0 {
+		// The container loopback is not reachable through the published
+		// port, the API binds every container address and stays on the
+		// host loopback
+		containerCfg.Cmd = []string{"-api-listen", fmt.Sprintf(":%d", ports[0])}
+	}
+
 	resp, err := dm.cli.ContainerCreate(
 		ctx,
 		containerCfg,
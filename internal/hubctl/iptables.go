@@ -14,16 +14,22 @@ import (
 const DNSPort = 53
 
 type IPTablesManager struct {
-	targetPort int
-	active     bool
-	mu         sync.Mutex
+	udpPort int
+	tcpPort int
+	active  bool
+	mu      sync.Mutex
 }
 
-func NewIPTablesManager(cfg config.DockerContainerConfig) *IPTablesManager {
-	return &IPTablesManager{
-		targetPort: cfg.Listen,
-		active:     false,
+// NewIPTablesManager redirects DNS to the first UDP and TCP listen ports.
+func NewIPTablesManager(cfg config.DNSConfig) *IPTablesManager {
+	ipt := &IPTablesManager{active: false}
+	if ports := cfg.UDPPorts(); len(ports) > 0 {
+		ipt.udpPort = ports[0]
 	}
+	if ports := cfg.TCPPorts(); len(ports) > 0 {
+		ipt.tcpPort = ports[0]
+	}
+	return ipt
 }
 
 func (ipt *IPTablesManager) Setup() error {
@@ -35,16 +41,16 @@ func (ipt *IPTablesManager) Setup() error {
 		return nil
 	}
 
-	logger.Infof("Setting up DNS redirection to port %d", ipt.targetPort)
+	logger.Infof("Setting up DNS redirection to ports %d/udp and %d/tcp", ipt.udpPort, ipt.tcpPort)
 
 	rules := [][]string{
 		// Redirect UDP DNS queries
 		{"-t", "nat", "-A", "OUTPUT", "-p", "udp", "--dport", "53",
-			"-j", "REDIRECT", "--to-port", strconv.Itoa(ipt.targetPort)},
+			"-j", "REDIRECT", "--to-port", strconv.Itoa(ipt.udpPort)},
 
 		// Redirect TCP DNS queries
 		{"-t", "nat", "-A", "OUTPUT", "-p", "tcp", "--dport", "53",
-			"-j", "REDIRECT", "--to-port", strconv.Itoa(ipt.targetPort + 1)},
+			"-j", "REDIRECT", "--to-port", strconv.Itoa(ipt.tcpPort)},
 	}
 
 	for _, rule := range rules {
@@ -72,10 +78,10 @@ func (ipt *IPTablesManager) Cleanup() error {
 
 	rules := [][]string{
 		{"-t", "nat", "-D", "OUTPUT", "-p", "udp", "--dport", "53",
-			"-j", "REDIRECT", "--to-port", strconv.Itoa(ipt.targetPort)},
+			"-j", "REDIRECT", "--to-port", strconv.Itoa(ipt.udpPort)},
 
 		{"-t", "nat", "-D", "OUTPUT", "-p", "tcp", "--dport", "53",
-			"-j", "REDIRECT", "--to-port", strconv.Itoa(ipt.targetPort + 1)},
+			"-j", "REDIRECT", "--to-port", strconv.Itoa(ipt.tcpPort)},
 	}
 
 	for _, rule := range rules {
@@ -0,0 +1,206 @@
+package identity
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+)
+
+const (
+	SourceStatic = "static"
+	SourceLease  = "lease"
+	SourceARP    = "arp"
+
+	defaultRefresh = 1 * time.Minute
+	arpTable       = "/proc/net/arp"
+)
+
+// Client is what is known about the host behind an address.
+type Client struct {
+	IP     string `json:"ip"`
+	Name   string `json:"name,omitempty"`
+	MAC    string `json:"mac,omitempty"`
+	Source string `json:"source"`
+}
+
+// Label is the name of the client when known, its address otherwise.
+func (c Client) Label() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.IP
+}
+
+// Registry maps client addresses to names and MACs from DHCP lease files,
+// the ARP table and static definitions. Lease files and the ARP table are
+// reread periodically.
+type Registry struct {
+	cfg     config.ClientIdentityConfig
+	arpPath string
+	byIP    map[netip.Addr]Client
+	done    chan struct{}
+	mu      sync.RWMutex
+}
+
+func New(cfg config.ClientIdentityConfig) *Registry {
+	r := &Registry{
+		cfg:     cfg,
+		arpPath: arpTable,
+		byIP:    make(map[netip.Addr]Client),
+		done:    make(chan struct{}),
+	}
+
+	for _, err := range r.Refresh() {
+		logger.Errorf("Client identity: %v", err)
+	}
+
+	if len(cfg.LeaseFiles) > 0 || cfg.ARP {
+		go r.refreshLoop()
+	}
+
+	return r
+}
+
+// Lookup returns the client at addr. It is safe to call on a nil Registry.
+func (r *Registry) Lookup(addr netip.Addr) (Client, bool) {
+	if r == nil {
+		return Client{}, false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.byIP[addr.Unmap()]
+	return c, ok
+}
+
+// List returns all known clients ordered by address.
+func (r *Registry) List() []Client {
+	r.mu.RLock()
+	addrs := make([]netip.Addr, 0, len(r.byIP))
+	for addr := range r.byIP {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+
+	list := make([]Client, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, r.byIP[addr])
+	}
+	r.mu.RUnlock()
+
+	return list
+}
+
+// Refresh rereads all sources and returns the errors of those that failed.
+// Entries of a failed source are dropped until it can be read again.
+func (r *Registry) Refresh() []error {
+	byIP := make(map[netip.Addr]Client)
+	var errs []error
+
+	for _, path := range r.cfg.LeaseFiles {
+		leases, err := readLeases(path, time.Now())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, c := range leases {
+			if addr, err := netip.ParseAddr(c.IP); err == nil {
+				byIP[addr] = c
+			}
+		}
+	}
+
+	// The neighbour table fills in MACs and hosts without a lease
+	if r.cfg.ARP {
+		neighbours, err := readARP(r.arpPath)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for addr, mac := range neighbours {
+			c, ok := byIP[addr]
+			if !ok {
+				c = Client{IP: addr.String(), Source: SourceARP}
+			}
+			if c.MAC == "" {
+				c.MAC = mac
+			}
+			byIP[addr] = c
+		}
+	}
+
+	// Static definitions win: by MAC they name whatever address the host
+	// has, by IP they add or replace the entry
+	byMAC := make(map[string]string)
+	for _, s := range r.cfg.Static {
+		if hw, err := net.ParseMAC(s.MAC); err == nil && s.IP == "" {
+			byMAC[hw.String()] = s.Name
+		}
+	}
+	for addr, c := range byIP {
+		if name, ok := byMAC[c.MAC]; ok {
+			c.Name, c.Source = name, SourceStatic
+			byIP[addr] = c
+		}
+	}
+	for _, s := range r.cfg.Static {
+		addr, err := netip.ParseAddr(s.IP)
+		if err != nil {
+			continue
+		}
+		c := Client{IP: addr.String(), Name: s.Name, MAC: byIP[addr].MAC, Source: SourceStatic}
+		if hw, err := net.ParseMAC(s.MAC); err == nil {
+			c.MAC = hw.String()
+		}
+		byIP[addr] = c
+	}
+
+	r.mu.Lock()
+	r.byIP = byIP
+	r.mu.Unlock()
+
+	return errs
+}
+
+func (r *Registry) refreshLoop() {
+	refresh := r.cfg.Refresh
+	if refresh <= 0 {
+		refresh = defaultRefresh
+	}
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			// Sources are often rewritten in place, failures are expected
+			for _, err := range r.Refresh() {
+				logger.Debugf("Client identity: %v", err)
+			}
+		}
+	}
+}
+
+func (r *Registry) Close() {
+	if r == nil {
+		return
+	}
+	close(r.done)
+}
+
+// hostname cleans up names taken from leases, "*" means none.
+func hostname(name string) string {
+	name = strings.Trim(name, `"`)
+	if name == "*" {
+		return ""
+	}
+	return strings.ToLower(name)
+}
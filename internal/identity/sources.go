@@ -0,0 +1,171 @@
+package identity
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readLeases reads a dnsmasq or ISC dhcpd lease file, telling them apart by
+// the "lease <ip> {" blocks of the latter. Expired leases are skipped.
+func readLeases(path string, now time.Time) ([]Client, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease file: %v", err)
+	}
+
+	if bytes.Contains(data, []byte("lease ")) && bytes.Contains(data, []byte("{")) {
+		return parseISCLeases(data, now), nil
+	}
+	return parseDnsmasqLeases(data, now), nil
+}
+
+// parseDnsmasqLeases reads lines of "<expiry> <mac> <ip> <hostname> <client-id>".
+// DHCPv6 lines carry an IAID instead of the MAC.
+func parseDnsmasqLeases(data []byte, now time.Time) []Client {
+	var leases []Client
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "duid" {
+			continue
+		}
+
+		// Zero expiry means an infinite lease
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || (expiry != 0 && time.Unix(expiry, 0).Before(now)) {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			continue
+		}
+
+		c := Client{IP: addr.String(), Name: hostname(fields[3]), Source: SourceLease}
+		if hw, err := net.ParseMAC(fields[1]); err == nil {
+			c.MAC = hw.String()
+		}
+		leases = append(leases, c)
+	}
+
+	return leases
+}
+
+// parseISCLeases reads dhcpd.leases blocks. The file is append only, so a
+// later block for the same address replaces an earlier one.
+func parseISCLeases(data []byte, now time.Time) []Client {
+	var (
+		leases  []Client
+		index   = make(map[string]int)
+		current *Client
+		bound   bool
+		expired bool
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ";"))
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "lease" && len(fields) >= 3:
+			if addr, err := netip.ParseAddr(fields[1]); err == nil {
+				current = &Client{IP: addr.String(), Source: SourceLease}
+				bound, expired = true, false
+			}
+		case current == nil:
+		case fields[0] == "}":
+			if bound && !expired {
+				if i, ok := index[current.IP]; ok {
+					leases[i] = *current
+				} else {
+					index[current.IP] = len(leases)
+					leases = append(leases, *current)
+				}
+			} else if i, ok := index[current.IP]; ok {
+				leases[i] = Client{}
+			}
+			current = nil
+		case fields[0] == "binding" && len(fields) >= 3 && fields[1] == "state":
+			bound = fields[2] == "active"
+		case fields[0] == "ends" && len(fields) >= 2:
+			ends, ok := iscTime(fields[1:])
+			expired = ok && ends.Before(now)
+		case fields[0] == "hardware" && len(fields) >= 3:
+			if hw, err := net.ParseMAC(fields[2]); err == nil {
+				current.MAC = hw.String()
+			}
+		case fields[0] == "client-hostname" && len(fields) >= 2:
+			current.Name = hostname(fields[1])
+		}
+	}
+
+	// Drop addresses whose latest block was not active
+	kept := leases[:0]
+	for _, c := range leases {
+		if c.IP != "" {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// iscTime parses "<weekday> yyyy/mm/dd hh:mm:ss" in UTC or "epoch <seconds>".
+// "never" and unknown forms report false.
+func iscTime(fields []string) (time.Time, bool) {
+	if len(fields) >= 2 && fields[0] == "epoch" {
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		return time.Unix(secs, 0), err == nil
+	}
+	if len(fields) >= 3 {
+		t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// readARP returns the complete entries of the kernel neighbour table:
+// "IP address  HW type  Flags  HW address  Mask  Device".
+func readARP(path string) (map[netip.Addr]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ARP table: %v", err)
+	}
+
+	neighbours := make(map[netip.Addr]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+
+		// 0x2 is ATF_COM, the entry is resolved
+		flags, err := strconv.ParseUint(fields[2], 0, 32)
+		if err != nil || flags&0x2 == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		hw, err := net.ParseMAC(fields[3])
+		if err != nil || hw.String() == "00:00:00:00:00:00" {
+			continue
+		}
+		neighbours[addr] = hw.String()
+	}
+
+	return neighbours, nil
+}
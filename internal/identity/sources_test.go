@@ -0,0 +1,163 @@
+package identity
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const dnsmasqLeases = `1792411200 3c:22:fb:12:34:56 192.168.1.10 Laptop-Anna 01:3c:22:fb:12:34:56
+1760000000 a4:5e:60:00:00:01 192.168.1.11 old-phone *
+0 a4:5e:60:00:00:02 192.168.1.12 * *
+duid 00:01:00:01:2c:7a:5b:1e:3c:22:fb:12:34:56
+1792411200 1234567 2001:db8::10 laptop-anna 00:01:00:01:2c:7a:5b:1e:3c:22:fb:12:34:56
+1792411200 a4:5e:60:00:00:03 not-an-ip broken *
+truncated line
+`
+
+const iscLeases = `# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 192.168.1.10 {
+  starts 1 2026/10/19 08:00:00;
+  ends never;
+  binding state active;
+  hardware ethernet 3c:22:fb:12:34:56;
+  client-hostname "old-name";
+}
+lease 192.168.1.11 {
+  ends epoch 1760000000; # 2025/10/09
+  binding state active;
+  hardware ethernet a4:5e:60:00:00:01;
+}
+lease 192.168.1.12 {
+  ends 2 2026/10/20 08:00:00;
+  binding state active;
+  hardware ethernet a4:5e:60:00:00:02;
+  client-hostname "phone";
+}
+lease 192.168.1.13 {
+  ends 0 2026/10/18 08:00:00;
+  binding state active;
+  hardware ethernet a4:5e:60:00:00:03;
+}
+lease 192.168.1.10 {
+  ends epoch 1792411200;
+  binding state active;
+  hardware ethernet 3c:22:fb:12:34:56;
+  client-hostname "Laptop-Anna";
+}
+lease 192.168.1.12 {
+  ends 2 2026/10/20 08:00:00;
+  binding state free;
+  hardware ethernet a4:5e:60:00:00:02;
+}
+lease 192.168.1.14 {
+  ends never;
+  hardware ethernet a4:5e:60:00:00:04;
+}
+`
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	got := parseDnsmasqLeases([]byte(dnsmasqLeases), testNow)
+	want := []Client{
+		{IP: "192.168.1.10", Name: "laptop-anna", MAC: "3c:22:fb:12:34:56", Source: SourceLease},
+		{IP: "192.168.1.12", MAC: "a4:5e:60:00:00:02", Source: SourceLease},
+		{IP: "2001:db8::10", Name: "laptop-anna", Source: SourceLease},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseISCLeases(t *testing.T) {
+	got := parseISCLeases([]byte(iscLeases), testNow)
+	want := []Client{
+		// The later block for .10 replaces the earlier one, .12 was freed
+		{IP: "192.168.1.10", Name: "laptop-anna", MAC: "3c:22:fb:12:34:56", Source: SourceLease},
+		// No binding state is taken as active
+		{IP: "192.168.1.14", MAC: "a4:5e:60:00:00:04", Source: SourceLease},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestISCTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+		want   time.Time
+		ok     bool
+	}{
+		{name: "date", fields: []string{"2", "2026/10/20", "08:00:00"}, want: time.Date(2026, 10, 20, 8, 0, 0, 0, time.UTC), ok: true},
+		{name: "epoch", fields: []string{"epoch", "1792411200"}, want: time.Unix(1792411200, 0), ok: true},
+		{name: "never", fields: []string{"never"}},
+		{name: "bad epoch", fields: []string{"epoch", "soon"}},
+		{name: "bad date", fields: []string{"2", "20/10/2026", "08:00"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := iscTime(tt.fields)
+			if ok != tt.ok || (ok && !got.Equal(tt.want)) {
+				t.Fatalf("got %v %v, want %v %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReadLeases(t *testing.T) {
+	for name, data := range map[string]string{"dnsmasq.leases": dnsmasqLeases, "dhcpd.leases": iscLeases} {
+		got, err := readLeases(writeFile(t, name, data), testNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) == 0 || got[0].Name != "laptop-anna" {
+			t.Fatalf("%s: read as the wrong format: %+v", name, got)
+		}
+	}
+
+	if _, err := readLeases(filepath.Join(t.TempDir(), "missing"), testNow); err == nil {
+		t.Fatal("missing lease file read")
+	}
+}
+
+func TestReadARP(t *testing.T) {
+	path := writeFile(t, "arp", `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.10     0x1         0x2         3c:22:fb:12:34:56     *        eth0
+192.168.1.11     0x1         0x0         a4:5e:60:00:00:01     *        eth0
+192.168.1.12     0x1         0x6         a4:5e:60:00:00:02     *        eth0
+192.168.1.13     0x1         0x2         00:00:00:00:00:00     *        eth0
+192.168.1.14     0x1         0x4         a4:5e:60:00:00:04     *        eth0
+192.168.1.15     0x1         0x2         not-a-mac             *        eth0
+`)
+
+	got, err := readARP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[netip.Addr]string{
+		netip.MustParseAddr("192.168.1.10"): "3c:22:fb:12:34:56",
+		netip.MustParseAddr("192.168.1.12"): "a4:5e:60:00:00:02",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if _, err := readARP(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("missing ARP table read")
+	}
+}
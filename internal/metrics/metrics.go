@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "privacyhub"
+
+var Registry = prometheus.NewRegistry()
+
+// DNS resolver
+var (
+	DNSQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "queries_total",
+		Help:      "DNS queries answered, by query type and response code.",
+	}, []string{"qtype", "rcode"})
+
+	DNSCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "cache_hits_total",
+		Help:      "DNS cache hits.",
+	})
+
+	DNSCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "cache_misses_total",
+		Help:      "DNS cache misses.",
+	})
+
+	DNSCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "cache_evictions_total",
+		Help:      "DNS cache entries evicted because the cache was full.",
+	})
+
+	DNSUpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "upstream_duration_seconds",
+		Help:      "Round trip time of successful upstream exchanges.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"upstream"})
+
+	DNSUpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "upstream_errors_total",
+		Help:      "Failed upstream exchanges.",
+	}, []string{"upstream"})
+
+	DNSFilterBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "filter_blocks_total",
+		Help:      "Queries blocked by the filter, by the list of the matched rule.",
+	}, []string{"list"})
+
+	DNSLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "limited_total",
+		Help:      "Queries refused or dropped by abuse protection, by reason: acl, rate_limit, rrl_drop or rrl_slip.",
+	}, []string{"reason"})
+)
+
+// HTTP proxy
+var (
+	ProxyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "requests_total",
+		Help:      "Requests handled by the proxy, by method and scheme.",
+	}, []string{"method", "scheme"})
+
+	ProxyMITMHandshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "mitm_handshakes_total",
+		Help:      "TLS interceptions, by result: ok, rejected by the client or cert_error.",
+	}, []string{"result"})
+)
+
+// Supervisor
+var ServiceUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: "supervisor",
+	Name:      "service_up",
+	Help:      "Whether a supervised service is running (1) or not (0).",
+}, []string{"service"})
+
+func init() {
+	Registry.MustRegister(
+		DNSQueries,
+		DNSCacheHits,
+		DNSCacheMisses,
+		DNSCacheEvictions,
+		DNSUpstreamDuration,
+		DNSUpstreamErrors,
+		DNSFilterBlocks,
+		DNSLimited,
+		ProxyRequests,
+		ProxyMITMHandshakes,
+		ServiceUp,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// SetServiceUp records the state of a supervised service.
+func SetServiceUp(service string, up bool) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	ServiceUp.WithLabelValues(service).Set(v)
+}
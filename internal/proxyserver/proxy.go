@@ -3,14 +3,21 @@ package proxyserver
 import (
 	"context"
 	"crypto/tls"
+	"io"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
 	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/metrics"
 	"github.com/elazarl/goproxy"
 )
 
+const mitmHandshakeTimeout = 10 * time.Second
+
 func Start(ctx context.Context, cfg config.ProxyConfig) error {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = false // Включите true для отладки
@@ -27,7 +34,7 @@ func Start(ctx context.Context, cfg config.ProxyConfig) error {
 		}
 
 		// Включаем MITM для всех CONNECT запросов
-		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		proxy.OnRequest().HandleConnect(newMITMHandler(proxy, &tlsc))
 
 		// ПРАВИЛЬНЫЙ СПОСОБ установки своего CA:
 		goproxy.GoproxyCa = tlsc // Присваиваем глобальной переменной библиотеки
@@ -36,6 +43,8 @@ func Start(ctx context.Context, cfg config.ProxyConfig) error {
 		logger.Infof("MITM disabled - HTTPS headers will NOT be filtered")
 	}
 
+	proxy.OnRequest().DoFunc(countRequest)
+
 	// 2. Настройка фильтров (работает для HTTP и для расшифрованного HTTPS)
 	if cfg.FilterHeads {
 		proxy.OnRequest().DoFunc(newHeaderFilter(cfg.FilterListHeaders))
@@ -89,3 +98,142 @@ func newHeaderFilter(filterList []string) func(*http.Request, *goproxy.ProxyCtx)
 		return req, nil
 	}
 }
+
+func countRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	metrics.ProxyRequests.WithLabelValues(methodLabel(req.Method), schemeLabel(req.URL.Scheme)).Inc()
+	return req, nil
+}
+
+// methodLabel keeps label values bounded, clients may send any method.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+func schemeLabel(scheme string) string {
+	switch scheme {
+	case "", "http":
+		return "http"
+	case "https":
+		return "https"
+	}
+	return "other"
+}
+
+// newMITMHandler intercepts every CONNECT like goproxy.AlwaysMitm, but
+// completes the client handshake itself so handshakes are counted by their
+// real outcome. Go's server runs VerifyConnection before the client's
+// Finished, a client rejecting our certificate would pass it.
+func newMITMHandler(proxy http.Handler, ca *tls.Certificate) goproxy.FuncHttpsHandler {
+	tlsConfig := goproxy.TLSConfigFromCA(ca)
+
+	action := &goproxy.ConnectAction{
+		Action: goproxy.ConnectHijack,
+		Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+			host := req.URL.Host
+			cfg, err := tlsConfig(host, ctx)
+			if err != nil {
+				metrics.ProxyMITMHandshakes.WithLabelValues("cert_error").Inc()
+				client.Write([]byte("HTTP/1.0 502 Bad Gateway\r\n\r\n"))
+				client.Close()
+				return
+			}
+			client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+
+			// The CONNECT handler must return, the tunnel lives on its own
+			go serveMITM(proxy, tls.Server(client, cfg), host)
+		},
+	}
+
+	return func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return action, host
+	}
+}
+
+// serveMITM completes the handshake with the client and passes the
+// decrypted requests to proxy as https requests for host.
+func serveMITM(proxy http.Handler, conn *tls.Conn, host string) {
+	conn.SetDeadline(time.Now().Add(mitmHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		metrics.ProxyMITMHandshakes.WithLabelValues("rejected").Inc()
+		logger.Debugf("MITM handshake with %s for %s failed: %v", conn.RemoteAddr(), host, err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	metrics.ProxyMITMHandshakes.WithLabelValues("ok").Inc()
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = r.Host
+			if r.URL.Host == "" {
+				r.URL.Host = host
+			}
+			// goproxy would dial websockets in plain TCP
+			if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				tunnelWebsocket(w, r)
+				return
+			}
+			proxy.ServeHTTP(w, r)
+		}),
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+	server.Serve(&connListener{conn: conn})
+}
+
+// tunnelWebsocket forwards an upgrade request to the site over TLS and
+// copies both directions until either side closes.
+func tunnelWebsocket(w http.ResponseWriter, r *http.Request) {
+	addr := r.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: mitmHandshakeTimeout}}
+	site, err := dialer.DialContext(r.Context(), "tcp", addr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer site.Close()
+
+	client, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+	client.SetDeadline(time.Time{})
+
+	if err := r.Write(site); err != nil {
+		logger.Debugf("Failed to forward websocket request to %s: %v", addr, err)
+		return
+	}
+	go io.Copy(site, buf)
+	io.Copy(client, site)
+}
+
+// connListener hands out a single connection, Serve returns once it is
+// taken while the connection is served until it closes.
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn == nil {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *connListener) Close() error   { return nil }
+func (l *connListener) Addr() net.Addr { return l.conn.LocalAddr() }
@@ -0,0 +1,114 @@
+package proxyserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/metrics"
+	"github.com/elazarl/goproxy"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func newTestCA(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "privacy-hub test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func handshakes(t *testing.T, result string) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metrics.ProxyMITMHandshakes.WithLabelValues(result).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestMITMHandshakeResult(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.Header.Get("User-Agent"))
+	}))
+	defer site.Close()
+
+	ca, pool := newTestCA(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(newMITMHandler(proxy, &ca))
+	proxy.OnRequest().DoFunc(newUserAgentSetter("privacy-hub"))
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+	proxyURL, _ := url.Parse(proxySrv.URL)
+
+	client := func(roots *x509.CertPool) *http.Client {
+		return &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS13},
+			},
+		}
+	}
+
+	ok, rejected := handshakes(t, "ok"), handshakes(t, "rejected")
+
+	// A client trusting our CA gets the decrypted and filtered request through
+	resp, err := client(pool).Get(site.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello privacy-hub" {
+		t.Fatalf("body %q", body)
+	}
+	if got := handshakes(t, "ok"); got != ok+1 {
+		t.Fatalf("ok handshakes %v, want %v", got, ok+1)
+	}
+
+	// A client rejecting the forged certificate is not counted as ok
+	if _, err := client(x509.NewCertPool()).Get(site.URL); err == nil {
+		t.Fatal("client accepted an untrusted certificate")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for handshakes(t, "rejected") != rejected+1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := handshakes(t, "rejected"); got != rejected+1 {
+		t.Fatalf("rejected handshakes %v, want %v", got, rejected+1)
+	}
+	if got := handshakes(t, "ok"); got != ok+1 {
+		t.Fatalf("ok handshakes %v after a rejection, want %v", got, ok+1)
+	}
+}
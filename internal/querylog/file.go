@@ -0,0 +1,222 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// rotatingFile appends lines to path and renames it to path.1 .. path.N
+// once it grows over maxSize. Every line carries its expiry and purge
+// rewrites the files without expired lines.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration // for lines written without an expiry
+	file       *os.File
+	size       int64
+	nextExpiry time.Time // earliest expiry on disk, zero when unknown
+	mu         sync.Mutex
+}
+
+// fileRecord is a Record as stored on disk.
+type fileRecord struct {
+	Record
+	Expires time.Time `json:"expires"`
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		maxAge:     maxAge,
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	// Apply retention to what earlier runs left behind
+	if err := rf.purge(time.Now()); err != nil {
+		rf.Close()
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.file = f
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) WriteLine(line []byte, expires time.Time) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.size > 0 && rf.size+int64(len(line))+1 > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := rf.file.Write(append(line, '\n'))
+	rf.size += int64(n)
+	if err == nil && (rf.nextExpiry.IsZero() || expires.Before(rf.nextExpiry)) {
+		rf.nextExpiry = expires
+	}
+	return err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(rf.backup(rf.maxBackups))
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(rf.backup(i), rf.backup(i+1))
+	}
+	if err := os.Rename(rf.path, rf.backup(1)); err != nil {
+		return err
+	}
+
+	return rf.open()
+}
+
+// purge drops expired lines from the live file and the backups. Files are
+// only read once the earliest known expiry has passed.
+func (rf *rotatingFile) purge(now time.Time) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if !rf.nextExpiry.IsZero() && now.Before(rf.nextExpiry) {
+		return nil
+	}
+
+	var next time.Time
+	keep := func(earliest time.Time) {
+		if !earliest.IsZero() && (next.IsZero() || earliest.Before(next)) {
+			next = earliest
+		}
+	}
+
+	for i := 1; i <= rf.maxBackups; i++ {
+		earliest, err := rf.purgeFile(rf.backup(i), now, true)
+		if err != nil {
+			return err
+		}
+		keep(earliest)
+	}
+
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	earliest, err := rf.purgeFile(rf.path, now, false)
+	if openErr := rf.open(); err == nil {
+		err = openErr
+	}
+	if err != nil {
+		return err
+	}
+	keep(earliest)
+
+	rf.nextExpiry = next
+	return nil
+}
+
+// purgeFile rewrites path without the lines expired at now and returns the
+// earliest expiry left. Backups left empty are removed.
+func (rf *rotatingFile) purgeFile(path string, now time.Time, backup bool) (time.Time, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	var kept [][]byte
+	var earliest time.Time
+	dropped := false
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var rec fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Not ours to judge, keep it
+			kept = append(kept, append([]byte(nil), scanner.Bytes()...))
+			continue
+		}
+		expires := rec.Expires
+		if expires.IsZero() {
+			expires = rec.Time.Add(rf.maxAge)
+		}
+		if now.After(expires) {
+			dropped = true
+			continue
+		}
+		kept = append(kept, append([]byte(nil), scanner.Bytes()...))
+		if earliest.IsZero() || expires.Before(earliest) {
+			earliest = expires
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if !dropped {
+		return earliest, nil
+	}
+
+	if backup && len(kept) == 0 {
+		return earliest, os.Remove(path)
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return time.Time{}, err
+	}
+	w := bufio.NewWriter(out)
+	for _, line := range kept {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return time.Time{}, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return time.Time{}, err
+	}
+	return earliest, os.Rename(tmp, path)
+}
+
+func (rf *rotatingFile) backup(n int) string {
+	return fmt.Sprintf("%s.%d", rf.path, n)
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
@@ -0,0 +1,156 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+)
+
+// qnames returns the query names stored in a log file, nil when it is gone.
+func qnames(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	names := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, rec.QName)
+	}
+	return names
+}
+
+func TestFilePurgeAppliesProfileRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	l, err := New(config.QueryLogConfig{
+		Enabled:              true,
+		File:                 path,
+		QueryLogPolicyConfig: config.QueryLogPolicyConfig{Retention: 24 * time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	kids := NewPolicy(config.QueryLogPolicyConfig{Retention: time.Hour})
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.Add(Record{Time: start, QName: "kids.example"}, kids)
+	l.Add(Record{Time: start, QName: "default.example"}, nil)
+
+	steps := []struct {
+		after time.Duration
+		want  []string
+	}{
+		{after: 30 * time.Minute, want: []string{"kids.example", "default.example"}},
+		{after: 2 * time.Hour, want: []string{"default.example"}},
+		{after: 25 * time.Hour, want: []string{}},
+	}
+	for _, step := range steps {
+		if err := l.file.purge(start.Add(step.after)); err != nil {
+			t.Fatal(err)
+		}
+		if got := qnames(t, path); !slices.Equal(got, step.want) {
+			t.Fatalf("after %s: file has %v, want %v", step.after, got, step.want)
+		}
+	}
+
+	// The live file stays open for new records
+	l.Add(Record{Time: start.Add(25 * time.Hour), QName: "later.example"}, nil)
+	if got := qnames(t, path); !slices.Equal(got, []string{"later.example"}) {
+		t.Fatalf("after purge: file has %v", got)
+	}
+}
+
+func TestFilePurgeBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	rf, err := openRotatingFile(path, 150, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(name string, ttl time.Duration) {
+		rec := Record{Time: start, QName: name}
+		line, _ := json.Marshal(fileRecord{Record: rec, Expires: start.Add(ttl)})
+		if err := rf.WriteLine(line, start.Add(ttl)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each record fills a file, older ones move to backups
+	write("short.example", time.Minute)
+	write("long.example", 3*time.Hour)
+
+	// Nothing is read before the earliest expiry
+	if err := rf.purge(start); err != nil {
+		t.Fatal(err)
+	}
+	if got := qnames(t, rf.backup(1)); !slices.Equal(got, []string{"short.example"}) {
+		t.Fatalf("backup 1 has %v", got)
+	}
+
+	if err := rf.purge(start.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if got := qnames(t, rf.backup(i)); got != nil {
+			t.Fatalf("backup %d kept with %v", i, got)
+		}
+	}
+	if got := qnames(t, path); !slices.Equal(got, []string{"long.example"}) {
+		t.Fatalf("live file has %v", got)
+	}
+	if want := start.Add(3 * time.Hour); !rf.nextExpiry.Equal(want) {
+		t.Fatalf("next expiry %s, want %s", rf.nextExpiry, want)
+	}
+}
+
+func TestFilePurgeOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+
+	// Lines written without an expiry age by the default retention
+	now := time.Now()
+	var data []byte
+	for _, rec := range []Record{
+		{Time: now.Add(-2 * time.Hour), QName: "old.example"},
+		{Time: now.Add(-time.Minute), QName: "new.example"},
+	} {
+		line, _ := json.Marshal(rec)
+		data = append(append(data, line...), '\n')
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".1", data[:len(data)/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	rf, err := openRotatingFile(path, 1<<20, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	if got := qnames(t, path); !slices.Equal(got, []string{"new.example"}) {
+		t.Fatalf("live file has %v", got)
+	}
+	if got := qnames(t, rf.backup(1)); got != nil {
+		t.Fatalf("expired backup kept with %v", got)
+	}
+}
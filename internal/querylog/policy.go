@@ -0,0 +1,126 @@
+package querylog
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+)
+
+const defaultKeyRotation = 24 * time.Hour
+
+// Policy decides whether and in which form a record is stored.
+type Policy struct {
+	anonymizeClient bool
+	hashNames       bool
+	skipAllowlisted bool
+	ignore          map[string]bool
+	retention       time.Duration
+}
+
+func NewPolicy(cfg config.QueryLogPolicyConfig) *Policy {
+	p := &Policy{
+		anonymizeClient: cfg.AnonymizeClientIP,
+		hashNames:       cfg.HashNames,
+		skipAllowlisted: cfg.SkipAllowlisted,
+		ignore:          make(map[string]bool),
+		retention:       cfg.Retention,
+	}
+	if p.retention <= 0 {
+		p.retention = defaultRetention
+	}
+
+	for _, domain := range cfg.IgnoreDomains {
+		p.ignore[normalize(domain)] = true
+	}
+
+	return p
+}
+
+func (p *Policy) skip(rec Record) bool {
+	if p.skipAllowlisted && rec.Decision == DecisionAllowed {
+		return true
+	}
+
+	name := normalize(rec.QName)
+	for {
+		if p.ignore[name] {
+			return true
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return false
+		}
+		name = parent
+	}
+}
+
+func (p *Policy) apply(rec Record, h *hasher) Record {
+	if p.anonymizeClient {
+		// A name identifies the client as well as its address
+		rec.Client = truncateIP(rec.Client)
+		rec.ClientName = ""
+	}
+	if p.hashNames {
+		rec.QName = h.sum(normalize(rec.QName))
+		rec.Rule = ""
+		rec.Hashed = true
+	}
+	rec.expires = rec.Time.Add(p.retention)
+	return rec
+}
+
+// truncateIP keeps the /24 of IPv4 and the /48 of IPv6 addresses.
+func truncateIP(client string) string {
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		return client
+	}
+
+	bits := 24
+	if addr.Is6() {
+		bits = 48
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.Addr().String()
+}
+
+// hasher computes HMACs with a key that is replaced every rotation period,
+// so hashes from different periods can not be linked.
+type hasher struct {
+	key       []byte
+	rotatedAt time.Time
+	rotation  time.Duration
+	mu        sync.Mutex
+}
+
+func newHasher(rotation time.Duration) *hasher {
+	if rotation <= 0 {
+		rotation = defaultKeyRotation
+	}
+	return &hasher{rotation: rotation}
+}
+
+func (h *hasher) sum(value string) string {
+	h.mu.Lock()
+	if h.key == nil || time.Since(h.rotatedAt) >= h.rotation {
+		h.key = make([]byte, sha256.Size)
+		rand.Read(h.key)
+		h.rotatedAt = time.Now()
+	}
+	mac := hmac.New(sha256.New, h.key)
+	h.mu.Unlock()
+
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
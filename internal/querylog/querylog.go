@@ -0,0 +1,255 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+)
+
+const (
+	DecisionBlocked   = "blocked"
+	DecisionAllowed   = "allowed" // an allow rule matched
+	DecisionCached    = "cached"
+	DecisionForwarded = "forwarded"
+	DecisionLocal     = "local" // local zone or rewrite
+
+	defaultMaxRecords = 10000
+	defaultMaxSizeMB  = 10
+	defaultMaxBackups = 3
+	defaultRetention  = 24 * time.Hour
+)
+
+type Record struct {
+	Time       time.Time     `json:"time"`
+	Client     string        `json:"client"`
+	ClientName string        `json:"client_name,omitempty"`
+	Profile    string        `json:"profile,omitempty"`
+	QName      string        `json:"qname"`
+	QType      string        `json:"qtype"`
+	Decision   string        `json:"decision"`
+	Rule       string        `json:"rule,omitempty"`
+	List       string        `json:"list,omitempty"`
+	Upstream   string        `json:"upstream,omitempty"`
+	Rcode      string        `json:"rcode"`
+	Answers    int           `json:"answers"`
+	Latency    time.Duration `json:"latency"`
+	Hashed     bool          `json:"hashed,omitempty"`
+
+	expires time.Time
+}
+
+// Query filters records in Search. Empty fields match everything.
+type Query struct {
+	Client   string // address or client name
+	Domain   string // substring of the query name
+	Decision string
+	Since    time.Time
+	Until    time.Time
+	Offset   int
+	Limit    int
+}
+
+// Log keeps the newest records in a ring buffer for search and optionally
+// appends every record to a rotating JSON lines file. Records are purged,
+// from memory and from the file, once the retention of the policy they were
+// stored with has passed.
+type Log struct {
+	records []Record
+	next    int
+	size    int
+	policy  *Policy
+	hasher  *hasher
+	file    *rotatingFile
+	done    chan struct{}
+	mu      sync.RWMutex
+}
+
+func New(cfg config.QueryLogConfig) (*Log, error) {
+	maxRecords := cfg.MaxRecords
+	if maxRecords <= 0 {
+		maxRecords = defaultMaxRecords
+	}
+
+	l := &Log{
+		records: make([]Record, maxRecords),
+		policy:  NewPolicy(cfg.QueryLogPolicyConfig),
+		hasher:  newHasher(cfg.HashKeyRotation),
+		done:    make(chan struct{}),
+	}
+
+	if cfg.File != "" {
+		maxSize := cfg.MaxSizeMB
+		if maxSize <= 0 {
+			maxSize = defaultMaxSizeMB
+		}
+		maxBackups := cfg.MaxBackups
+		if maxBackups <= 0 {
+			maxBackups = defaultMaxBackups
+		}
+
+		// Lines written before expiries were stored age by the default policy
+		f, err := openRotatingFile(cfg.File, int64(maxSize)<<20, maxBackups, l.policy.retention)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open query log: %v", err)
+		}
+		l.file = f
+	}
+
+	go l.purgeLoop()
+
+	return l, nil
+}
+
+// Add stores a record according to policy, nil means the default policy.
+// It is safe to call on a nil Log.
+func (l *Log) Add(rec Record, policy *Policy) {
+	if l == nil {
+		return
+	}
+	if policy == nil {
+		policy = l.policy
+	}
+	if policy.skip(rec) {
+		return
+	}
+	rec = l.Redact(rec, policy)
+
+	l.mu.Lock()
+	l.records[l.next] = rec
+	l.next = (l.next + 1) % len(l.records)
+	if l.size < len(l.records) {
+		l.size++
+	}
+	l.mu.Unlock()
+
+	if l.file != nil {
+		line, err := json.Marshal(fileRecord{Record: rec, Expires: rec.expires})
+		if err != nil {
+			return
+		}
+		if err := l.file.WriteLine(line, rec.expires); err != nil {
+			logger.Errorf("Query log write failed: %v", err)
+		}
+	}
+}
+
+// Redact returns rec in the form policy stores it, nil meaning the default
+// policy, so other views of the same queries such as the statistics show no
+// more than the log. A nil Log returns rec unchanged.
+func (l *Log) Redact(rec Record, policy *Policy) Record {
+	if l == nil {
+		return rec
+	}
+	if policy == nil {
+		policy = l.policy
+	}
+	return policy.apply(rec, l.hasher)
+}
+
+// Search returns matching records, newest first, and the total number of
+// matches before pagination.
+func (l *Log) Search(q Query) ([]Record, int) {
+	if l == nil {
+		return nil, 0
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	now := time.Now()
+	domain := strings.ToLower(q.Domain)
+
+	var matches []Record
+	for i := 1; i <= l.size; i++ {
+		rec := l.records[(l.next-i+len(l.records))%len(l.records)]
+
+		if now.After(rec.expires) {
+			continue
+		}
+		if q.Client != "" && rec.Client != q.Client && rec.ClientName != q.Client {
+			continue
+		}
+		if q.Decision != "" && rec.Decision != q.Decision {
+			continue
+		}
+		if domain != "" && !strings.Contains(strings.ToLower(rec.QName), domain) {
+			continue
+		}
+		if !q.Since.IsZero() && rec.Time.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && rec.Time.After(q.Until) {
+			continue
+		}
+		matches = append(matches, rec)
+	}
+
+	total := len(matches)
+	if q.Offset >= total {
+		return []Record{}, total
+	}
+	matches = matches[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matches) {
+		matches = matches[:q.Limit]
+	}
+
+	return matches, total
+}
+
+func (l *Log) purgeLoop() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C:
+			l.purge(now)
+			if l.file != nil {
+				if err := l.file.purge(now); err != nil {
+					logger.Errorf("Query log purge failed: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// purge drops expired records, keeping the rest in order.
+func (l *Log) purge(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	kept := make([]Record, 0, l.size)
+	for i := l.size; i >= 1; i-- {
+		rec := l.records[(l.next-i+len(l.records))%len(l.records)]
+		if !now.After(rec.expires) {
+			kept = append(kept, rec)
+		}
+	}
+	if len(kept) == l.size {
+		return
+	}
+
+	clear(l.records)
+	copy(l.records, kept)
+	l.size = len(kept)
+	l.next = len(kept) % len(l.records)
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	close(l.done)
+
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
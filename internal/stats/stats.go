@@ -0,0 +1,316 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	minuteBuckets = 60
+	hourBuckets   = 7 * 24
+
+	candidatesPerBucket = 100
+	sketchDepth         = 4
+	minuteSketchWidth   = 256
+	hourSketchWidth     = 512
+)
+
+// Windows served by Snapshot.
+var Windows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+// Upper bounds of latency histogram buckets, the last bucket is unbounded.
+var latencyBounds = []time.Duration{
+	1 * time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	1 * time.Second, 2 * time.Second, 5 * time.Second,
+}
+
+type Event struct {
+	Time     time.Time
+	Client   string // name when known, address otherwise
+	Domain   string
+	Blocked  bool
+	Cached   bool
+	Upstream string // empty when answered without an upstream
+	Latency  time.Duration
+}
+
+type Count struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type UpstreamStats struct {
+	Queries   uint64            `json:"queries"`
+	AvgMs     float64           `json:"avg_ms"`
+	P50Ms     float64           `json:"p50_ms"`
+	P95Ms     float64           `json:"p95_ms"`
+	Histogram map[string]uint64 `json:"histogram"`
+}
+
+type Snapshot struct {
+	Window         string                   `json:"window"`
+	Queries        uint64                   `json:"queries"`
+	Blocked        uint64                   `json:"blocked"`
+	BlockedPercent float64                  `json:"blocked_percent"`
+	CacheHits      uint64                   `json:"cache_hits"`
+	CacheMisses    uint64                   `json:"cache_misses"`
+	CacheHitRatio  float64                  `json:"cache_hit_ratio"`
+	Upstreams      map[string]UpstreamStats `json:"upstreams"`
+	TopDomains     []Count                  `json:"top_domains"`
+	TopBlocked     []Count                  `json:"top_blocked"`
+	TopClients     []Count                  `json:"top_clients"`
+}
+
+type histogram struct {
+	counts []uint64
+	sum    time.Duration
+	total  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBounds)+1)
+	}
+	i := sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+	h.counts[i]++
+	h.sum += d
+	h.total++
+}
+
+func (h *histogram) merge(o *histogram) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBounds)+1)
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.sum += o.sum
+	h.total += o.total
+}
+
+// quantile returns the upper bound of the bucket holding the q-th quantile.
+func (h *histogram) quantile(q float64) time.Duration {
+	rank := uint64(q * float64(h.total))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen > rank && i < len(latencyBounds) {
+			return latencyBounds[i]
+		}
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+type bucket struct {
+	start       time.Time
+	queries     uint64
+	blocked     uint64
+	cacheHits   uint64
+	cacheMisses uint64
+	upstreams   map[string]*histogram
+	domains     *topK
+	blockedTop  *topK
+	clients     *topK
+}
+
+func newBucket(start time.Time, sketchWidth int) *bucket {
+	return &bucket{
+		start:      start,
+		upstreams:  make(map[string]*histogram),
+		domains:    newTopK(candidatesPerBucket, sketchWidth, sketchDepth),
+		blockedTop: newTopK(candidatesPerBucket, sketchWidth, sketchDepth),
+		clients:    newTopK(candidatesPerBucket, sketchWidth, sketchDepth),
+	}
+}
+
+func (b *bucket) add(ev Event) {
+	b.queries++
+	b.domains.add(ev.Domain)
+	b.clients.add(ev.Client)
+
+	switch {
+	case ev.Blocked:
+		b.blocked++
+		b.blockedTop.add(ev.Domain)
+	case ev.Cached:
+		b.cacheHits++
+	case ev.Upstream != "":
+		b.cacheMisses++
+		h, ok := b.upstreams[ev.Upstream]
+		if !ok {
+			h = &histogram{}
+			b.upstreams[ev.Upstream] = h
+		}
+		h.observe(ev.Latency)
+	}
+}
+
+// ring is a fixed set of time buckets reused in a circle.
+type ring struct {
+	buckets     []*bucket
+	size        time.Duration
+	sketchWidth int
+}
+
+func (r *ring) bucketFor(t time.Time) *bucket {
+	start := t.Truncate(r.size)
+	i := int(start.Unix()/int64(r.size.Seconds())) % len(r.buckets)
+
+	if b := r.buckets[i]; b != nil && !b.start.Before(start) {
+		// Events older than the ring are dropped
+		if b.start.After(start) {
+			return nil
+		}
+		return b
+	}
+	r.buckets[i] = newBucket(start, r.sketchWidth)
+	return r.buckets[i]
+}
+
+func (r *ring) since(from time.Time) []*bucket {
+	var out []*bucket
+	for _, b := range r.buckets {
+		if b != nil && !b.start.Before(from) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// Engine keeps rolling counters in bounded memory: per-minute buckets for
+// the last hour and per-hour buckets for the last week. Top lists are
+// approximated with a count-min sketch and a bounded candidate heap.
+type Engine struct {
+	minutes ring
+	hours   ring
+	mu      sync.Mutex
+}
+
+func New() *Engine {
+	return &Engine{
+		minutes: ring{buckets: make([]*bucket, minuteBuckets), size: time.Minute, sketchWidth: minuteSketchWidth},
+		hours:   ring{buckets: make([]*bucket, hourBuckets), size: time.Hour, sketchWidth: hourSketchWidth},
+	}
+}
+
+// Record adds an event. It is safe to call on a nil Engine.
+func (e *Engine) Record(ev Event) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, r := range []*ring{&e.minutes, &e.hours} {
+		if b := r.bucketFor(ev.Time); b != nil {
+			b.add(ev)
+		}
+	}
+}
+
+func (e *Engine) Snapshot(window string, topN int, now time.Time) (Snapshot, error) {
+	length, ok := Windows[window]
+	if !ok {
+		return Snapshot{}, fmt.Errorf("unknown window %q", window)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var buckets []*bucket
+	if length <= time.Hour {
+		buckets = e.minutes.since(now.Add(-length).Truncate(time.Minute).Add(time.Minute))
+	} else {
+		buckets = e.hours.since(now.Add(-length).Truncate(time.Hour).Add(time.Hour))
+	}
+
+	s := Snapshot{Window: window, Upstreams: make(map[string]UpstreamStats)}
+	upstreams := make(map[string]*histogram)
+	for _, b := range buckets {
+		s.Queries += b.queries
+		s.Blocked += b.blocked
+		s.CacheHits += b.cacheHits
+		s.CacheMisses += b.cacheMisses
+		for name, h := range b.upstreams {
+			if upstreams[name] == nil {
+				upstreams[name] = &histogram{}
+			}
+			upstreams[name].merge(h)
+		}
+	}
+
+	if s.Queries > 0 {
+		s.BlockedPercent = 100 * float64(s.Blocked) / float64(s.Queries)
+	}
+	if lookups := s.CacheHits + s.CacheMisses; lookups > 0 {
+		s.CacheHitRatio = float64(s.CacheHits) / float64(lookups)
+	}
+
+	for name, h := range upstreams {
+		s.Upstreams[name] = upstreamStats(h)
+	}
+
+	s.TopDomains = top(buckets, func(b *bucket) *topK { return b.domains }, topN)
+	s.TopBlocked = top(buckets, func(b *bucket) *topK { return b.blockedTop }, topN)
+	s.TopClients = top(buckets, func(b *bucket) *topK { return b.clients }, topN)
+
+	return s, nil
+}
+
+func upstreamStats(h *histogram) UpstreamStats {
+	us := UpstreamStats{
+		Queries:   h.total,
+		Histogram: make(map[string]uint64, len(h.counts)),
+	}
+	if h.total > 0 {
+		us.AvgMs = float64(h.sum.Microseconds()) / float64(h.total) / 1000
+		us.P50Ms = float64(h.quantile(0.5).Microseconds()) / 1000
+		us.P95Ms = float64(h.quantile(0.95).Microseconds()) / 1000
+	}
+
+	for i, c := range h.counts {
+		label := "+Inf"
+		if i < len(latencyBounds) {
+			label = latencyBounds[i].String()
+		}
+		us.Histogram["le_"+label] = c
+	}
+	return us
+}
+
+// top merges the candidates of all buckets. A key only counts in buckets
+// where it was a candidate, which keeps sketch noise of the quiet buckets
+// out of the totals.
+func top(buckets []*bucket, tracker func(*bucket) *topK, n int) []Count {
+	totals := make(map[string]uint64)
+	for _, b := range buckets {
+		for _, c := range tracker(b).heap.items {
+			totals[c.key] += uint64(c.count)
+		}
+	}
+
+	out := make([]Count, 0, len(totals))
+	for key, count := range totals {
+		out = append(out, Count{Name: key, Count: count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
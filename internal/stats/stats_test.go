@@ -0,0 +1,113 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 10, 19, 12, 0, 30, 0, time.UTC)
+
+func snapshot(t *testing.T, e *Engine, window string, now time.Time) Snapshot {
+	t.Helper()
+	s, err := e.Snapshot(window, 10, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSnapshot(t *testing.T) {
+	e := New()
+	events := []Event{
+		{Time: t0, Client: "laptop", Domain: "example.com", Upstream: "1.1.1.1:853", Latency: 8 * time.Millisecond},
+		{Time: t0, Client: "laptop", Domain: "example.com", Cached: true},
+		{Time: t0.Add(-10 * time.Minute), Client: "tv", Domain: "ads.example.net", Blocked: true},
+		{Time: t0.Add(-20 * time.Minute), Client: "tv", Domain: "example.org", Upstream: "1.1.1.1:853", Latency: 40 * time.Millisecond},
+		{Time: t0.Add(-3 * time.Hour), Client: "phone", Domain: "example.org", Upstream: "9.9.9.9:853", Latency: 3 * time.Second},
+		{Time: t0.Add(-3 * 24 * time.Hour), Client: "phone", Domain: "example.org", Cached: true},
+	}
+	for _, ev := range events {
+		e.Record(ev)
+	}
+
+	tests := []struct {
+		window  string
+		queries uint64
+		clients []Count
+	}{
+		{window: "1h", queries: 4, clients: []Count{{"laptop", 2}, {"tv", 2}}},
+		{window: "24h", queries: 5, clients: []Count{{"laptop", 2}, {"tv", 2}, {"phone", 1}}},
+		{window: "7d", queries: 6, clients: []Count{{"laptop", 2}, {"phone", 2}, {"tv", 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			s := snapshot(t, e, tt.window, t0)
+			if s.Queries != tt.queries {
+				t.Fatalf("%d queries, want %d", s.Queries, tt.queries)
+			}
+			if len(s.TopClients) != len(tt.clients) {
+				t.Fatalf("top clients %v, want %v", s.TopClients, tt.clients)
+			}
+			for i := range tt.clients {
+				if s.TopClients[i] != tt.clients[i] {
+					t.Fatalf("top clients %v, want %v", s.TopClients, tt.clients)
+				}
+			}
+		})
+	}
+
+	s := snapshot(t, e, "1h", t0)
+	if s.Blocked != 1 || s.BlockedPercent != 25 {
+		t.Fatalf("blocked %d (%.0f%%), want 1 (25%%)", s.Blocked, s.BlockedPercent)
+	}
+	if s.CacheHits != 1 || s.CacheMisses != 2 {
+		t.Fatalf("cache hits %d misses %d, want 1 and 2", s.CacheHits, s.CacheMisses)
+	}
+	if len(s.TopBlocked) != 1 || s.TopBlocked[0] != (Count{"ads.example.net", 1}) {
+		t.Fatalf("top blocked %v", s.TopBlocked)
+	}
+	us := s.Upstreams["1.1.1.1:853"]
+	if us.Queries != 2 || us.AvgMs != 24 || us.P50Ms != 50 || us.Histogram["le_10ms"] != 1 {
+		t.Fatalf("upstream stats %+v", us)
+	}
+
+	if _, err := e.Snapshot("2h", 10, t0); err == nil {
+		t.Fatal("unknown window accepted")
+	}
+}
+
+func TestRingRollover(t *testing.T) {
+	e := New()
+	e.Record(Event{Time: t0, Client: "laptop", Domain: "old.example"})
+
+	// An hour later the minute slot of t0 is reused
+	later := t0.Add(time.Hour)
+	e.Record(Event{Time: later, Client: "laptop", Domain: "new.example"})
+	if s := snapshot(t, e, "1h", later); s.Queries != 1 || s.TopDomains[0].Name != "new.example" {
+		t.Fatalf("1h after rollover: %d queries, top %v", s.Queries, s.TopDomains)
+	}
+
+	// Events older than the reused slot are dropped from the minutes only
+	e.Record(Event{Time: t0, Client: "laptop", Domain: "old.example"})
+	if s := snapshot(t, e, "1h", later); s.Queries != 1 {
+		t.Fatalf("late event counted in the last hour: %d queries", s.Queries)
+	}
+	if s := snapshot(t, e, "24h", later); s.Queries != 3 {
+		t.Fatalf("24h: %d queries, want 3", s.Queries)
+	}
+
+	// A week later the hour slot of t0 is reused as well
+	week := t0.Add(7 * 24 * time.Hour)
+	e.Record(Event{Time: week, Client: "laptop", Domain: "new.example"})
+	if s := snapshot(t, e, "7d", week); s.Queries != 2 {
+		t.Fatalf("7d after rollover: %d queries, want 2", s.Queries)
+	}
+	if s := snapshot(t, e, "1h", week); s.Queries != 1 {
+		t.Fatalf("1h a week later: %d queries, want 1", s.Queries)
+	}
+}
+
+func TestRecordNil(t *testing.T) {
+	var e *Engine
+	e.Record(Event{Time: t0})
+}
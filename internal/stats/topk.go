@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"container/heap"
+	"hash/maphash"
+)
+
+// countMinSketch estimates key frequencies in fixed memory. Estimates never
+// undercount and overcount by a small, bounded error.
+type countMinSketch struct {
+	seeds []maphash.Seed
+	rows  [][]uint32
+}
+
+func newCountMinSketch(width, depth int) *countMinSketch {
+	s := &countMinSketch{
+		seeds: make([]maphash.Seed, depth),
+		rows:  make([][]uint32, depth),
+	}
+	for i := range s.rows {
+		s.seeds[i] = maphash.MakeSeed()
+		s.rows[i] = make([]uint32, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) add(key string) uint32 {
+	est := ^uint32(0)
+	for i, row := range s.rows {
+		idx := maphash.String(s.seeds[i], key) % uint64(len(row))
+		row[idx]++
+		est = min(est, row[idx])
+	}
+	return est
+}
+
+// topK tracks the heaviest keys of a stream: the sketch counts everything,
+// a bounded min-heap keeps the current candidates.
+type topK struct {
+	sketch *countMinSketch
+	heap   candidateHeap
+	index  map[string]int
+	k      int
+}
+
+func newTopK(k, width, depth int) *topK {
+	t := &topK{
+		sketch: newCountMinSketch(width, depth),
+		index:  make(map[string]int, k),
+		k:      k,
+	}
+	t.heap.index = t.index
+	return t
+}
+
+func (t *topK) add(key string) {
+	est := t.sketch.add(key)
+
+	if i, ok := t.index[key]; ok {
+		t.heap.items[i].count = est
+		heap.Fix(&t.heap, i)
+		return
+	}
+
+	switch {
+	case len(t.heap.items) < t.k:
+		heap.Push(&t.heap, candidate{key: key, count: est})
+	case est > t.heap.items[0].count:
+		delete(t.index, t.heap.items[0].key)
+		t.heap.items[0] = candidate{key: key, count: est}
+		t.index[key] = 0
+		heap.Fix(&t.heap, 0)
+	}
+}
+
+type candidate struct {
+	key   string
+	count uint32
+}
+
+type candidateHeap struct {
+	items []candidate
+	index map[string]int
+}
+
+func (h *candidateHeap) Len() int           { return len(h.items) }
+func (h *candidateHeap) Less(i, j int) bool { return h.items[i].count < h.items[j].count }
+
+func (h *candidateHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].key] = i
+	h.index[h.items[j].key] = j
+}
+
+func (h *candidateHeap) Push(x any) {
+	c := x.(candidate)
+	h.index[c.key] = len(h.items)
+	h.items = append(h.items, c)
+}
+
+func (h *candidateHeap) Pop() any {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, last.key)
+	return last
+}
@@ -0,0 +1,59 @@
+package stats
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestTopKAccuracy(t *testing.T) {
+	// Ten heavy keys over a long tail of keys seen once
+	var stream []string
+	for i := 0; i < 10; i++ {
+		for n := 0; n < 1000-100*i; n++ {
+			stream = append(stream, fmt.Sprintf("heavy-%d.example", i))
+		}
+	}
+	for i := 0; i < 5000; i++ {
+		stream = append(stream, fmt.Sprintf("tail-%d.example", i))
+	}
+	rng := rand.New(rand.NewPCG(1, 2))
+	rng.Shuffle(len(stream), func(i, j int) { stream[i], stream[j] = stream[j], stream[i] })
+
+	for _, width := range []int{minuteSketchWidth, hourSketchWidth} {
+		t.Run(fmt.Sprint(width), func(t *testing.T) {
+			tk := newTopK(candidatesPerBucket, width, sketchDepth)
+			for _, key := range stream {
+				tk.add(key)
+			}
+
+			b := &bucket{domains: tk}
+			got := top([]*bucket{b}, func(b *bucket) *topK { return b.domains }, 10)
+			maxError := uint64(2 * len(stream) / width)
+			for i, c := range got {
+				name, want := fmt.Sprintf("heavy-%d.example", i), uint64(1000-100*i)
+				if c.Name != name {
+					t.Fatalf("rank %d is %s, want %s: %v", i, c.Name, name, got)
+				}
+				if c.Count < want || c.Count > want+maxError {
+					t.Fatalf("%s counted %d, want %d to %d", name, c.Count, want, want+maxError)
+				}
+			}
+			if len(tk.heap.items) > candidatesPerBucket {
+				t.Fatalf("%d candidates, bound is %d", len(tk.heap.items), candidatesPerBucket)
+			}
+		})
+	}
+}
+
+func TestCountMinSketchNeverUndercounts(t *testing.T) {
+	s := newCountMinSketch(16, sketchDepth)
+	counts := make(map[string]uint32)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprint(i % 97)
+		counts[key]++
+		if est := s.add(key); est < counts[key] {
+			t.Fatalf("%s estimated %d, seen %d", key, est, counts[key])
+		}
+	}
+}
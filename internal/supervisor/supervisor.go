@@ -10,9 +10,18 @@ import (
 	"github.com/Roman-Samoilenko/privacy-hub/internal/config"
 	"github.com/Roman-Samoilenko/privacy-hub/internal/hubctl"
 	"github.com/Roman-Samoilenko/privacy-hub/internal/logger"
+	"github.com/Roman-Samoilenko/privacy-hub/internal/metrics"
 	"github.com/Roman-Samoilenko/privacy-hub/internal/proxyserver"
 )
 
+// Service names reported by the service_up metric
+const (
+	serviceDNSContainer = "dns_container"
+	serviceIPTables     = "iptables"
+	serviceAPI          = "api"
+	serviceProxy        = "proxy"
+)
+
 type Supervisor struct {
 	cfg         *config.Config
 	ctx         context.Context
@@ -27,7 +36,7 @@ type Supervisor struct {
 func New(cfg *config.Config) *Supervisor {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	dockerMgr, err := hubctl.NewDockerManager(cfg.DockerContainer)
+	dockerMgr, err := hubctl.NewDockerManager(cfg.DockerContainer, cfg.DNS)
 	if err != nil {
 		logger.Errorf("Failed to create docker manager: %v", err)
 		cancel()
@@ -39,7 +48,7 @@ func New(cfg *config.Config) *Supervisor {
 		ctx:         ctx,
 		cancel:      cancel,
 		dockerMgr:   dockerMgr,
-		iptablesMgr: hubctl.NewIPTablesManager(cfg.DockerContainer),
+		iptablesMgr: hubctl.NewIPTablesManager(cfg.DNS),
 	}
 }
 
@@ -63,17 +72,22 @@ func (s *Supervisor) Start() error {
 	if err := s.dockerMgr.WaitReady(s.ctx, 30*time.Second); err != nil {
 		return fmt.Errorf("DNS container not ready: %v", err)
 	}
+	metrics.SetServiceUp(serviceDNSContainer, true)
 
 	// Setup iptables
 	if err := s.iptablesMgr.Setup(); err != nil {
 		return fmt.Errorf("failed to setup iptables: %v", err)
 	}
+	metrics.SetServiceUp(serviceIPTables, true)
 
-	// Start API server
+	// Start API server. Resolver endpoints are served by the DNS container
+	// on dns.api_listen, the resolver does not run in this process.
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		if err := api.Start(s.ctx, s.cfg.API); err != nil {
+		metrics.SetServiceUp(serviceAPI, true)
+		defer metrics.SetServiceUp(serviceAPI, false)
+		if err := api.Start(s.ctx, s.cfg.API, nil); err != nil {
 			logger.Errorf("API server error: %v", err)
 		}
 	}()
@@ -82,6 +96,8 @@ func (s *Supervisor) Start() error {
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
+		metrics.SetServiceUp(serviceProxy, true)
+		defer metrics.SetServiceUp(serviceProxy, false)
 		if err := proxyserver.Start(s.ctx, s.cfg.Proxy); err != nil {
 			logger.Errorf("Proxy server error: %v", err)
 		}
@@ -122,6 +138,7 @@ func (s *Supervisor) Stop() error {
 	if err := s.iptablesMgr.Cleanup(); err != nil {
 		logger.Errorf("iptables cleanup error: %v", err)
 	}
+	metrics.SetServiceUp(serviceIPTables, false)
 
 	// Stop container
 	stopCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -130,6 +147,7 @@ func (s *Supervisor) Stop() error {
 	if err := s.dockerMgr.Stop(stopCtx); err != nil {
 		logger.Errorf("Failed to stop DNS container: %v", err)
 	}
+	metrics.SetServiceUp(serviceDNSContainer, false)
 
 	// Close docker client
 	if err := s.dockerMgr.Close(); err != nil {